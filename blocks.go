@@ -0,0 +1,15 @@
+package manifest
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// Block returns the embedded raw data for a cid. ok is false if the cid isn't
+// in the manifest or blocks weren't embedded
+func (m *Manifest) Block(id *cid.Cid) (data []byte, ok bool) {
+	idx := m.IndexOf(id)
+	if idx < 0 || idx >= len(m.Blocks) {
+		return nil, false
+	}
+	return m.Blocks[idx], true
+}
@@ -0,0 +1,60 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestEmbedBlocks(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.Blocks != nil {
+		t.Error("expected blocks to be omitted by default")
+	}
+
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Blocks) != len(mf.Nodes) {
+		t.Fatalf("nodes/blocks length mismatch. %d != %d", len(mf.Nodes), len(mf.Blocks))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := codec.NewEncoder(buf, &codec.CborHandle{}).Encode(mf); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := codec.NewDecoder(buf, &codec.CborHandle{}).Decode(got); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, n := range g {
+		data, ok := got.Block(n.Cid())
+		if !ok {
+			t.Fatalf("missing block for %s", n.Cid().String())
+		}
+		c, err := n.Cid().Prefix().Sum(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !c.Equals(n.Cid()) {
+			t.Errorf("block data for %s hashes to %s", n.Cid().String(), c.String())
+		}
+	}
+
+	if _, ok := got.Block(newNode(kb).Cid()); ok {
+		t.Error("expected missing cid to have no block")
+	}
+}
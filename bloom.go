@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a scalable Bloom filter: a set that may report strings that
+// were never added, at about its false positive rate, but never misses one
+// that was. It grows by adding slices of twice the capacity with half the
+// false positive rate, so the combined rate stays under the target however
+// many strings are added
+type bloomFilter struct {
+	fpr    float64
+	slices []*bloomSlice
+}
+
+// bloomSlice is one fixed capacity Bloom filter
+type bloomSlice struct {
+	bits     []uint64
+	hashes   int
+	capacity int
+	count    int
+}
+
+// bloomCapacity is the number of strings the first slice of a filter holds
+const bloomCapacity = 1024
+
+// newBloomFilter creates a filter with a false positive rate of at most fpr
+func newBloomFilter(fpr float64) *bloomFilter {
+	return &bloomFilter{fpr: fpr}
+}
+
+func newBloomSlice(capacity int, fpr float64) *bloomSlice {
+	// optimal bit & hash counts for capacity strings at the given rate
+	bits := math.Ceil(-float64(capacity) * math.Log(fpr) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomSlice{
+		bits:     make([]uint64, (int(bits)+63)/64),
+		hashes:   hashes,
+		capacity: capacity,
+	}
+}
+
+// add inserts s into the filter
+func (f *bloomFilter) add(s string) {
+	last := len(f.slices) - 1
+	if last < 0 || f.slices[last].count >= f.slices[last].capacity {
+		// slice rates of fpr/2, fpr/4... sum to less than fpr
+		capacity, fpr := bloomCapacity, f.fpr/2
+		if last >= 0 {
+			capacity = f.slices[last].capacity * 2
+			fpr = f.fpr / math.Pow(2, float64(last+2))
+		}
+		f.slices = append(f.slices, newBloomSlice(capacity, fpr))
+		last++
+	}
+	h1, h2 := bloomHashes(s)
+	f.slices[last].add(h1, h2)
+}
+
+// has checks if s may have been added to the filter
+func (f *bloomFilter) has(s string) bool {
+	h1, h2 := bloomHashes(s)
+	for _, sl := range f.slices {
+		if sl.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sl *bloomSlice) add(h1, h2 uint64) {
+	n := uint64(len(sl.bits) * 64)
+	for i := 0; i < sl.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		sl.bits[bit/64] |= 1 << (bit % 64)
+	}
+	sl.count++
+}
+
+func (sl *bloomSlice) has(h1, h2 uint64) bool {
+	n := uint64(len(sl.bits) * 64)
+	for i := 0; i < sl.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if sl.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the two hashes each bit position is combined from
+func bloomHashes(s string) (uint64, uint64) {
+	a, b := fnv.New64a(), fnv.New64()
+	a.Write([]byte(s))
+	b.Write([]byte(s))
+	// a step of 0 would set the same bit for every hash
+	return a.Sum64(), b.Sum64() | 1
+}
@@ -0,0 +1,29 @@
+package manifest
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(0.01)
+	for i := 0; i < 10000; i++ {
+		f.add(fmt.Sprintf("added-%d", i))
+	}
+	for i := 0; i < 10000; i++ {
+		if s := fmt.Sprintf("added-%d", i); !f.has(s) {
+			t.Fatalf("expected %s to be in the filter", s)
+		}
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if f.has(fmt.Sprintf("other-%d", i)) {
+			fp++
+		}
+	}
+	// slack over the 1% target for an unlucky spread
+	if fp > 150 {
+		t.Errorf("expected around 1%% false positives, got: %d in 10000", fp)
+	}
+}
@@ -0,0 +1,238 @@
+package manifest
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// derivedCache holds lookups computed from a manifest's nodes & links, so
+// repeated reads of an unchanged manifest don't recompute them. Each lookup is
+// filled the first time it's needed & all are dropped when the manifest is
+// modified: every exported method that changes Nodes or Links calls
+// Invalidate. It's safe for concurrent readers
+type derivedCache struct {
+	lk sync.Mutex
+	// shape is the node & link count the cache was filled at, so nodes or
+	// links appended directly are noticed. Edits that keep the counts, like
+	// retargeting a link, need an Invalidate
+	shape     [2]int
+	index     map[string]int
+	roots     []int
+	leaves    []int
+	refCounts map[string]int
+	adjacency map[int][]int
+	cids      []*cid.Cid
+	canonical []int
+}
+
+// Invalidate drops lookups cached from the manifest's nodes & links. Methods
+// that modify the manifest invalidate it themselves, call Invalidate after
+// changing Nodes or Links in place
+func (m *Manifest) Invalidate() {
+	m.cache.lk.Lock()
+	defer m.cache.lk.Unlock()
+	m.cache.reset()
+}
+
+// replace sets every field of m to res's under the cache lock, dropping
+// anything cached. Assigning *m directly would swap out the lock
+func (m *Manifest) replace(res *Manifest) {
+	c := m.lock()
+	defer c.lk.Unlock()
+	m.Version, m.Nodes, m.Links, m.Sizes = res.Version, res.Nodes, res.Links, res.Sizes
+	m.Blocks, m.StoredSizes, m.VisitOrder, m.FetchDurations = res.Blocks, res.StoredSizes, res.VisitOrder, res.FetchDurations
+	m.LeafCounts, m.DroppedLinkCounts = res.LeafCounts, res.DroppedLinkCounts
+	m.Boundaries, m.MarkedRoots, m.Missing, m.External = res.Boundaries, res.MarkedRoots, res.Missing, res.External
+	m.DroppedLinks, m.DroppedPerLevel, m.WeakLinks, m.CreatedAt = res.DroppedLinks, res.DroppedPerLevel, res.WeakLinks, res.CreatedAt
+	c.reset()
+}
+
+func (c *derivedCache) reset() {
+	c.shape = [2]int{}
+	c.index = nil
+	c.roots = nil
+	c.leaves = nil
+	c.refCounts = nil
+	c.adjacency = nil
+	c.cids = nil
+	c.canonical = nil
+}
+
+// lock locks the cache for reading or filling, dropping anything cached at a
+// different shape. Callers must unlock
+func (m *Manifest) lock() *derivedCache {
+	c := &m.cache
+	c.lk.Lock()
+	if shape := [2]int{len(m.Nodes), len(m.Links)}; shape != c.shape {
+		c.reset()
+		c.shape = shape
+	}
+	return c
+}
+
+// index is a lookup table of cid key to first index position. The table is
+// shared & must not be modified
+func (m *Manifest) index() map[string]int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.index == nil {
+		c.index = m.buildIndex()
+	}
+	return c.index
+}
+
+// roots returns the indexes of all nodes no other node links to
+func (m *Manifest) roots() []int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.roots == nil {
+		c.roots = append([]int{}, m.findRoots()...)
+	}
+	return append([]int(nil), c.roots...)
+}
+
+// leaves returns the indexes of all nodes that don't link to any node
+func (m *Manifest) leaves() []int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.leaves == nil {
+		c.leaves = []int{}
+		for i, ch := range m.children() {
+			if len(ch) == 0 {
+				c.leaves = append(c.leaves, i)
+			}
+		}
+	}
+	return append([]int(nil), c.leaves...)
+}
+
+// refCounts counts the links pointing to each node, by cid key, so one cid
+// written as different strings is counted once. Nodes no link points to are
+// counted as 0. The map is shared & must not be modified
+func (m *Manifest) refCounts() map[string]int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.refCounts == nil {
+		keys := m.nodeKeys()
+		c.refCounts = make(map[string]int, len(keys))
+		for _, key := range keys {
+			c.refCounts[key] = 0
+		}
+		for _, l := range m.Links {
+			c.refCounts[keys[l[1]]]++
+		}
+	}
+	return c.refCounts
+}
+
+// AdjacencyList maps each node index position that has links to the index
+// positions it links to, in link order. It's only built once for an unchanged
+// manifest, so the map is shared & must not be modified
+func (m *Manifest) AdjacencyList() map[int][]int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.adjacency == nil {
+		c.adjacency = map[int][]int{}
+		for _, l := range m.Links {
+			c.adjacency[l[0]] = append(c.adjacency[l[0]], l[1])
+		}
+	}
+	return c.adjacency
+}
+
+// canonicalOrder lists index positions with nodes sorted by cid string, nodes
+// with the same cid string keeping their relative order. The slice is shared
+// & must not be modified
+func (m *Manifest) canonicalOrder() []int {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.canonical == nil {
+		order := allIndexes(len(m.Nodes))
+		sort.SliceStable(order, func(i, j int) bool { return m.Nodes[order[i]] < m.Nodes[order[j]] })
+		c.canonical = order
+	}
+	return c.canonical
+}
+
+// CIDs parses every node cid, aligned with Nodes. Parsed cids are cached, so
+// only the first call decodes them. CIDs errors with the index position of the
+// first node that isn't a valid cid
+func (m *Manifest) CIDs() ([]*cid.Cid, error) {
+	c := m.lock()
+	defer c.lk.Unlock()
+	if c.cids == nil {
+		ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+		if err != nil {
+			return nil, err
+		}
+		c.cids = ids
+	}
+	return append([]*cid.Cid(nil), c.cids...), nil
+}
+
+// SizeCache remembers node sizes by cid across manifest builds, so blocks
+// shared between many DAGs are only sized once. Use it with the SizeCache
+// option. A SizeCache holds a fixed number of sizes, evicting the least
+// recently used. It's safe for concurrent use
+type SizeCache struct {
+	lk       sync.Mutex
+	capacity int
+	// lru lists entries most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type sizeEntry struct {
+	key  string
+	size uint64
+}
+
+// NewSizeCache creates a size cache holding up to capacity sizes. capacity is
+// at least 1
+func NewSizeCache(capacity int) *SizeCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SizeCache{capacity: capacity, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get returns the cached size of a cid
+func (c *SizeCache) Get(id *cid.Cid) (uint64, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	e, ok := c.entries[id.KeyString()]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(sizeEntry).size, true
+}
+
+// Put caches the size of a cid, evicting the least recently used size if the
+// cache is full
+func (c *SizeCache) Put(id *cid.Cid, size uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	key := id.KeyString()
+	if e, ok := c.entries[key]; ok {
+		e.Value = sizeEntry{key, size}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(sizeEntry{key, size})
+	if c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(sizeEntry).key)
+	}
+}
+
+// Len is the number of sizes cached
+func (c *SizeCache) Len() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.lru.Len()
+}
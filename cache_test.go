@@ -0,0 +1,314 @@
+package manifest
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestCacheInvalidation(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	leaves := mf.leaves()
+	if mf.cache.leaves == nil {
+		t.Fatal("expected leaves to be cached")
+	}
+	// modifying the result mustn't touch the cache
+	leaves[0] = -1
+	if mf.leaves()[0] == -1 {
+		t.Error("expected cached leaves to be copied")
+	}
+
+	// reordering keeps the shape but moves every node
+	mf.Canonicalize()
+	if mf.cache.leaves != nil || mf.cache.index != nil {
+		t.Error("expected canonicalizing to invalidate the cache")
+	}
+	for _, i := range mf.leaves() {
+		if len(mf.children()[i]) != 0 {
+			t.Errorf("expected node %d to be a leaf", i)
+		}
+	}
+
+	// appending directly changes the shape
+	extra := newNode(kb)
+	before := len(mf.roots())
+	mf.Nodes = append(mf.Nodes, extra.Cid().String())
+	mf.Sizes = append(mf.Sizes, kb)
+	if len(mf.roots()) != before+1 {
+		t.Error("expected a node appended directly to be noticed")
+	}
+	if _, ok := mf.index()[extra.Cid().KeyString()]; !ok {
+		t.Error("expected appended node in index")
+	}
+
+	// in-place edits need an explicit invalidate
+	mf.Links[0][1] = len(mf.Nodes) - 1
+	mf.Invalidate()
+	if got, expect := mf.roots(), mf.findRoots(); len(got) != len(expect) || got[len(got)-1] == len(mf.Nodes)-1 {
+		t.Errorf("expected invalidate to drop cached roots. got: %v, expected: %v", got, expect)
+	}
+
+	// remapping & decoding keep the shape, but replace every node
+	mf.index()
+	if err := mf.RemapCIDs(func(*cid.Cid) (*cid.Cid, error) { return newNode(kb).Cid(), nil }); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := mf.index()[cidKey(mf.Nodes[0])]; !ok {
+		t.Error("expected remapping to invalidate the cache")
+	}
+	other, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := other.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf = other.Copy()
+	mf.Nodes[0] = newNode(kb).Cid().String()
+	mf.index()
+	if err := mf.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := mf.index()[g[0].Cid().KeyString()]; !ok {
+		t.Error("expected decoding to invalidate the cache")
+	}
+}
+
+func TestCacheConcurrentReads(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if leaves, err := mf.Leaves(); err != nil || len(leaves) != 4 {
+				t.Errorf("expected 4 leaves, got: %d, %v", len(leaves), err)
+			}
+			if roots, err := mf.Roots(); err != nil || len(roots) != 1 {
+				t.Errorf("expected 1 root, got: %d, %v", len(roots), err)
+			}
+			if counts := mf.RefCounts(); counts[g[len(g)-1].Cid().String()] != 3 {
+				t.Errorf("expected the last leaf to have 3 parents, got: %d", counts[g[len(g)-1].Cid().String()])
+			}
+			mf.Contains(g[1].Cid())
+			mf.Stats()
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkLeaves(b *testing.B) {
+	g := NewGraph([]layer{
+		{10, 4 * kb},
+		{100, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					mf.Invalidate()
+				}
+				mf.leaves()
+			}
+		})
+	}
+}
+
+func TestCIDs(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids, err := mf.CIDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var expect []*cid.Cid
+	for _, n := range mf.Nodes {
+		for _, gn := range g {
+			if gn.Cid().String() == n {
+				expect = append(expect, gn.Cid())
+			}
+		}
+	}
+	expectCids(t, "CIDs", ids, expect...)
+	if mf.cache.cids == nil {
+		t.Error("expected parsed cids to be cached")
+	}
+
+	mf.Nodes[3] = "not a cid"
+	mf.Invalidate()
+	if _, err := mf.CIDs(); err == nil || !strings.Contains(err.Error(), "index 3") {
+		t.Errorf("expected error naming index 3, got: %v", err)
+	}
+}
+
+// sizeCountingNodeGetter counts every node Size call, by cid string
+type sizeCountingNodeGetter struct {
+	format.NodeGetter
+	lk    sync.Mutex
+	sized map[string]int
+}
+
+func (ng *sizeCountingNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	n, err := ng.NodeGetter.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return sizeCountingNode{n, ng}, nil
+}
+
+type sizeCountingNode struct {
+	format.Node
+	ng *sizeCountingNodeGetter
+}
+
+func (n sizeCountingNode) Size() (uint64, error) {
+	n.ng.lk.Lock()
+	n.ng.sized[n.Cid().String()]++
+	n.ng.lk.Unlock()
+	return n.Node.Size()
+}
+
+func TestAdjacencyList(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{2, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var expect []int
+	for _, l := range g[0].Links() {
+		for i, id := range mf.Nodes {
+			if id == l.Cid.String() {
+				expect = append(expect, i)
+			}
+		}
+	}
+	adj := mf.AdjacencyList()
+	if len(expect) != 3 || !reflect.DeepEqual(adj[0], expect) {
+		t.Errorf("expected root to link to %v, got: %v", expect, adj[0])
+	}
+	if len(adj) != 1+3 {
+		t.Errorf("expected an entry for each node with links, got: %d", len(adj))
+	}
+	if mf.cache.adjacency == nil {
+		t.Error("expected adjacency list to be cached")
+	}
+
+	mf.Links = mf.Links[:1]
+	if adj := mf.AdjacencyList(); len(adj) != 1 {
+		t.Errorf("expected adjacency list rebuilt after links change, got: %v", adj)
+	}
+}
+
+func TestSizeCache(t *testing.T) {
+	shared := newNode(4 * kb)
+	shared.links = []*node{newNode(kb), newNode(kb)}
+	a, b := newNode(kb), newNode(kb)
+	a.links = []*node{shared, newNode(kb)}
+	b.links = []*node{shared}
+	ng := &sizeCountingNodeGetter{
+		NodeGetter: TestNodeGetter{[]format.Node{a, b, shared, shared.links[0], shared.links[1], a.links[1]}},
+		sized:      map[string]int{},
+	}
+
+	cache := NewSizeCache(100)
+	var mfs []*Manifest
+	for _, root := range []*node{a, b} {
+		n, _ := ng.Get(context.Background(), root.Cid())
+		mf, err := NewManifestWithOpts(context.Background(), ng, n, Options{SizeCache: cache})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		verifyManifest(t, mf)
+		mfs = append(mfs, mf)
+	}
+	if len(ng.sized) != 6 {
+		t.Errorf("expected all 6 nodes to be sized, got: %d", len(ng.sized))
+	}
+	for id, n := range ng.sized {
+		if n != 1 {
+			t.Errorf("expected %s to be sized once, got: %d", id, n)
+		}
+	}
+	if mfs[1].TotalSize() != kb+4*kb+2*kb {
+		t.Errorf("expected cached sizes in second manifest, got total: %d", mfs[1].TotalSize())
+	}
+}
+
+func TestSizeCacheEviction(t *testing.T) {
+	ids := []*cid.Cid{newNode(kb).Cid(), newNode(kb).Cid(), newNode(kb).Cid()}
+	cache := NewSizeCache(2)
+	cache.Put(ids[0], 1)
+	cache.Put(ids[1], 2)
+	// using the first size makes the second the least recently used
+	if size, ok := cache.Get(ids[0]); !ok || size != 1 {
+		t.Errorf("expected cached size 1, got: %d, %t", size, ok)
+	}
+	cache.Put(ids[2], 3)
+	if cache.Len() != 2 {
+		t.Errorf("expected cache bounded to 2 sizes, got: %d", cache.Len())
+	}
+	if _, ok := cache.Get(ids[1]); ok {
+		t.Error("expected least recently used size to be evicted")
+	}
+	if size, ok := cache.Get(ids[2]); !ok || size != 3 {
+		t.Errorf("expected cached size 3, got: %d, %t", size, ok)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache.Put(ids[i%3], uint64(i))
+			cache.Get(ids[(i+1)%3])
+		}(i)
+	}
+	wg.Wait()
+	if cache.Len() > 2 {
+		t.Errorf("expected cache to stay bounded, got: %d", cache.Len())
+	}
+}
@@ -0,0 +1,270 @@
+package manifest
+
+import (
+	"sort"
+	"time"
+)
+
+// Canonicalize sorts nodes by cid string and links by index position,
+// dropping duplicate links. Any two manifests of the same graph are identical
+// once canonicalized
+func (m *Manifest) Canonicalize() {
+	m.CanonicalizeWith(func(i, j int) bool {
+		return m.Nodes[i] < m.Nodes[j]
+	})
+}
+
+// CanonicalizeWith sorts nodes with less, which compares the nodes at index
+// positions i & j, then sorts links like Canonicalize. Sizes, blocks & every
+// other per-node field are kept aligned. Nodes less considers equal keep their
+// relative order. A frozen manifest is left unchanged
+func (m *Manifest) CanonicalizeWith(less func(i, j int) bool) {
+	if m.frozen {
+		return
+	}
+	order := allIndexes(len(m.Nodes))
+	sort.SliceStable(order, func(i, j int) bool {
+		return less(order[i], order[j])
+	})
+	m.reorder(order)
+
+	m.Links = sortLinks(m.Links)
+	m.WeakLinks = sortLinks(m.WeakLinks)
+	m.Invalidate()
+}
+
+// sortLinks sorts links by index position in place, dropping duplicates
+func sortLinks(links [][2]int) [][2]int {
+	sort.Slice(links, func(i, j int) bool {
+		return linkLess(links[i], links[j])
+	})
+	res := links[:0]
+	for i, l := range links {
+		if i == 0 || l != links[i-1] {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// IsCanonical checks if the manifest is in canonical form
+func (m *Manifest) IsCanonical() bool {
+	for i := 1; i < len(m.Nodes); i++ {
+		if m.Nodes[i-1] >= m.Nodes[i] {
+			return false
+		}
+	}
+	for i := 1; i < len(m.Links); i++ {
+		if !linkLess(m.Links[i-1], m.Links[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// reorder rearranges nodes so that position i holds the node previously at
+// order[i], remapping links to match
+func (m *Manifest) reorder(order []int) {
+	remap := make([]int, len(order))
+	nodes := make([]string, len(order))
+	sizes := make([]uint64, len(order))
+	for i, prev := range order {
+		remap[prev] = i
+		nodes[i] = m.Nodes[prev]
+		sizes[i] = m.Sizes[prev]
+	}
+	m.Nodes = nodes
+	m.Sizes = sizes
+	if m.Blocks != nil {
+		blocks := make([][]byte, len(order))
+		for i, prev := range order {
+			blocks[i] = m.Blocks[prev]
+		}
+		m.Blocks = blocks
+	}
+	if m.StoredSizes != nil {
+		stored := make([]uint64, len(order))
+		for i, prev := range order {
+			stored[i] = m.StoredSizes[prev]
+		}
+		m.StoredSizes = stored
+	}
+	if m.VisitOrder != nil {
+		visits := make([]int, len(order))
+		for i, prev := range order {
+			visits[i] = m.VisitOrder[prev]
+		}
+		m.VisitOrder = visits
+	}
+	if m.FetchDurations != nil {
+		durations := make([]time.Duration, len(order))
+		for i, prev := range order {
+			durations[i] = m.FetchDurations[prev]
+		}
+		m.FetchDurations = durations
+	}
+	if m.LeafCounts != nil {
+		counts := make([]int, len(order))
+		for i, prev := range order {
+			counts[i] = m.LeafCounts[prev]
+		}
+		m.LeafCounts = counts
+	}
+	if m.DroppedLinkCounts != nil {
+		counts := make([]int, len(order))
+		for i, prev := range order {
+			counts[i] = m.DroppedLinkCounts[prev]
+		}
+		m.DroppedLinkCounts = counts
+	}
+	for i, l := range m.Links {
+		m.Links[i] = [2]int{remap[l[0]], remap[l[1]]}
+	}
+	for i, l := range m.WeakLinks {
+		m.WeakLinks[i] = [2]int{remap[l[0]], remap[l[1]]}
+	}
+	for _, set := range m.indexSets() {
+		*set = remapIndexes(*set, remap)
+		sort.Ints(*set)
+	}
+	m.Invalidate()
+}
+
+func linkLess(a, b [2]int) bool {
+	if a[0] != b[0] {
+		return a[0] < b[0]
+	}
+	return a[1] < b[1]
+}
+
+// ByCID returns a sort.Interface ordering nodes by cid string. Sorting it
+// mutates the manifest, moving sizes, blocks & every other per-node field
+// along with each node & remapping links to match. Boundaries & the other
+// index sets follow their nodes but keep their entry order, so they aren't
+// re-sorted the way Canonicalize leaves them. Sorting a frozen manifest
+// leaves it unchanged
+func (m *Manifest) ByCID() sort.Interface {
+	return newNodeSorter(m, func(i, j int) bool { return m.Nodes[i] < m.Nodes[j] })
+}
+
+// BySize returns a sort.Interface ordering nodes by ascending size. Like
+// ByCID, sorting it mutates the manifest. Use sort.Stable to keep nodes of
+// the same size in their relative order
+func (m *Manifest) BySize() sort.Interface {
+	return newNodeSorter(m, func(i, j int) bool { return m.Sizes[i] < m.Sizes[j] })
+}
+
+// nodeSorter sorts manifest nodes in place, tracking which links & index set
+// entries touch each node so a swap only remaps the ones it affects
+type nodeSorter struct {
+	m    *Manifest
+	less func(i, j int) bool
+	// links & weak hold the positions in Links & WeakLinks of every link
+	// touching each node
+	links, weak [][]int
+	// entries holds the set & position of every index set entry for each node
+	entries [][][2]int
+	// dirty is set once the first swap has invalidated the cache
+	dirty bool
+}
+
+func newNodeSorter(m *Manifest, less func(i, j int) bool) *nodeSorter {
+	return &nodeSorter{
+		m:       m,
+		less:    less,
+		links:   incidentLinks(len(m.Nodes), m.Links),
+		weak:    incidentLinks(len(m.Nodes), m.WeakLinks),
+		entries: setEntries(len(m.Nodes), m.indexSets()),
+	}
+}
+
+// setEntries lists the set & position of the index set entries for each of
+// n nodes
+func setEntries(n int, sets []*[]int) [][][2]int {
+	entries := make([][][2]int, n)
+	for s, set := range sets {
+		for k, v := range *set {
+			entries[v] = append(entries[v], [2]int{s, k})
+		}
+	}
+	return entries
+}
+
+// incidentLinks lists the positions of the links touching each of n nodes
+func incidentLinks(n int, links [][2]int) [][]int {
+	inc := make([][]int, n)
+	for k, l := range links {
+		inc[l[0]] = append(inc[l[0]], k)
+		if l[1] != l[0] {
+			inc[l[1]] = append(inc[l[1]], k)
+		}
+	}
+	return inc
+}
+
+func (s *nodeSorter) Len() int           { return len(s.m.Nodes) }
+func (s *nodeSorter) Less(i, j int) bool { return s.less(i, j) }
+func (s *nodeSorter) Swap(i, j int) {
+	if i == j || s.m.frozen {
+		return
+	}
+	m := s.m
+	if !s.dirty {
+		m.Invalidate()
+		s.dirty = true
+	}
+	m.Nodes[i], m.Nodes[j] = m.Nodes[j], m.Nodes[i]
+	m.Sizes[i], m.Sizes[j] = m.Sizes[j], m.Sizes[i]
+	if m.Blocks != nil {
+		m.Blocks[i], m.Blocks[j] = m.Blocks[j], m.Blocks[i]
+	}
+	if m.StoredSizes != nil {
+		m.StoredSizes[i], m.StoredSizes[j] = m.StoredSizes[j], m.StoredSizes[i]
+	}
+	if m.VisitOrder != nil {
+		m.VisitOrder[i], m.VisitOrder[j] = m.VisitOrder[j], m.VisitOrder[i]
+	}
+	if m.FetchDurations != nil {
+		m.FetchDurations[i], m.FetchDurations[j] = m.FetchDurations[j], m.FetchDurations[i]
+	}
+	if m.LeafCounts != nil {
+		m.LeafCounts[i], m.LeafCounts[j] = m.LeafCounts[j], m.LeafCounts[i]
+	}
+	if m.DroppedLinkCounts != nil {
+		m.DroppedLinkCounts[i], m.DroppedLinkCounts[j] = m.DroppedLinkCounts[j], m.DroppedLinkCounts[i]
+	}
+
+	swap := func(v int) int {
+		switch v {
+		case i:
+			return j
+		case j:
+			return i
+		}
+		return v
+	}
+	swapLinks(m.Links, s.links, i, j, swap)
+	swapLinks(m.WeakLinks, s.weak, i, j, swap)
+	sets := m.indexSets()
+	for _, e := range s.entries[i] {
+		(*sets[e[0]])[e[1]] = j
+	}
+	for _, e := range s.entries[j] {
+		(*sets[e[0]])[e[1]] = i
+	}
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+// swapLinks remaps the links touching nodes i & j after they trade places
+func swapLinks(links [][2]int, inc [][]int, i, j int, swap func(int) int) {
+	for _, k := range inc[i] {
+		links[k] = [2]int{swap(links[k][0]), swap(links[k][1])}
+	}
+	for _, k := range inc[j] {
+		// links between i & j were already remapped
+		if l := links[k]; l[0] != i && l[1] != i {
+			links[k] = [2]int{swap(l[0]), swap(l[1])}
+		}
+	}
+	inc[i], inc[j] = inc[j], inc[i]
+}
@@ -0,0 +1,130 @@
+package manifest
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{5, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// reverse node order & duplicate a link
+	shuffled := mf.Copy()
+	order := make([]int, len(shuffled.Nodes))
+	for i := range order {
+		order[i] = len(order) - 1 - i
+	}
+	shuffled.reorder(order)
+	shuffled.Links = append(shuffled.Links, shuffled.Links[0])
+
+	mf.Canonicalize()
+	shuffled.Canonicalize()
+	if !mf.IsCanonical() {
+		t.Error("expected manifest to be canonical")
+	}
+	if !reflect.DeepEqual(mf, shuffled) {
+		t.Error("expected canonicalized manifests to be identical")
+	}
+}
+
+func TestCanonicalizeWith(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{5, 256 * kb},
+	})
+	ng := storedSizeNodeGetter{TestNodeGetter{g}}
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mf.AddRoot(g[1].Cid()); err != nil {
+		t.Fatal(err.Error())
+	}
+	orig := mf.Copy()
+
+	mf.CanonicalizeWith(func(i, j int) bool {
+		return mf.Sizes[i] > mf.Sizes[j]
+	})
+	verifyManifest(t, mf)
+	if !mf.Equal(orig) {
+		t.Error("expected reordered manifest to equal the original")
+	}
+	for i := 1; i < len(mf.Sizes); i++ {
+		if mf.Sizes[i-1] < mf.Sizes[i] {
+			t.Errorf("expected sizes to descend, %d < %d at %d", mf.Sizes[i-1], mf.Sizes[i], i)
+		}
+	}
+	idx := orig.index()
+	for i, key := range mf.nodeKeys() {
+		j := idx[key]
+		if mf.Sizes[i] != orig.Sizes[j] || mf.StoredSizes[i] != orig.StoredSizes[j] || !reflect.DeepEqual(mf.Blocks[i], orig.Blocks[j]) {
+			t.Errorf("aligned fields out of sync for node %d", i)
+		}
+	}
+	if len(mf.MarkedRoots) != 1 || mf.Nodes[mf.MarkedRoots[0]] != g[1].Cid().String() {
+		t.Error("expected marked root to follow its node")
+	}
+}
+
+func TestSortInterfaces(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{3, 4 * kb},
+		{4, 5 * kb},
+		{2, 256 * kb},
+	})
+	ng := storedSizeNodeGetter{TestNodeGetter{g}}
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{EmbedBlocks: true, RecordVisitOrder: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mf.AddRoot(g[1].Cid()); err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Boundaries = []int{1, len(mf.Nodes) - 1}
+	orig := mf.Copy()
+	// warm the cache so sorting has to invalidate it
+	mf.roots()
+
+	sort.Sort(mf.BySize())
+	if !sort.IsSorted(mf.BySize()) {
+		t.Error("expected nodes sorted by size")
+	}
+	verifyManifest(t, mf)
+	if !mf.Equal(orig) {
+		t.Error("expected sorted manifest to equal the original")
+	}
+	idx := orig.index()
+	for i, key := range mf.nodeKeys() {
+		j := idx[key]
+		if mf.Sizes[i] != orig.Sizes[j] || mf.StoredSizes[i] != orig.StoredSizes[j] || mf.VisitOrder[i] != orig.VisitOrder[j] || !reflect.DeepEqual(mf.Blocks[i], orig.Blocks[j]) {
+			t.Errorf("aligned fields out of sync for node %d", i)
+		}
+	}
+	if len(mf.MarkedRoots) != 1 || mf.Nodes[mf.MarkedRoots[0]] != g[1].Cid().String() {
+		t.Error("expected marked root to follow its node")
+	}
+	if len(mf.Boundaries) != 2 || mf.Nodes[mf.Boundaries[0]] != orig.Nodes[1] || mf.Nodes[mf.Boundaries[1]] != orig.Nodes[len(orig.Nodes)-1] {
+		t.Error("expected boundaries to follow their nodes")
+	}
+	if !reflect.DeepEqual(mf.roots(), mf.findRoots()) {
+		t.Error("expected cached roots to be invalidated by sorting")
+	}
+
+	sort.Sort(mf.ByCID())
+	if !sort.IsSorted(mf.ByCID()) {
+		t.Error("expected nodes sorted by cid")
+	}
+	if !mf.Equal(orig) {
+		t.Error("expected sorted manifest to equal the original")
+	}
+}
@@ -0,0 +1,317 @@
+package manifest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+	"github.com/ugorji/go/codec"
+)
+
+// ManifestFromCARDir builds one manifest spanning DAG shards stored as .car
+// files in dir. Every CARv1 file in dir is indexed, then the DAG is walked
+// from roots reading each block from whichever shard holds it. Blocks are
+// read as they're visited, only their positions are kept in memory. Raw,
+// dag-pb & dag-cbor blocks can be decoded, the size of each node is the
+// length of its block. ManifestFromCARDir errors if a root or linked block
+// isn't in any shard
+func ManifestFromCARDir(ctx context.Context, dir string, roots []*cid.Cid) (*Manifest, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.car"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ng := &carNodeGetter{blocks: map[string]carBlock{}}
+	defer ng.close()
+	for _, p := range paths {
+		if err := ng.index(p); err != nil {
+			return nil, fmt.Errorf("indexing %s: %s", p, err.Error())
+		}
+	}
+
+	manifests := make([]*Manifest, len(roots))
+	for i, r := range roots {
+		node, err := ng.Get(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if manifests[i], err = NewManifest(ctx, ng, node); err != nil {
+			return nil, err
+		}
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	return Union(manifests...), nil
+}
+
+// carBlock is the position of a block's data in a CAR file
+type carBlock struct {
+	file   *os.File
+	offset int64
+	length int
+}
+
+// carNodeGetter fetches nodes from an index of blocks across CAR files
+type carNodeGetter struct {
+	files  []*os.File
+	blocks map[string]carBlock
+}
+
+// index reads the block positions of a CAR file. Blocks already indexed from
+// another file are skipped
+func (ng *carNodeGetter) index(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	ng.files = append(ng.files, f)
+
+	r := &countingReader{r: bufio.NewReader(f)}
+	hlen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	// the header only lists the file's own roots, which aren't needed
+	if _, err := io.CopyN(ioutil.Discard, r, int64(hlen)); err != nil {
+		return err
+	}
+
+	for {
+		start := r.n
+		slen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		section := make([]byte, slen)
+		if _, err := io.ReadFull(r, section); err != nil {
+			return fmt.Errorf("reading block at offset %d: %s", start, err.Error())
+		}
+		n, err := cidLength(section)
+		if err != nil {
+			return fmt.Errorf("reading block at offset %d: %s", start, err.Error())
+		}
+		id, err := cid.Cast(section[:n])
+		if err != nil {
+			return fmt.Errorf("reading block at offset %d: %s", start, err.Error())
+		}
+		if _, ok := ng.blocks[id.KeyString()]; !ok {
+			ng.blocks[id.KeyString()] = carBlock{file: f, offset: r.n - int64(len(section)-n), length: len(section) - n}
+		}
+	}
+}
+
+func (ng *carNodeGetter) close() {
+	for _, f := range ng.files {
+		f.Close()
+	}
+}
+
+// Get reads & decodes a block from the shard that holds it
+func (ng *carNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b, ok := ng.blocks[id.KeyString()]
+	if !ok {
+		return nil, fmt.Errorf("block not found in any CAR shard: %s", id.String())
+	}
+	data := make([]byte, b.length)
+	if _, err := b.file.ReadAt(data, b.offset); err != nil {
+		return nil, err
+	}
+	return decodeBlock(id, data)
+}
+
+// countingReader tracks how many bytes have been read
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// cidLength finds the length of the binary cid at the start of data
+func cidLength(data []byte) (int, error) {
+	// version 0 cids are a bare sha2-256 multihash
+	if len(data) >= 34 && data[0] == 0x12 && data[1] == 0x20 {
+		return 34, nil
+	}
+	n := 0
+	// version, codec, hash function & digest length
+	var vals [4]uint64
+	for i := range vals {
+		v, l := binary.Uvarint(data[n:])
+		if l <= 0 {
+			return 0, fmt.Errorf("invalid cid")
+		}
+		vals[i] = v
+		n += l
+	}
+	if vals[3] > uint64(len(data)-n) {
+		return 0, fmt.Errorf("invalid cid: digest out of range")
+	}
+	return n + int(vals[3]), nil
+}
+
+// decodeBlock decodes a block into a node, reading its links according to
+// the codec of its cid
+func decodeBlock(id *cid.Cid, data []byte) (format.Node, error) {
+	var ids []*cid.Cid
+	var err error
+	switch id.Type() {
+	case cid.Raw:
+	case cid.DagProtobuf:
+		ids, err = dagPBLinks(data)
+	case cid.DagCBOR:
+		ids, err = dagCBORLinks(data)
+	default:
+		return nil, UnknownCodecError{Cid: id, Codec: id.Type()}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %s", id.String(), err.Error())
+	}
+
+	links := make([]*format.Link, len(ids))
+	for i, l := range ids {
+		links[i] = &format.Link{Name: strconv.Itoa(i), Cid: l}
+	}
+	return &ipldNode{cid: id, data: data, links: links}, nil
+}
+
+// dagPBLinks reads the hashes of the links of a dag-pb node. Links are field 2
+// of the node & their hash is field 1 of each link
+func dagPBLinks(data []byte) ([]*cid.Cid, error) {
+	var ids []*cid.Cid
+	err := protoFields(data, func(field uint64, value []byte) error {
+		if field != 2 {
+			return nil
+		}
+		return protoFields(value, func(field uint64, value []byte) error {
+			if field != 1 {
+				return nil
+			}
+			id, err := cid.Cast(value)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// protoFields calls f with each length-delimited field of a protobuf message,
+// skipping fields of other wire types
+func protoFields(data []byte, f func(field uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		data = data[n:]
+
+		size := 0
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			size = n
+		case 1:
+			size = 8
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return fmt.Errorf("invalid protobuf field length")
+			}
+			if err := f(key>>3, data[n:n+int(l)]); err != nil {
+				return err
+			}
+			size = n + int(l)
+		case 5:
+			size = 4
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if size > len(data) {
+			return fmt.Errorf("truncated protobuf field")
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// dagCBORLinks finds every cid linked from a dag-cbor node, in the order they
+// appear
+func dagCBORLinks(data []byte) ([]*cid.Cid, error) {
+	var v interface{}
+	if err := codec.NewDecoderBytes(data, &codec.CborHandle{}).Decode(&v); err != nil {
+		return nil, err
+	}
+	var ids []*cid.Cid
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch val := v.(type) {
+		case codec.RawExt:
+			raw, ok := val.Value.([]byte)
+			if val.Tag != cborLinkTag || !ok || len(raw) == 0 || raw[0] != 0 {
+				return nil
+			}
+			id, err := cid.Cast(raw[1:])
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		case []interface{}:
+			for _, e := range val {
+				if err := walk(e); err != nil {
+					return err
+				}
+			}
+		case map[interface{}]interface{}:
+			// map entries are walked in key order so links are found in a
+			// consistent order
+			keys := make([]string, 0, len(val))
+			byKey := map[string]interface{}{}
+			for k, e := range val {
+				ks := fmt.Sprint(k)
+				keys = append(keys, ks)
+				byKey[ks] = e
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := walk(byKey[k]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return ids, walk(v)
+}
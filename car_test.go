@@ -0,0 +1,170 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/ugorji/go/codec"
+)
+
+// carBlockData is a block to write to a test CAR file
+type carBlockData struct {
+	id   *cid.Cid
+	data []byte
+}
+
+func sumBlock(t *testing.T, codec uint64, data []byte) carBlockData {
+	t.Helper()
+	id, err := cid.Prefix{Version: 1, Codec: codec, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return carBlockData{id, data}
+}
+
+func cborLink(id *cid.Cid) codec.RawExt {
+	return codec.RawExt{Tag: cborLinkTag, Value: append([]byte{0}, id.Bytes()...)}
+}
+
+func cborBlock(t *testing.T, links ...*cid.Cid) carBlockData {
+	t.Helper()
+	node := map[string]interface{}{"name": "node"}
+	var ls []interface{}
+	for _, l := range links {
+		ls = append(ls, cborLink(l))
+	}
+	node["links"] = ls
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, cborHandle).Encode(node); err != nil {
+		t.Fatal(err.Error())
+	}
+	return sumBlock(t, cid.DagCBOR, data)
+}
+
+func protoField(buf *bytes.Buffer, field uint64, value []byte) {
+	writeUvarint(buf, field<<3|2)
+	writeUvarint(buf, uint64(len(value)))
+	buf.Write(value)
+}
+
+func pbBlock(t *testing.T, links ...*cid.Cid) carBlockData {
+	t.Helper()
+	node := &bytes.Buffer{}
+	for _, l := range links {
+		link := &bytes.Buffer{}
+		protoField(link, 1, l.Bytes())
+		protoField(link, 2, []byte("child"))
+		writeUvarint(link, 3<<3)
+		writeUvarint(link, 100)
+		protoField(node, 2, link.Bytes())
+	}
+	protoField(node, 1, []byte("unixfs data"))
+	return sumBlock(t, cid.DagProtobuf, node.Bytes())
+}
+
+func writeCAR(t *testing.T, path string, roots []*cid.Cid, blocks ...carBlockData) {
+	t.Helper()
+	var rs []interface{}
+	for _, r := range roots {
+		rs = append(rs, cborLink(r))
+	}
+	var header []byte
+	if err := codec.NewEncoderBytes(&header, cborHandle).Encode(map[string]interface{}{"roots": rs, "version": 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	writeUvarint(buf, uint64(len(header)))
+	buf.Write(header)
+	for _, b := range blocks {
+		writeUvarint(buf, uint64(len(b.id.Bytes())+len(b.data)))
+		buf.Write(b.id.Bytes())
+		buf.Write(b.data)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestManifestFromCARDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-car")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	l1 := sumBlock(t, cid.Raw, []byte("leaf 1"))
+	l2 := sumBlock(t, cid.Raw, []byte("leaf 2"))
+	l3 := sumBlock(t, cid.Raw, []byte("leaf 3"))
+	mid1 := pbBlock(t, l1.id, l2.id)
+	mid2 := cborBlock(t, l3.id, l2.id)
+	root := cborBlock(t, mid1.id, mid2.id)
+
+	writeCAR(t, filepath.Join(dir, "a.car"), []*cid.Cid{root.id}, root, mid1, l1)
+	writeCAR(t, filepath.Join(dir, "b.car"), []*cid.Cid{mid2.id}, mid2, l2, l3, l1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a car"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mf, err := ManifestFromCARDir(context.Background(), dir, []*cid.Cid{root.id})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != 6 || len(mf.Links) != 6 {
+		t.Errorf("expected 6 nodes & 6 links, got: %d, %d", len(mf.Nodes), len(mf.Links))
+	}
+	for _, b := range []carBlockData{root, mid1, mid2, l1, l2, l3} {
+		idx := mf.IndexOf(b.id)
+		if idx < 0 {
+			t.Errorf("expected %s in manifest", b.id)
+		} else if mf.Sizes[idx] != uint64(len(b.data)) {
+			t.Errorf("expected size of %s to be its block length %d, got: %d", b.id, len(b.data), mf.Sizes[idx])
+		}
+	}
+	expectCids(t, "dag-pb children", childCids(t, mf, mid1.id), l1.id, l2.id)
+	// l2 is reached through mid1 first, so comes before l3
+	expectCids(t, "dag-cbor children", childCids(t, mf, mid2.id), l2.id, l3.id)
+
+	// two roots are combined into one manifest
+	other := sumBlock(t, cid.Raw, []byte("other root"))
+	writeCAR(t, filepath.Join(dir, "c.car"), []*cid.Cid{other.id}, other)
+	mf, err = ManifestFromCARDir(context.Background(), dir, []*cid.Cid{root.id, other.id})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Nodes) != 7 || !mf.Contains(other.id) {
+		t.Errorf("expected both roots in the manifest, got %d nodes", len(mf.Nodes))
+	}
+
+	if _, err := ManifestFromCARDir(context.Background(), dir, []*cid.Cid{sumBlock(t, cid.Raw, []byte("nowhere")).id}); err == nil {
+		t.Error("expected a root missing from every shard to error")
+	}
+	if err := os.Remove(filepath.Join(dir, "b.car")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ManifestFromCARDir(context.Background(), dir, []*cid.Cid{root.id}); err == nil {
+		t.Error("expected a linked block missing from every shard to error")
+	}
+}
+
+func TestCidLength(t *testing.T) {
+	for _, id := range []*cid.Cid{newNode(kb).Cid(), cid.NewCidV0(newNode(kb).Cid().Hash())} {
+		data := append(id.Bytes(), "trailing"...)
+		n, err := cidLength(data)
+		if err != nil || n != len(id.Bytes()) {
+			t.Errorf("expected length %d for %s, got: %d, %v", len(id.Bytes()), id, n, err)
+		}
+	}
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := cidLength(buf[:binary.PutUvarint(buf[:], 1)]); err == nil {
+		t.Error("expected truncated cid to error")
+	}
+}
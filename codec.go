@@ -0,0 +1,89 @@
+package manifest
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// UnknownCodecError is returned by codec-aware operations when a cid uses a
+// codec the operation can't handle
+type UnknownCodecError struct {
+	Cid   *cid.Cid
+	Codec uint64
+}
+
+// Error implements the error interface
+func (e UnknownCodecError) Error() string {
+	return fmt.Sprintf("unknown codec 0x%x for cid %s", e.Codec, e.Cid.String())
+}
+
+// FilterByCodec returns a new manifest of only the nodes encoded with one of
+// codecs. Links to nodes that are filtered out are dropped. FilterByCodec
+// returns an UnknownCodecError for any cid with an unregistered codec, since
+// there's no telling what it should match
+func (m *Manifest) FilterByCodec(codecs ...uint64) (*Manifest, error) {
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return nil, err
+	}
+
+	want := map[uint64]bool{}
+	for _, c := range codecs {
+		want[c] = true
+	}
+	keep := make([]bool, len(ids))
+	for i, id := range ids {
+		if _, ok := cid.CodecToStr[id.Type()]; !ok {
+			return nil, UnknownCodecError{Cid: id, Codec: id.Type()}
+		}
+		keep[i] = want[id.Type()]
+	}
+	return m.subManifest(keep), nil
+}
+
+// NormalizeCIDs rewrites every cid in the manifest to the given cid version.
+// Only dag-pb cids can be represented as version 0, NormalizeCIDs returns an
+// UnknownCodecError if asked to convert any other codec. If an error is
+// returned the manifest is left unchanged
+func (m *Manifest) NormalizeCIDs(version uint64) error {
+	return m.RemapCIDs(func(id *cid.Cid) (*cid.Cid, error) {
+		if id.Version() == version {
+			return id, nil
+		}
+		switch version {
+		case 0:
+			if id.Type() != cid.DagProtobuf {
+				return nil, UnknownCodecError{Cid: id, Codec: id.Type()}
+			}
+			if id.Prefix().MhType != multihash.SHA2_256 {
+				return nil, fmt.Errorf("can't convert %s to cid version 0: hash must be sha2-256", id.String())
+			}
+			return cid.NewCidV0(id.Hash()), nil
+		case 1:
+			return cid.NewCidV1(id.Type(), id.Hash()), nil
+		}
+		return nil, fmt.Errorf("unsupported cid version: %d", version)
+	})
+}
+
+// RequireHash lists the distinct cids in the manifest that aren't hashed with
+// the multihash function mhType, in index order. An empty list means every
+// cid conforms
+func (m *Manifest) RequireHash(mhType uint64) ([]*cid.Cid, error) {
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []*cid.Cid
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id.Prefix().MhType != mhType && !seen[id.KeyString()] {
+			seen[id.KeyString()] = true
+			bad = append(bad, id)
+		}
+	}
+	return bad, nil
+}
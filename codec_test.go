@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestNormalizeCIDs(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// raw cids can't be represented as v0
+	before := mf.Copy()
+	err = mf.NormalizeCIDs(0)
+	var uce UnknownCodecError
+	if !errors.As(err, &uce) {
+		t.Fatalf("expected UnknownCodecError, got: %v", err)
+	}
+	if uce.Codec != cid.Raw || !mf.Contains(uce.Cid) {
+		t.Errorf("unexpected error fields: %+v", uce)
+	}
+	if !mf.Equal(before) {
+		t.Error("expected failed normalize to leave manifest unchanged")
+	}
+
+	if err := mf.NormalizeCIDs(1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !mf.Equal(before) {
+		t.Error("expected normalizing v1 cids to v1 to be a no-op")
+	}
+
+	// dag-pb round trips through v0
+	pb, err := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("pb"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf = &Manifest{Nodes: []string{pb.String()}, Sizes: []uint64{1}}
+	if err := mf.NormalizeCIDs(0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if id, err := cid.Decode(mf.Nodes[0]); err != nil || id.Version() != 0 || id.Hash().B58String() != pb.Hash().B58String() {
+		t.Errorf("expected dag-pb cid to convert to v0, got: %s", mf.Nodes[0])
+	}
+}
+
+func TestFilterByCodec(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pb, err := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("pb"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Nodes = append(mf.Nodes, pb.String())
+	mf.Sizes = append(mf.Sizes, 1)
+	mf.Links = append(mf.Links, [2]int{0, len(mf.Nodes) - 1})
+
+	raw, err := mf.FilterByCodec(cid.Raw)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, raw)
+	if len(raw.Nodes) != len(g) || raw.Contains(pb) {
+		t.Errorf("expected only raw nodes to be kept, got %d nodes", len(raw.Nodes))
+	}
+
+	unknown, err := cid.Prefix{Version: 1, Codec: 0x300001, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("?"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Nodes = append(mf.Nodes, unknown.String())
+	mf.Sizes = append(mf.Sizes, 1)
+	var uce UnknownCodecError
+	if _, err := mf.FilterByCodec(cid.Raw); !errors.As(err, &uce) || !uce.Cid.Equals(unknown) {
+		t.Errorf("expected UnknownCodecError for %s, got: %v", unknown, err)
+	}
+}
+
+func TestRequireHash(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bad, err := mf.RequireHash(multihash.SHA2_256); err != nil || len(bad) != 0 {
+		t.Errorf("expected all sha2-256 cids to conform, got: %v, %v", bad, err)
+	}
+
+	// rehash a couple of leaves with blake2b
+	pref := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.BLAKE2B_MIN + 31, MhLength: -1}
+	var expect []*cid.Cid
+	for _, i := range []int{2, 5} {
+		id, err := pref.Sum(g[i].RawData())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mf.Nodes[i] = id.String()
+		expect = append(expect, id)
+	}
+
+	bad, err := mf.RequireHash(multihash.SHA2_256)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "non-conforming", bad, expect...)
+}
@@ -0,0 +1,99 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Completion tracks which nodes of a manifest have been fetched. Completion is
+// aligned with the Nodes of the manifest it describes
+type Completion []bool
+
+// NewCompletion creates a completion for m with no nodes complete
+func NewCompletion(m *Manifest) Completion {
+	return make(Completion, len(m.Nodes))
+}
+
+// Complete checks if every node is complete
+func (c Completion) Complete() bool {
+	for _, done := range c {
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
+// CompletedCount is the number of complete nodes
+func (c Completion) CompletedCount() int {
+	n := 0
+	for _, done := range c {
+		if done {
+			n++
+		}
+	}
+	return n
+}
+
+// MigrateCompletion builds a completion for newM, marking complete every node
+// whose cid was complete in oldM. Use it to keep download progress when moving
+// to a new version of a manifest
+func MigrateCompletion(oldM *Manifest, oldC Completion, newM *Manifest) Completion {
+	done := map[string]bool{}
+	for i, key := range oldM.nodeKeys() {
+		if i < len(oldC) && oldC[i] {
+			done[key] = true
+		}
+	}
+
+	c := NewCompletion(newM)
+	for i, key := range newM.nodeKeys() {
+		c[i] = done[key]
+	}
+	return c
+}
+
+// Marshal packs the completion into bytes: a uvarint node count followed by
+// one bit per node, lowest bit first
+func (c Completion) Marshal() []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+(len(c)+7)/8)
+	buf = buf[:binary.PutUvarint(buf, uint64(len(c)))]
+	bits := make([]byte, (len(c)+7)/8)
+	for i, done := range c {
+		if done {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return append(buf, bits...)
+}
+
+// UnmarshalCompletion decodes a completion written by Marshal
+func UnmarshalCompletion(data []byte) (Completion, error) {
+	n, read := binary.Uvarint(data)
+	if read <= 0 {
+		return nil, fmt.Errorf("invalid completion length")
+	}
+	bits := data[read:]
+	if uint64(len(bits)) != (n+7)/8 {
+		return nil, fmt.Errorf("completion length mismatch. %d nodes needs %d bytes, got %d", n, (n+7)/8, len(bits))
+	}
+
+	c := make(Completion, n)
+	for i := range c {
+		c[i] = bits[i/8]&(1<<uint(i%8)) != 0
+	}
+	return c, nil
+}
+
+// UnmarshalCompletionFor decodes a completion written by Marshal, checking that
+// it describes the same number of nodes as m
+func UnmarshalCompletionFor(m *Manifest, data []byte) (Completion, error) {
+	c, err := UnmarshalCompletion(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) != len(m.Nodes) {
+		return nil, fmt.Errorf("completion/nodes length mismatch. %d != %d", len(c), len(m.Nodes))
+	}
+	return c, nil
+}
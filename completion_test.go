@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateCompletion(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	a, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// complete the first subtree of a
+	shared := root.links[0]
+	oldC := NewCompletion(a)
+	for _, n := range append([]*node{shared}, shared.links...) {
+		oldC[a.IndexOf(n.Cid())] = true
+	}
+
+	// b replaces the root & second subtree, keeping the first
+	rootB := newNode(2 * kb)
+	added := newNode(kb)
+	rootB.links = []*node{added, shared}
+	b, err := NewManifest(context.Background(), TestNodeGetter{append(g, rootB, added)}, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c := MigrateCompletion(a, oldC, b)
+	if len(c) != len(b.Nodes) {
+		t.Fatalf("expected completion aligned with new manifest, got length %d for %d nodes", len(c), len(b.Nodes))
+	}
+	if c.CompletedCount() != 4 {
+		t.Errorf("expected 4 complete nodes, got: %d", c.CompletedCount())
+	}
+	for _, n := range append([]*node{shared}, shared.links...) {
+		if !c[b.IndexOf(n.Cid())] {
+			t.Errorf("expected shared node %s to start complete", n.Cid().String())
+		}
+	}
+	for _, n := range []*node{rootB, added} {
+		if c[b.IndexOf(n.Cid())] {
+			t.Errorf("expected new node %s to be incomplete", n.Cid().String())
+		}
+	}
+	if c.Complete() {
+		t.Error("expected migrated completion to be incomplete")
+	}
+}
+
+func TestCompletionMarshal(t *testing.T) {
+	for _, c := range []Completion{
+		{},
+		{true},
+		{false, true, true, false, false, false, false, true, true},
+		make(Completion, 100),
+	} {
+		data := c.Marshal()
+		got, err := UnmarshalCompletion(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !reflect.DeepEqual(c, got) {
+			t.Errorf("round trip mismatch. expected: %v, got: %v", c, got)
+		}
+	}
+
+	if _, err := UnmarshalCompletion(nil); err == nil {
+		t.Error("expected empty data to error")
+	}
+	if _, err := UnmarshalCompletion(Completion{true, true}.Marshal()[:1]); err == nil {
+		t.Error("expected truncated bitmap to error")
+	}
+}
+
+func TestUnmarshalCompletionFor(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c := NewCompletion(mf)
+	c[0] = true
+	got, err := UnmarshalCompletionFor(mf, c.Marshal())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(c, got) {
+		t.Error("round trip mismatch")
+	}
+
+	if _, err := UnmarshalCompletionFor(mf, c[1:].Marshal()); err == nil {
+		t.Error("expected length mismatched bitmap to error")
+	}
+}
@@ -0,0 +1,42 @@
+package manifest
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// CountDAG walks the DAG under root counting distinct nodes & their total
+// size, without building a manifest. Useful as a cheap check before generating
+// a full manifest. Like TotalSize, bytes saturates to math.MaxUint64 on overflow
+func CountDAG(ctx context.Context, ng format.NodeGetter, root *cid.Cid) (nodes int, bytes uint64, err error) {
+	visited := map[string]bool{root.KeyString(): true}
+	stack := []*cid.Cid{root}
+
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nodes, bytes, err
+		}
+
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node, err := ng.Get(ctx, id)
+		if err != nil {
+			return nodes, bytes, err
+		}
+
+		size, _ := node.Size()
+		nodes++
+		bytes, _ = sumSizes([]uint64{bytes, size})
+
+		for _, l := range node.Links() {
+			if key := l.Cid.KeyString(); !visited[key] {
+				visited[key] = true
+				stack = append(stack, l.Cid)
+			}
+		}
+	}
+
+	return nodes, bytes, nil
+}
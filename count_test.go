@@ -0,0 +1,49 @@
+package manifest
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestCountDAG(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{3, 4 * kb},
+		{5, 5 * kb},
+		{10, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nodes, bytes, err := CountDAG(context.Background(), ng, g[0].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if nodes != len(mf.Nodes) {
+		t.Errorf("expected %d nodes, got: %d", len(mf.Nodes), nodes)
+	}
+	if bytes != mf.TotalSize() {
+		t.Errorf("expected %d bytes, got: %d", mf.TotalSize(), bytes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := CountDAG(ctx, ng, g[0].Cid()); err != context.Canceled {
+		t.Errorf("expected cancelled context to error, got: %v", err)
+	}
+}
+
+func TestCountDAGOverflow(t *testing.T) {
+	g := NewGraph([]layer{{2, math.MaxUint64 - 1}})
+	_, bytes, err := CountDAG(context.Background(), TestNodeGetter{g}, g[0].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes != math.MaxUint64 {
+		t.Errorf("expected bytes to saturate, got: %d", bytes)
+	}
+}
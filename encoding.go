@@ -0,0 +1,567 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ugorji/go/codec"
+)
+
+// cborHandle configures CBOR serialization of manifests. Encoding is canonical
+// so a manifest always serializes to the same bytes, which is required to
+// content-address manifests
+var cborHandle = newCborHandle()
+
+func newCborHandle() *codec.CborHandle {
+	h := &codec.CborHandle{}
+	h.Canonical = true
+	return h
+}
+
+// CurrentVersion is the manifest schema version written by MarshalBinary.
+// Version 0 manifests are unversioned CBOR maps of nodes, links & sizes.
+// Version 1 manifests have no trailing checksum
+const CurrentVersion uint = 2
+
+// checksumVersion is the first schema version with a trailing checksum
+const checksumVersion uint = 2
+
+// ChecksumError is returned decoding a manifest whose trailing checksum doesn't
+// match its contents, eg: after corruption in storage or transit
+type ChecksumError struct {
+	Expected, Actual uint32
+}
+
+// Error implements the error interface
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("manifest checksum mismatch. expected: %08x, got: %08x", e.Expected, e.Actual)
+}
+
+// wireEnvelope prefixes an encoded manifest with its schema version, encoded
+// as a two element array so the version always comes first
+type wireEnvelope struct {
+	_struct  bool `codec:",toarray"`
+	Version  uint
+	Manifest wireManifest
+}
+
+// wireVersion decodes only the version of an envelope
+type wireVersion struct {
+	_struct bool `codec:",toarray"`
+	Version uint
+}
+
+// wireManifest is the serialized form of a manifest
+type wireManifest struct {
+	Nodes []string `json:"nodes"`
+	Links [][2]int `json:"links"`
+	Sizes []uint64 `json:"sizes,omitempty"`
+	// UniformSizes is set when sizes are run-length encoded as (size, count)
+	// pairs in SizeRuns instead of Sizes. Much smaller for DAGs where long runs
+	// of nodes share a size, like chunked file leaves
+	UniformSizes      bool        `json:"uniformSizes,omitempty"`
+	SizeRuns          [][2]uint64 `json:"sizeRuns,omitempty"`
+	Blocks            [][]byte    `json:"blocks,omitempty"`
+	StoredSizes       []uint64    `json:"storedSizes,omitempty"`
+	VisitOrder        []int       `json:"visitOrder,omitempty"`
+	FetchDurations    []int64     `json:"fetchDurations,omitempty"`
+	LeafCounts        []int       `json:"leafCounts,omitempty"`
+	DroppedLinkCounts []int       `json:"droppedLinkCounts,omitempty"`
+	Boundaries        []int       `json:"boundaries,omitempty"`
+	MarkedRoots       []int       `json:"roots,omitempty"`
+	Missing           []int       `json:"missing,omitempty"`
+	External          []int       `json:"external,omitempty"`
+	DroppedLinks      int         `json:"droppedLinks,omitempty"`
+	DroppedPerLevel   []int       `json:"droppedPerLevel,omitempty"`
+	WeakLinks         [][2]int    `json:"weakLinks,omitempty"`
+	CreatedAt         int64       `json:"createdAt,omitempty"`
+}
+
+// MarshalBinary encodes the manifest as CBOR, run-length encoding sizes when
+// that's smaller. The in-memory manifest always holds plain sizes. The CBOR is
+// followed by a big-endian CRC-32 of it, checked by UnmarshalBinary
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	w := wireManifest{
+		Nodes:             m.Nodes,
+		Links:             m.Links,
+		Blocks:            m.Blocks,
+		StoredSizes:       m.StoredSizes,
+		VisitOrder:        m.VisitOrder,
+		FetchDurations:    durationNanos(m.FetchDurations),
+		LeafCounts:        m.LeafCounts,
+		DroppedLinkCounts: m.DroppedLinkCounts,
+		Boundaries:        m.Boundaries,
+		MarkedRoots:       m.MarkedRoots,
+		Missing:           m.Missing,
+		External:          m.External,
+		DroppedLinks:      m.DroppedLinks,
+		DroppedPerLevel:   m.DroppedPerLevel,
+		WeakLinks:         m.WeakLinks,
+		CreatedAt:         m.CreatedAt,
+	}
+	if runs := sizeRuns(m.Sizes); len(runs)*2 < len(m.Sizes) {
+		w.UniformSizes = true
+		w.SizeRuns = runs
+	} else {
+		w.Sizes = m.Sizes
+	}
+
+	var data []byte
+	env := wireEnvelope{Version: CurrentVersion, Manifest: w}
+	if err := codec.NewEncoderBytes(&data, cborHandle).Encode(env); err != nil {
+		return nil, err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+	return append(data, sum[:]...), nil
+}
+
+// UnmarshalBinary decodes a manifest encoded with MarshalBinary, migrating
+// older schema versions to the current version. UnmarshalBinary returns a
+// ChecksumError if the manifest's checksum doesn't match
+func (m *Manifest) UnmarshalBinary(data []byte) error {
+	if m.frozen {
+		return ErrFrozen
+	}
+	w, err := migrate(data)
+	if err != nil {
+		return err
+	}
+
+	sizes := w.Sizes
+	if w.UniformSizes {
+		// count runs before expanding them, so a huge run in a tiny payload
+		// can't force a huge allocation
+		total := uint64(0)
+		for _, run := range w.SizeRuns {
+			if run[1] > uint64(len(w.Nodes))-total {
+				return fmt.Errorf("nodes/sizes length mismatch. size runs exceed %d nodes", len(w.Nodes))
+			}
+			total += run[1]
+		}
+		sizes = make([]uint64, 0, total)
+		for _, run := range w.SizeRuns {
+			for i := uint64(0); i < run[1]; i++ {
+				sizes = append(sizes, run[0])
+			}
+		}
+	}
+	if len(sizes) != len(w.Nodes) {
+		return fmt.Errorf("nodes/sizes length mismatch. %d != %d", len(w.Nodes), len(sizes))
+	}
+	if len(w.Blocks) != 0 && len(w.Blocks) != len(w.Nodes) {
+		return fmt.Errorf("nodes/blocks length mismatch. %d != %d", len(w.Nodes), len(w.Blocks))
+	}
+	if w.StoredSizes != nil && len(w.StoredSizes) != len(w.Nodes) {
+		return fmt.Errorf("nodes/stored sizes length mismatch. %d != %d", len(w.Nodes), len(w.StoredSizes))
+	}
+	if w.VisitOrder != nil && len(w.VisitOrder) != len(w.Nodes) {
+		return fmt.Errorf("nodes/visit order length mismatch. %d != %d", len(w.Nodes), len(w.VisitOrder))
+	}
+	if w.FetchDurations != nil && len(w.FetchDurations) != len(w.Nodes) {
+		return fmt.Errorf("nodes/fetch durations length mismatch. %d != %d", len(w.Nodes), len(w.FetchDurations))
+	}
+	if w.LeafCounts != nil && len(w.LeafCounts) != len(w.Nodes) {
+		return fmt.Errorf("nodes/leaf counts length mismatch. %d != %d", len(w.Nodes), len(w.LeafCounts))
+	}
+	if w.DroppedLinkCounts != nil && len(w.DroppedLinkCounts) != len(w.Nodes) {
+		return fmt.Errorf("nodes/dropped link counts length mismatch. %d != %d", len(w.Nodes), len(w.DroppedLinkCounts))
+	}
+	n := len(w.Nodes)
+	for _, links := range [][][2]int{w.Links, w.WeakLinks} {
+		for _, l := range links {
+			if l[0] < 0 || l[0] >= n || l[1] < 0 || l[1] >= n {
+				return fmt.Errorf("link out of range: %v", l)
+			}
+		}
+	}
+	for _, set := range [][]int{w.Boundaries, w.MarkedRoots, w.Missing, w.External} {
+		for _, i := range set {
+			if i < 0 || i >= n {
+				return fmt.Errorf("index out of range: %d", i)
+			}
+		}
+	}
+
+	m.replace(&Manifest{
+		Version:           CurrentVersion,
+		Nodes:             w.Nodes,
+		Links:             w.Links,
+		Sizes:             sizes,
+		Blocks:            w.Blocks,
+		StoredSizes:       w.StoredSizes,
+		VisitOrder:        w.VisitOrder,
+		FetchDurations:    nanosDuration(w.FetchDurations),
+		LeafCounts:        w.LeafCounts,
+		DroppedLinkCounts: w.DroppedLinkCounts,
+		Boundaries:        w.Boundaries,
+		MarkedRoots:       w.MarkedRoots,
+		Missing:           w.Missing,
+		External:          w.External,
+		DroppedLinks:      w.DroppedLinks,
+		DroppedPerLevel:   w.DroppedPerLevel,
+		WeakLinks:         w.WeakLinks,
+		CreatedAt:         w.CreatedAt,
+	})
+	return nil
+}
+
+// migrate decodes a serialized manifest of any supported version into the
+// current wire format
+func migrate(raw []byte) (wireManifest, error) {
+	w := wireManifest{}
+	if len(raw) == 0 {
+		return w, fmt.Errorf("empty manifest")
+	}
+
+	// version 0 manifests are a bare CBOR map (major type 5), fields missing
+	// from v0 decode as empty values
+	if raw[0]>>5 == 5 {
+		err := codec.NewDecoderBytes(raw, cborHandle).Decode(&w)
+		return w, err
+	}
+
+	v := wireVersion{}
+	err := codec.NewDecoderBytes(raw, cborHandle).Decode(&v)
+	if err == nil && v.Version > CurrentVersion {
+		return w, fmt.Errorf("unsupported manifest version %d, newest supported version is %d", v.Version, CurrentVersion)
+	}
+	// a version that can't be read is most likely corruption, so check it
+	// against the checksum
+	if err != nil || v.Version >= checksumVersion {
+		if len(raw) < 4 {
+			return w, fmt.Errorf("manifest too short for checksum")
+		}
+		body := raw[:len(raw)-4]
+		expect := binary.BigEndian.Uint32(raw[len(raw)-4:])
+		if sum := crc32.ChecksumIEEE(body); sum != expect {
+			return w, ChecksumError{Expected: expect, Actual: sum}
+		}
+		raw = body
+	}
+
+	env := wireEnvelope{}
+	if err := codec.NewDecoderBytes(raw, cborHandle).Decode(&env); err != nil {
+		return w, err
+	}
+	return env.Manifest, nil
+}
+
+// Encode writes the manifest to w as CBOR
+func (m *Manifest) Encode(w io.Writer) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Decode reads a CBOR manifest written by Encode from r
+func Decode(r io.Reader) (*Manifest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := m.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteFramedManifest writes m to w as a single frame: a uvarint length prefix
+// followed by the CBOR encoding of m. Frames can be written back to back to
+// send many manifests over one stream
+func WriteFramedManifest(w io.Writer, m *Manifest) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(data)))
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadFramedManifest reads exactly one frame written by WriteFramedManifest
+// from r, leaving r positioned at the start of the next frame
+func ReadFramedManifest(r io.Reader) (*Manifest, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy rather than allocating size bytes up front, a corrupt prefix
+	// shouldn't be able to trigger a huge allocation
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := m.UnmarshalBinary(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// byteReader reads single bytes from a reader without buffering past them
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// durationNanos converts durations to nanoseconds for encoding, keeping nil
+func durationNanos(ds []time.Duration) []int64 {
+	if ds == nil {
+		return nil
+	}
+	ns := make([]int64, len(ds))
+	for i, d := range ds {
+		ns[i] = int64(d)
+	}
+	return ns
+}
+
+// nanosDuration converts decoded nanoseconds back to durations, keeping nil
+func nanosDuration(ns []int64) []time.Duration {
+	if ns == nil {
+		return nil
+	}
+	ds := make([]time.Duration, len(ns))
+	for i, n := range ns {
+		ds[i] = time.Duration(n)
+	}
+	return ds
+}
+
+// EstimatedCBORSize estimates the length of the manifest encoded with
+// MarshalBinary without encoding it. The estimate follows the CBOR encoding of
+// each field, so it's close to exact
+func (m *Manifest) EstimatedCBORSize() int {
+	fields := 0
+	size := 0
+	field := func(name string, n int) {
+		fields++
+		size += cborHeadSize(uint64(len(name))) + len(name) + n
+	}
+	ints := func(name string, idxs []int) {
+		if len(idxs) == 0 {
+			return
+		}
+		n := cborHeadSize(uint64(len(idxs)))
+		for _, i := range idxs {
+			n += cborHeadSize(uint64(i))
+		}
+		field(name, n)
+	}
+	uints := func(name string, vals []uint64) {
+		if len(vals) == 0 {
+			return
+		}
+		n := cborHeadSize(uint64(len(vals)))
+		for _, v := range vals {
+			n += cborHeadSize(v)
+		}
+		field(name, n)
+	}
+
+	n := cborHeadSize(uint64(len(m.Nodes)))
+	for _, id := range m.Nodes {
+		n += cborHeadSize(uint64(len(id))) + len(id)
+	}
+	field("nodes", n)
+
+	links := func(name string, links [][2]int) {
+		n := cborHeadSize(uint64(len(links)))
+		for _, l := range links {
+			n += 1 + cborHeadSize(uint64(l[0])) + cborHeadSize(uint64(l[1]))
+		}
+		field(name, n)
+	}
+	links("links", m.Links)
+
+	if runs := sizeRuns(m.Sizes); len(runs)*2 < len(m.Sizes) {
+		field("uniformSizes", 1)
+		n = cborHeadSize(uint64(len(runs)))
+		for _, r := range runs {
+			n += 1 + cborHeadSize(r[0]) + cborHeadSize(r[1])
+		}
+		field("sizeRuns", n)
+	} else {
+		uints("sizes", m.Sizes)
+	}
+
+	if len(m.Blocks) > 0 {
+		n = cborHeadSize(uint64(len(m.Blocks)))
+		for _, b := range m.Blocks {
+			// nil blocks encode as a 1 byte null
+			n += cborHeadSize(uint64(len(b))) + len(b)
+		}
+		field("blocks", n)
+	}
+	uints("storedSizes", m.StoredSizes)
+	ints("visitOrder", m.VisitOrder)
+	if len(m.FetchDurations) > 0 {
+		n = cborHeadSize(uint64(len(m.FetchDurations)))
+		for _, d := range m.FetchDurations {
+			n += cborHeadSize(uint64(d))
+		}
+		field("fetchDurations", n)
+	}
+	ints("leafCounts", m.LeafCounts)
+	ints("droppedLinkCounts", m.DroppedLinkCounts)
+	ints("boundaries", m.Boundaries)
+	ints("roots", m.MarkedRoots)
+	ints("missing", m.Missing)
+	ints("external", m.External)
+	if m.DroppedLinks != 0 {
+		field("droppedLinks", cborHeadSize(uint64(m.DroppedLinks)))
+	}
+	ints("droppedPerLevel", m.DroppedPerLevel)
+	if len(m.WeakLinks) > 0 {
+		links("weakLinks", m.WeakLinks)
+	}
+	if m.CreatedAt > 0 {
+		field("createdAt", cborHeadSize(uint64(m.CreatedAt)))
+	} else if m.CreatedAt < 0 {
+		field("createdAt", cborHeadSize(uint64(-1-m.CreatedAt)))
+	}
+
+	// envelope array, version, map header & checksum
+	return 1 + cborHeadSize(uint64(CurrentVersion)) + cborHeadSize(uint64(fields)) + size + 4
+}
+
+// cborHeadSize is the length of a CBOR head encoding the argument n
+func cborHeadSize(n uint64) int {
+	switch {
+	case n < 24:
+		return 1
+	case n <= math.MaxUint8:
+		return 2
+	case n <= math.MaxUint16:
+		return 3
+	case n <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
+
+// sizeRuns run-length encodes sizes as (size, count) pairs
+func sizeRuns(sizes []uint64) [][2]uint64 {
+	var runs [][2]uint64
+	for _, s := range sizes {
+		if len(runs) > 0 && runs[len(runs)-1][0] == s {
+			runs[len(runs)-1][1]++
+			continue
+		}
+		runs = append(runs, [2]uint64{s, 1})
+	}
+	return runs
+}
+
+// WriteCSV writes the manifest as a CSV table of cid, size, num_children &
+// num_parents, with a header row & one row per node in canonical order
+func (m *Manifest) WriteCSV(w io.Writer) error {
+	c := m.Copy()
+	c.Canonicalize()
+	parents := make([]int, len(c.Nodes))
+	for _, l := range c.Links {
+		parents[l[1]]++
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"cid", "size", "num_children", "num_parents"}); err != nil {
+		return err
+	}
+	for i, ch := range c.children() {
+		row := []string{
+			c.Nodes[i],
+			strconv.FormatUint(c.Sizes[i], 10),
+			strconv.Itoa(len(ch)),
+			strconv.Itoa(parents[i]),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteTree writes the DAG under root as an indented tree, one line per node
+// of its short cid & size, indented two spaces per level. Nodes more than
+// maxDepth links below root aren't written, 0 means no limit. A node reached
+// again after its children were written is marked "(seen)" & not expanded, so
+// shared nodes & cycles don't repeat whole subtrees
+func (m *Manifest) WriteTree(w io.Writer, root *cid.Cid, maxDepth int) error {
+	idx := m.index()
+	start, ok := idx[root.KeyString()]
+	if !ok {
+		return fmt.Errorf("cid not in manifest: %s", root.String())
+	}
+	keys := m.nodeKeys()
+	ch := m.children()
+	seen := make([]bool, len(m.Nodes))
+
+	var write func(i, depth int) error
+	write = func(i, depth int) error {
+		// write the first occurrence of duplicate nodes
+		i = idx[keys[i]]
+		line := fmt.Sprintf("%s%s %d", strings.Repeat("  ", depth), shortCid(m.Nodes[i]), m.Sizes[i])
+		if seen[i] {
+			_, err := fmt.Fprintln(w, line, "(seen)")
+			return err
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		if maxDepth > 0 && depth >= maxDepth {
+			return nil
+		}
+		// only expanded nodes are seen, so a node first reached at maxDepth is
+		// still expanded when reached again higher up
+		seen[i] = true
+		for _, c := range ch[i] {
+			if err := write(c, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return write(start, 0)
+}
+
+// shortCid abbreviates a cid string to its last 8 characters, which differ
+// between cids sharing a version, codec & hash function
+func shortCid(id string) string {
+	if len(id) <= 8 {
+		return id
+	}
+	return id[len(id)-8:]
+}
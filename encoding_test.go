@@ -0,0 +1,412 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+	"github.com/ugorji/go/codec"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(mf) {
+		t.Error("expected decoded manifest to equal original")
+	}
+}
+
+func TestMarshalBinaryUniformSizes(t *testing.T) {
+	g := NewGraph([]layer{
+		{1000, 256 * kb},
+	})
+
+	uniform, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	varied := uniform.Copy()
+	for i := range varied.Sizes {
+		varied.Sizes[i] += uint64(i)
+	}
+
+	ud, err := uniform.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	vd, err := varied.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// 1000 5-byte sizes collapse into two runs
+	if len(vd)-len(ud) < 4000 {
+		t.Errorf("expected uniform sizes to shrink encoding. uniform: %d bytes, varied: %d bytes", len(ud), len(vd))
+	}
+	t.Logf("uniform sizes: %s, varied sizes: %s", fileSize(len(ud)), fileSize(len(vd)))
+
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(ud); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !got.Equal(uniform) {
+		t.Error("expected decoded uniform manifest to equal original")
+	}
+}
+
+func TestEncodeStable(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	first := &bytes.Buffer{}
+	if err := mf.Encode(first); err != nil {
+		t.Fatal(err.Error())
+	}
+	enc := first.Bytes()
+
+	got, err := Decode(first)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second := &bytes.Buffer{}
+	if err := got.Encode(second); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(enc, second.Bytes()) {
+		t.Error("expected re-encoded manifest bytes to be identical")
+	}
+}
+
+func TestDecodeV0(t *testing.T) {
+	a, b := newNode(kb).Cid().String(), newNode(kb).Cid().String()
+
+	// hand-written v0 payload: {"nodes": [a, b], "links": [[0, 1]], "sizes": [5, 300]}
+	v0 := []byte{0xa3}
+	v0 = append(v0, 0x65)
+	v0 = append(v0, "nodes"...)
+	v0 = append(v0, 0x82, 0x78, byte(len(a)))
+	v0 = append(v0, a...)
+	v0 = append(v0, 0x78, byte(len(b)))
+	v0 = append(v0, b...)
+	v0 = append(v0, 0x65)
+	v0 = append(v0, "links"...)
+	v0 = append(v0, 0x81, 0x82, 0x00, 0x01)
+	v0 = append(v0, 0x65)
+	v0 = append(v0, "sizes"...)
+	v0 = append(v0, 0x82, 0x05, 0x19, 0x01, 0x2c)
+
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(v0); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := &Manifest{
+		Nodes: []string{a, b},
+		Links: [][2]int{{0, 1}},
+		Sizes: []uint64{5, 300},
+	}
+	if !got.Equal(expect) {
+		t.Errorf("decoded v0 manifest mismatch. expected: %+v, got: %+v", expect, got)
+	}
+	if got.Version != CurrentVersion {
+		t.Errorf("expected v0 manifest to migrate to version %d, got: %d", CurrentVersion, got.Version)
+	}
+	if got.Blocks != nil || got.Boundaries != nil {
+		t.Error("expected fields missing from v0 to decode as nil")
+	}
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	// [CurrentVersion+1, {}]
+	data := []byte{0x82, byte(CurrentVersion + 1), 0xa0}
+	if err := (&Manifest{}).UnmarshalBinary(data); err == nil {
+		t.Error("expected newer manifest version to error")
+	}
+}
+
+func TestDecodeMisaligned(t *testing.T) {
+	a := newNode(kb).Cid().String()
+	encode := func(w wireManifest) []byte {
+		var data []byte
+		// version 1 has no checksum to fill in
+		if err := codec.NewEncoderBytes(&data, cborHandle).Encode(wireEnvelope{Version: 1, Manifest: w}); err != nil {
+			t.Fatal(err.Error())
+		}
+		return data
+	}
+
+	huge := encode(wireManifest{Nodes: []string{a}, UniformSizes: true, SizeRuns: [][2]uint64{{0, 1 << 40}}})
+	if err := (&Manifest{}).UnmarshalBinary(huge); err == nil {
+		t.Error("expected size runs past the node count to error")
+	}
+	blocks := encode(wireManifest{Nodes: []string{a}, Sizes: []uint64{kb}, Blocks: [][]byte{nil, nil}})
+	if err := (&Manifest{}).UnmarshalBinary(blocks); err == nil {
+		t.Error("expected blocks misaligned with nodes to error")
+	}
+	for _, w := range []wireManifest{
+		{Nodes: []string{a}, Sizes: []uint64{kb}, Links: [][2]int{{0, 5}}},
+		{Nodes: []string{a}, Sizes: []uint64{kb}, WeakLinks: [][2]int{{-1, 0}}},
+		{Nodes: []string{a}, Sizes: []uint64{kb}, MarkedRoots: []int{3}},
+		{Nodes: []string{a}, Sizes: []uint64{kb}, Missing: []int{-1}},
+	} {
+		if err := (&Manifest{}).UnmarshalBinary(encode(w)); err == nil {
+			t.Errorf("expected out of range indexes to error: %+v", w)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0x10
+	err = (&Manifest{}).UnmarshalBinary(flipped)
+	if _, ok := err.(ChecksumError); !ok {
+		t.Errorf("expected ChecksumError, got: %v", err)
+	}
+
+	// version 1 manifests have no checksum
+	v1 := append([]byte(nil), data[:len(data)-4]...)
+	v1[1] = 1
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(v1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !got.Equal(mf) {
+		t.Error("expected version 1 manifest to decode")
+	}
+}
+
+func TestFramedManifests(t *testing.T) {
+	var mfs []*Manifest
+	for _, leaves := range []int{1, 3, 5} {
+		g := NewGraph([]layer{
+			{leaves, 4 * kb},
+		})
+		mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mfs = append(mfs, mf)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, mf := range mfs {
+		if err := WriteFramedManifest(buf, mf); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// hide the ByteReader implementation of bytes.Buffer
+	r := struct{ io.Reader }{buf}
+	for i, expect := range mfs {
+		got, err := ReadFramedManifest(r)
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err.Error())
+		}
+		if !got.Equal(expect) {
+			t.Errorf("frame %d mismatch", i)
+		}
+	}
+	if _, err := ReadFramedManifest(r); err != io.EOF {
+		t.Errorf("expected EOF after last frame, got: %v", err)
+	}
+}
+
+func TestEstimatedCBORSize(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mf.AddRoot(g[1].Cid()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i, m := range []*Manifest{mf, {}, {Nodes: mf.Nodes, Links: mf.Links, Sizes: mf.Sizes}} {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		est := m.EstimatedCBORSize()
+		if diff := est - len(data); diff < 0 || diff > len(data)/20+8 {
+			t.Errorf("case %d: estimate %d isn't close to actual size %d", i, est, len(data))
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := mf.WriteCSV(buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	rows, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rows) != len(mf.Nodes)+1 {
+		t.Fatalf("expected %d rows, got: %d", len(mf.Nodes)+1, len(rows))
+	}
+	if rows[0][0] != "cid" || rows[0][3] != "num_parents" {
+		t.Errorf("unexpected header: %v", rows[0])
+	}
+
+	mid := g[0].(*node).links[1].Cid().String()
+	found := false
+	for i, row := range rows[1:] {
+		if i > 0 && row[0] < rows[i][0] {
+			t.Error("expected rows in canonical order")
+		}
+		if row[0] == mid {
+			found = true
+			if expect := []string{mid, "4000", "3", "1"}; !reflect.DeepEqual(row, expect) {
+				t.Errorf("row mismatch. expected: %v, got: %v", expect, row)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected a row for %s", mid)
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := mf.WriteTree(buf, g[0].Cid(), 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(mf.Nodes) {
+		t.Fatalf("expected %d lines, got: %d", len(mf.Nodes), len(lines))
+	}
+	// a pre-order walk: each child is one level below the last node at the
+	// level above
+	counts := map[int]int{}
+	prev := -1
+	for i, line := range lines {
+		depth := (len(line) - len(strings.TrimLeft(line, " "))) / 2
+		if depth > prev+1 {
+			t.Errorf("line %d: jumped from depth %d to %d", i, prev, depth)
+		}
+		counts[depth]++
+		prev = depth
+	}
+	if !reflect.DeepEqual(counts, map[int]int{0: 1, 1: 2, 2: 6, 3: 24}) {
+		t.Errorf("unexpected nodes per depth: %v", counts)
+	}
+	if root := g[0].Cid().String(); lines[0] != fmt.Sprintf("%s %d", root[len(root)-8:], 2*kb) {
+		t.Errorf("unexpected root line: %q", lines[0])
+	}
+
+	buf.Reset()
+	if err := mf.WriteTree(buf, g[0].Cid(), 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 3 {
+		t.Errorf("expected 3 lines at max depth 1, got: %d", n)
+	}
+}
+
+func TestWriteTreeShared(t *testing.T) {
+	// diamond: root -> a, b -> shared -> leaf
+	root, a, b, shared, leaf := newNode(kb), newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	root.links = []*node{a, b}
+	a.links = []*node{shared}
+	b.links = []*node{shared}
+	shared.links = []*node{leaf}
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, b, shared, leaf}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := mf.WriteTree(buf, root.Cid(), 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	out := buf.String()
+	if strings.Count(out, "\n") != 6 || strings.Count(out, "(seen)") != 1 {
+		t.Errorf("expected shared node written twice & expanded once, got:\n%s", out)
+	}
+	if err := mf.WriteTree(buf, newNode(kb).Cid(), 0); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+
+	// shared is first reached at the depth cap, then again one level higher
+	root.links = []*node{a, shared}
+	mf, err = NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, shared, leaf}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf.Reset()
+	if err := mf.WriteTree(buf, root.Cid(), 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	out = buf.String()
+	if id := leaf.Cid().String(); !strings.Contains(out, "    "+id[len(id)-8:]) || strings.Contains(out, "(seen)") {
+		t.Errorf("expected shared node expanded where it's above the cap, got:\n%s", out)
+	}
+}
@@ -0,0 +1,51 @@
+package manifest
+
+// AllowOnly returns a new manifest of only the allowed cids, keyed by cid
+// string. Allowed nodes that can no longer be reached from a root of m
+// without passing through a node that isn't allowed are pruned
+func (m *Manifest) AllowOnly(allowed map[string]bool) *Manifest {
+	allow := keySet(allowed)
+	keep := make([]bool, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		keep[i] = allow[key]
+	}
+	return m.pruned(keep)
+}
+
+// Deny returns a new manifest without the denied cids, keyed by cid string.
+// Denying a node also drops any nodes that can only be reached through it
+func (m *Manifest) Deny(denied map[string]bool) *Manifest {
+	deny := keySet(denied)
+	keep := make([]bool, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		keep[i] = !deny[key]
+	}
+	return m.pruned(keep)
+}
+
+// pruned builds a sub-manifest of the nodes marked in keep that are still
+// reachable from a kept root of m, following only kept nodes
+func (m *Manifest) pruned(keep []bool) *Manifest {
+	ch := m.children()
+	reached := make([]bool, len(m.Nodes))
+	var queue []int
+	for _, r := range m.sortedRoots() {
+		if keep[r] {
+			queue = append(queue, r)
+		}
+	}
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		if reached[idx] {
+			continue
+		}
+		reached[idx] = true
+		for _, c := range ch[idx] {
+			if keep[c] {
+				queue = append(queue, c)
+			}
+		}
+	}
+	return m.subManifest(reached)
+}
@@ -0,0 +1,72 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAllowOnly(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dir := root.links[0]
+	allowed := map[string]bool{
+		root.Cid().String():         true,
+		dir.Cid().String():          true,
+		dir.links[1].Cid().String(): true,
+		// orphaned, its parent isn't allowed
+		root.links[1].links[0].Cid().String(): true,
+	}
+	got := mf.AllowOnly(allowed)
+	verifyManifest(t, got)
+	if len(got.Nodes) != 3 || len(got.Links) != 2 {
+		t.Errorf("expected 3 nodes & 2 links, got: %d, %d", len(got.Nodes), len(got.Links))
+	}
+	for _, n := range []*node{root, dir, dir.links[1]} {
+		if !got.Contains(n.Cid()) {
+			t.Errorf("expected allowed node %s to be kept", n.Cid().String())
+		}
+	}
+	for _, l := range got.Links {
+		if l[0] < 0 || l[0] >= len(got.Nodes) || l[1] < 0 || l[1] >= len(got.Nodes) {
+			t.Errorf("link out of range: %v", l)
+		}
+	}
+}
+
+func TestDeny(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	denied := root.links[1]
+	got := mf.Deny(map[string]bool{denied.Cid().String(): true})
+	verifyManifest(t, got)
+	if got.Contains(denied.Cid()) {
+		t.Error("expected denied node to be dropped")
+	}
+	for _, n := range denied.links {
+		if got.Contains(n.Cid()) {
+			t.Errorf("expected descendant %s of denied node to be dropped", n.Cid().String())
+		}
+	}
+	if len(got.Nodes) != 5 || len(got.Links) != 4 {
+		t.Errorf("expected 5 nodes & 4 links, got: %d, %d", len(got.Nodes), len(got.Links))
+	}
+	if roots, _ := got.Roots(); len(roots) != 1 || !roots[0].Equals(root.Cid()) {
+		t.Error("expected root to be the only root")
+	}
+}
@@ -0,0 +1,132 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// Fingerprint hashes the graph a manifest describes. Manifests that are Equal
+// have the same fingerprint regardless of node order, duplicate links, or the
+// multibase encoding of their cids
+func (m *Manifest) Fingerprint() (multihash.Multihash, error) {
+	keys := m.nodeKeys()
+	order := allIndexes(len(keys))
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+
+	buf := &bytes.Buffer{}
+	remap := make([]int, len(keys))
+	n := 0
+	for i, idx := range order {
+		// duplicate nodes keep the first size, like Equal
+		if i > 0 && keys[idx] == keys[order[i-1]] {
+			remap[idx] = n - 1
+			continue
+		}
+		remap[idx] = n
+		n++
+		writeUvarint(buf, uint64(len(keys[idx])))
+		buf.WriteString(keys[idx])
+		writeUvarint(buf, m.Sizes[idx])
+	}
+
+	links := make([][2]int, 0, len(m.Links))
+	for _, l := range m.Links {
+		links = append(links, [2]int{remap[l[0]], remap[l[1]]})
+	}
+	sort.Slice(links, func(i, j int) bool { return linkLess(links[i], links[j]) })
+	for i, l := range links {
+		if i > 0 && l == links[i-1] {
+			continue
+		}
+		writeUvarint(buf, uint64(l[0]))
+		writeUvarint(buf, uint64(l[1]))
+	}
+
+	return multihash.Sum(buf.Bytes(), multihash.SHA2_256, -1)
+}
+
+// Key returns the fingerprint of the manifest as a string, for use as a map
+// key. Logically equal manifests have the same key
+func (m *Manifest) Key() string {
+	fp, err := m.Fingerprint()
+	if err != nil {
+		return ""
+	}
+	return fp.B58String()
+}
+
+// DuplicateSubtrees groups distinct non-leaf cids whose subtrees have the same
+// shape & the same leaves. Intermediate cids are ignored when comparing, so
+// subtrees that only differ in node metadata are grouped together. Groups are
+// ordered by their first node's index position. DuplicateSubtrees errors if
+// the manifest has a cycle
+func (m *Manifest) DuplicateSubtrees() ([][]*cid.Cid, error) {
+	order, err := m.topoIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := m.children()
+	keys := m.nodeKeys()
+	sigs := make([]string, len(m.Nodes))
+	// children come after parents in topological order, walk it backwards
+	for i := len(order) - 1; i >= 0; i-- {
+		idx := order[i]
+		if len(ch[idx]) == 0 {
+			sigs[idx] = "l" + keys[idx]
+			continue
+		}
+		child := make([]string, 0, len(ch[idx]))
+		for _, c := range ch[idx] {
+			child = append(child, sigs[c])
+		}
+		sort.Strings(child)
+		buf := &bytes.Buffer{}
+		for j, sig := range child {
+			if j > 0 && sig == child[j-1] {
+				continue
+			}
+			writeUvarint(buf, uint64(len(sig)))
+			buf.WriteString(sig)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		sigs[idx] = "n" + string(sum[:])
+	}
+
+	groups := map[string][]int{}
+	var found []string
+	seen := map[string]bool{}
+	for idx, sig := range sigs {
+		if sig[0] != 'n' || seen[keys[idx]] {
+			continue
+		}
+		seen[keys[idx]] = true
+		if len(groups[sig]) == 0 {
+			found = append(found, sig)
+		}
+		groups[sig] = append(groups[sig], idx)
+	}
+
+	var dups [][]*cid.Cid
+	for _, sig := range found {
+		if len(groups[sig]) < 2 {
+			continue
+		}
+		ids, err := m.cidsAt(groups[sig])
+		if err != nil {
+			return nil, err
+		}
+		dups = append(dups, ids)
+	}
+	return dups, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
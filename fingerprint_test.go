@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestKey(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reordered := mf.Copy()
+	reordered.Canonicalize()
+	reordered.Links = append(reordered.Links, reordered.Links[0])
+	for i, j := 0, len(reordered.Links)-1; i < j; i, j = i+1, j-1 {
+		reordered.Links[i], reordered.Links[j] = reordered.Links[j], reordered.Links[i]
+	}
+
+	cache := map[string]bool{mf.Key(): true}
+	if !cache[reordered.Key()] {
+		t.Error("expected reordered manifest to share key")
+	}
+
+	changed := mf.Copy()
+	changed.Sizes[4]++
+	if cache[changed.Key()] {
+		t.Error("expected changed size to change key")
+	}
+
+	changed = mf.Copy()
+	changed.Links = changed.Links[1:]
+	if cache[changed.Key()] {
+		t.Error("expected removed link to change key")
+	}
+}
+
+func TestDuplicateSubtrees(t *testing.T) {
+	// two directories with different cids that hold the same leaves, each under
+	// a different parent
+	leaves := []*node{newNode(kb), newNode(2 * kb), newNode(3 * kb)}
+	dirA, dirB := newNode(4*kb), newNode(5*kb)
+	dirA.links = leaves
+	dirB.links = []*node{leaves[2], leaves[0], leaves[1]}
+	parentA, parentB := newNode(kb), newNode(kb)
+	parentA.links = []*node{dirA, newNode(6 * kb)}
+	parentB.links = []*node{dirB}
+	root := newNode(kb)
+	root.links = []*node{parentA, parentB}
+
+	g := []format.Node{root, parentA, parentB, dirA, dirB, parentA.links[1]}
+	for _, l := range leaves {
+		g = append(g, l)
+	}
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dups, err := mf.DuplicateSubtrees()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(dups) != 1 {
+		t.Fatalf("expected 1 group of duplicates, got: %d", len(dups))
+	}
+	if len(dups[0]) != 2 || !dups[0][0].Equals(dirA.Cid()) || !dups[0][1].Equals(dirB.Cid()) {
+		t.Errorf("expected directories to be grouped, got: %v", dups[0])
+	}
+}
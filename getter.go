@@ -0,0 +1,95 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// AccessRecord describes all requests for a single cid made to an
+// InstrumentedNodeGetter
+type AccessRecord struct {
+	Cid   *cid.Cid
+	Calls int
+	// Latency is the total time spent in Get calls for Cid
+	Latency time.Duration
+}
+
+// InstrumentedNodeGetter wraps a NodeGetter, recording the count & latency of
+// every Get call for debugging. It's safe for concurrent use
+type InstrumentedNodeGetter struct {
+	format.NodeGetter
+
+	lk      sync.Mutex
+	records []*AccessRecord
+	byCid   map[string]*AccessRecord
+}
+
+var _ format.NodeGetter = (*InstrumentedNodeGetter)(nil)
+
+// NewInstrumentedNodeGetter wraps ng with access recording
+func NewInstrumentedNodeGetter(ng format.NodeGetter) *InstrumentedNodeGetter {
+	return &InstrumentedNodeGetter{
+		NodeGetter: ng,
+		byCid:      map[string]*AccessRecord{},
+	}
+}
+
+// Get fetches a node from the underlying NodeGetter, recording the request
+func (ing *InstrumentedNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	start := time.Now()
+	node, err := ing.NodeGetter.Get(ctx, id)
+	elapsed := time.Since(start)
+
+	ing.lk.Lock()
+	defer ing.lk.Unlock()
+	rec, ok := ing.byCid[id.KeyString()]
+	if !ok {
+		rec = &AccessRecord{Cid: id}
+		ing.byCid[id.KeyString()] = rec
+		ing.records = append(ing.records, rec)
+	}
+	rec.Calls++
+	rec.Latency += elapsed
+
+	return node, err
+}
+
+// Report lists access records for every requested cid, in order of first
+// request
+func (ing *InstrumentedNodeGetter) Report() []AccessRecord {
+	ing.lk.Lock()
+	defer ing.lk.Unlock()
+	report := make([]AccessRecord, len(ing.records))
+	for i, rec := range ing.records {
+		report[i] = *rec
+	}
+	return report
+}
+
+// NewManifestFromMap generates a manifest of the DAG under root from nodes
+// already loaded into memory, keyed by cid string. NewManifestFromMap errors
+// if root or any node it links to isn't in nodes
+func NewManifestFromMap(nodes map[string]format.Node, root *cid.Cid) (*Manifest, error) {
+	ng := mapNodeGetter(nodes)
+	node, err := ng.Get(context.Background(), root)
+	if err != nil {
+		return nil, err
+	}
+	return NewManifest(context.Background(), ng, node)
+}
+
+// mapNodeGetter fetches nodes from a map of cid string to node
+type mapNodeGetter map[string]format.Node
+
+func (ng mapNodeGetter) Get(_ context.Context, id *cid.Cid) (format.Node, error) {
+	node, ok := ng[id.String()]
+	if !ok {
+		return nil, fmt.Errorf("node not in map: %s", id.String())
+	}
+	return node, nil
+}
@@ -0,0 +1,84 @@
+package manifest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestInstrumentedNodeGetter(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{4, 4 * kb},
+		{8, 5 * kb},
+		{16, 256 * kb},
+	})
+	ing := NewInstrumentedNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifest(context.Background(), ing, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	report := ing.Report()
+	// the root is passed in directly, never fetched
+	if len(report) != len(g)-1 {
+		t.Errorf("expected %d access records, got: %d", len(g)-1, len(report))
+	}
+	for _, rec := range report {
+		if rec.Calls != 1 {
+			t.Errorf("expected %s to be fetched once, got: %d", rec.Cid.String(), rec.Calls)
+		}
+		if !mf.Contains(rec.Cid) {
+			t.Errorf("expected fetched cid %s to be in manifest", rec.Cid.String())
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ing.Get(context.Background(), g[1].Cid())
+		}()
+	}
+	wg.Wait()
+	if calls := ing.Report()[0].Calls; calls != 9 {
+		t.Errorf("expected 9 recorded calls, got: %d", calls)
+	}
+}
+
+func TestNewManifestFromMap(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	nodes := map[string]format.Node{}
+	for _, n := range g {
+		nodes[n.Cid().String()] = n
+	}
+
+	mf, err := NewManifestFromMap(nodes, g[0].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	expect, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !mf.Equal(expect) {
+		t.Error("expected manifest from map to match manifest from node getter")
+	}
+
+	delete(nodes, g[len(g)-1].Cid().String())
+	if _, err := NewManifestFromMap(nodes, g[0].Cid()); err == nil {
+		t.Error("expected error for missing child")
+	}
+	if _, err := NewManifestFromMap(map[string]format.Node{}, g[0].Cid()); err == nil {
+		t.Error("expected error for missing root")
+	}
+}
@@ -0,0 +1,225 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+	"github.com/ugorji/go/codec"
+)
+
+// cborLinkTag is the CBOR tag dag-cbor uses for cids
+const cborLinkTag = 42
+
+// ipldManifest is the dag-cbor form of a manifest. Nodes are encoded as cid
+// links so ipld tooling can traverse them
+type ipldManifest struct {
+	Nodes []codec.RawExt `codec:"nodes"`
+	Links [][2]int       `codec:"links"`
+	Sizes []uint64       `codec:"sizes"`
+}
+
+// ToIPLDNode encodes the manifest as a dag-cbor node that links to every cid
+// the manifest describes. Sizes & links between nodes are stored as data
+func (m *Manifest) ToIPLDNode() (format.Node, error) {
+	if err := m.checkSizes(); err != nil {
+		return nil, err
+	}
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return nil, err
+	}
+
+	im := ipldManifest{
+		Nodes: make([]codec.RawExt, len(ids)),
+		Links: m.Links,
+		Sizes: m.Sizes,
+	}
+	links := make([]*format.Link, len(ids))
+	for i, id := range ids {
+		// dag-cbor links are prefixed with the identity multibase
+		im.Nodes[i] = codec.RawExt{Tag: cborLinkTag, Value: append([]byte{0}, id.Bytes()...)}
+		links[i] = &format.Link{Name: strconv.Itoa(i), Size: m.Sizes[i], Cid: id}
+	}
+
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, cborHandle).Encode(im); err != nil {
+		return nil, err
+	}
+	id, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	return &ipldNode{cid: id, data: data, links: links}, nil
+}
+
+// FromIPLDNode decodes a manifest from a node created with ToIPLDNode
+func FromIPLDNode(nd format.Node) (*Manifest, error) {
+	im := ipldManifest{}
+	if err := codec.NewDecoderBytes(nd.RawData(), cborHandle).Decode(&im); err != nil {
+		return nil, err
+	}
+	if len(im.Sizes) != len(im.Nodes) {
+		return nil, fmt.Errorf("nodes/sizes length mismatch. %d != %d", len(im.Nodes), len(im.Sizes))
+	}
+
+	m := &Manifest{Version: CurrentVersion, Links: im.Links, Sizes: im.Sizes}
+	for i, l := range im.Nodes {
+		raw, ok := l.Value.([]byte)
+		if l.Tag != cborLinkTag || !ok || len(raw) == 0 || raw[0] != 0 {
+			return nil, fmt.Errorf("invalid link at index %d", i)
+		}
+		id, err := cid.Cast(raw[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+		m.Nodes = append(m.Nodes, id.String())
+	}
+	for _, l := range m.Links {
+		if l[0] < 0 || l[0] >= len(m.Nodes) || l[1] < 0 || l[1] >= len(m.Nodes) {
+			return nil, fmt.Errorf("link out of range: %v", l)
+		}
+	}
+	return m, nil
+}
+
+// ipldNode is a format.Node holding an encoded manifest. Links are named by
+// the index position of the node they point to
+type ipldNode struct {
+	cid   *cid.Cid
+	data  []byte
+	links []*format.Link
+}
+
+func (n *ipldNode) RawData() []byte           { return n.data }
+func (n *ipldNode) Cid() *cid.Cid             { return n.cid }
+func (n *ipldNode) String() string            { return n.cid.String() }
+func (n *ipldNode) Links() []*format.Link     { return n.links }
+func (n *ipldNode) Size() (uint64, error)     { return uint64(len(n.data)), nil }
+func (n *ipldNode) Tree(string, int) []string { return nil }
+func (n *ipldNode) Loggable() map[string]interface{} {
+	return map[string]interface{}{"node": n.String()}
+}
+
+func (n *ipldNode) Copy() format.Node {
+	links := make([]*format.Link, len(n.links))
+	for i, l := range n.links {
+		lc := *l
+		links[i] = &lc
+	}
+	return &ipldNode{cid: n.cid, data: append([]byte(nil), n.data...), links: links}
+}
+
+func (n *ipldNode) Resolve(path []string) (interface{}, []string, error) {
+	return n.ResolveLink(path)
+}
+
+func (n *ipldNode) ResolveLink(path []string) (*format.Link, []string, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("empty path")
+	}
+	i, err := strconv.Atoi(path[0])
+	if err != nil || i < 0 || i >= len(n.links) {
+		return nil, nil, fmt.Errorf("no link named %q", path[0])
+	}
+	return n.links[i], path[1:], nil
+}
+
+func (n *ipldNode) Stat() (*format.NodeStat, error) {
+	return &format.NodeStat{
+		Hash:           n.cid.String(),
+		NumLinks:       len(n.links),
+		BlockSize:      len(n.data),
+		DataSize:       len(n.data),
+		CumulativeSize: len(n.data),
+	}, nil
+}
+
+// ExceedsBlockLimit checks if the encoded manifest is estimated to be larger
+// than maxBytes, eg: the block size limit of the network it's stored on
+func (m *Manifest) ExceedsBlockLimit(maxBytes int) bool {
+	return m.EstimatedCBORSize() > maxBytes
+}
+
+// splitOverhead is an upper bound on the encoded size of an empty manifest,
+// including every field name
+const splitOverhead = 256
+
+// SplitForBlockLimit partitions the manifest into sub-manifests that are each
+// estimated to encode in under maxBytes. When a link crosses between parts the
+// child is also added as a leaf of the parent's part, so the roots of each part
+// tie it back to the part that links to it. A single node too large for the
+// limit gets a part to itself, which will still exceed it
+func (m *Manifest) SplitForBlockLimit(maxBytes int) []*Manifest {
+	if !m.ExceedsBlockLimit(maxBytes) {
+		return []*Manifest{m.Copy()}
+	}
+
+	_, order := m.spanningTree()
+	seen := make([]bool, len(m.Nodes))
+	for _, idx := range order {
+		seen[idx] = true
+	}
+	for idx := range m.Nodes {
+		if !seen[idx] {
+			order = append(order, idx)
+		}
+	}
+
+	ch := m.children()
+	budget := maxBytes - splitOverhead
+	part := make([]int, len(m.Nodes))
+	parts, used := 1, 0
+	for _, idx := range order {
+		cost := m.splitCost(idx, ch)
+		if used > 0 && used+cost > budget {
+			parts++
+			used = 0
+		}
+		part[idx] = parts - 1
+		used += cost
+	}
+
+	res := make([]*Manifest, parts)
+	for p := range res {
+		keep := make([]bool, len(m.Nodes))
+		for idx := range m.Nodes {
+			if part[idx] != p {
+				continue
+			}
+			keep[idx] = true
+			for _, c := range ch[idx] {
+				keep[c] = true
+			}
+		}
+		res[p] = m.subManifest(keep)
+	}
+	return res
+}
+
+// splitCost is an upper bound on the encoded bytes node idx adds to a part,
+// counting each of its children as if it were a leaf from another part
+func (m *Manifest) splitCost(idx int, ch [][]int) int {
+	// cid, size, stored size & an entry in every index set
+	nodeCost := func(i int) int {
+		cost := cborHeadSize(uint64(len(m.Nodes[i]))) + len(m.Nodes[i]) + 9 + 9 + 9*len(m.indexSets())
+		if i < len(m.Blocks) {
+			cost += cborHeadSize(uint64(len(m.Blocks[i]))) + len(m.Blocks[i])
+		}
+		return cost
+	}
+
+	cost := nodeCost(idx)
+	for _, c := range ch[idx] {
+		// link pair & the child as a leaf
+		cost += 1 + 9 + 9 + nodeCost(c)
+	}
+	return cost
+}
@@ -0,0 +1,92 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestToIPLDNode(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nd, err := mf.ToIPLDNode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(nd.Links()) != len(mf.Nodes) {
+		t.Errorf("expected %d links, got: %d", len(mf.Nodes), len(nd.Links()))
+	}
+	for i, l := range nd.Links() {
+		if l.Cid.String() != mf.Nodes[i] || l.Size != mf.Sizes[i] {
+			t.Errorf("link %d mismatch", i)
+		}
+	}
+
+	again, err := mf.ToIPLDNode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !nd.Cid().Equals(again.Cid()) {
+		t.Error("expected encoding to be deterministic")
+	}
+	bad := mf.Copy()
+	bad.Sizes = bad.Sizes[1:]
+	if _, err := bad.ToIPLDNode(); err == nil {
+		t.Error("expected misaligned sizes to error")
+	}
+
+	got, err := FromIPLDNode(nd)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(mf) {
+		t.Error("expected decoded manifest to equal the original")
+	}
+}
+
+func TestSplitForBlockLimit(t *testing.T) {
+	g := NewGraph([]layer{
+		{4, 4 * kb},
+		{5, 5 * kb},
+		{10, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	limit := 2 * kb
+	if !mf.ExceedsBlockLimit(limit) {
+		t.Fatalf("expected test manifest to exceed %d bytes, estimated %d", limit, mf.EstimatedCBORSize())
+	}
+	if mf.ExceedsBlockLimit(mf.EstimatedCBORSize()) {
+		t.Error("expected manifest to fit a limit of its own size")
+	}
+
+	parts := mf.SplitForBlockLimit(limit)
+	if len(parts) < 2 {
+		t.Fatalf("expected manifest to be split, got %d parts", len(parts))
+	}
+	for i, p := range parts {
+		verifyManifest(t, p)
+		if size := p.EstimatedCBORSize(); size > limit {
+			t.Errorf("part %d estimated at %d bytes exceeds limit of %d", i, size, limit)
+		}
+	}
+
+	// every node & link is in some part
+	if u := Union(parts...); !u.Equal(mf) {
+		t.Error("expected union of parts to equal the original manifest")
+	}
+
+	if parts := mf.SplitForBlockLimit(mf.EstimatedCBORSize()); len(parts) != 1 || !parts[0].Equal(mf) {
+		t.Error("expected manifest under the limit to come back whole")
+	}
+}
@@ -2,6 +2,12 @@ package manifest
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipld-format"
@@ -11,9 +17,96 @@ import (
 // node identifiers are stored in a slice "nodes", all other slices reference
 // cids by index positions
 type Manifest struct {
-	Nodes []string `json:"nodes"`
-	Links [][2]int `json:"links"`
-	Sizes []uint64 `json:"sizes"`
+	// Version is the schema version of the manifest. Decoded manifests are
+	// always migrated to CurrentVersion
+	Version uint     `json:"version"`
+	Nodes   []string `json:"nodes"`
+	Links   [][2]int `json:"links"`
+	Sizes   []uint64 `json:"sizes"`
+	// Blocks optionally holds the raw data of each node, aligned with Nodes.
+	// Only populated when generated with the EmbedBlocks option
+	Blocks [][]byte `json:"blocks,omitempty"`
+	// StoredSizes optionally holds the on-disk size of each node, aligned with
+	// Nodes, where Sizes holds the logical size. Only populated when generated
+	// with a node getter that implements StoredSizer
+	StoredSizes []uint64 `json:"storedSizes,omitempty"`
+	// VisitOrder optionally holds the sequence number each node was discovered
+	// at while generating the manifest, aligned with Nodes. Only populated when
+	// generated with the RecordVisitOrder option
+	VisitOrder []int `json:"visitOrder,omitempty"`
+	// FetchDurations optionally holds how long fetching each node took, aligned
+	// with Nodes. Nodes that weren't fetched, like the root & boundary nodes,
+	// take 0. Only populated when generated with the RecordTimings option
+	FetchDurations []time.Duration `json:"fetchDurations,omitempty"`
+	// LeafCounts optionally holds the number of links from each node to leaves
+	// left out of the manifest, aligned with Nodes. Only populated when
+	// generated with the SkipLeaves option
+	LeafCounts []int `json:"leafCounts,omitempty"`
+	// DroppedLinkCounts optionally holds the number of links from each node
+	// left out by the MaxFanoutPerNode option, aligned with Nodes. Only
+	// populated when generated with MaxFanoutPerNode
+	DroppedLinkCounts []int `json:"droppedLinkCounts,omitempty"`
+	// Boundaries lists the index positions of nodes that were recorded but not
+	// expanded because they're outside the boundary of the described DAG
+	Boundaries []int `json:"boundaries,omitempty"`
+	// MarkedRoots lists the index positions of nodes explicitly marked as
+	// roots, in addition to nodes that have no parents
+	MarkedRoots []int `json:"roots,omitempty"`
+	// Missing lists the index positions of placeholder nodes for links to
+	// nodes that couldn't be fetched
+	Missing []int `json:"missing,omitempty"`
+	// External lists the index positions of nodes in other networks, recorded
+	// with a size of 0 by the ExternalRefs option without being fetched
+	External []int `json:"external,omitempty"`
+	// DroppedLinks counts links left out of the manifest by the
+	// MaxFanoutPerNode option, or dropped as self-loops by RemapCIDs
+	DroppedLinks int `json:"droppedLinks,omitempty"`
+	// DroppedPerLevel counts nodes left out of the manifest by the
+	// MaxNodesPerLevel option, indexed by their depth
+	DroppedPerLevel []int `json:"droppedPerLevel,omitempty"`
+	// WeakLinks are links the LinkClassifier option marked weak, as pairs of
+	// index positions like Links. Weak links are recorded but don't count as
+	// structure, so they're ignored by everything that walks Links
+	WeakLinks [][2]int `json:"weakLinks,omitempty"`
+	// CreatedAt is when the manifest was generated, in unix seconds, stamped by
+	// NewManifest unless overridden with the CreatedAt option. 0 if unknown
+	CreatedAt int64 `json:"createdAt,omitempty"`
+
+	// cache holds lookups derived from nodes & links, see Invalidate
+	cache derivedCache
+	// frozen manifests can't be modified, see Freeze
+	frozen bool
+}
+
+// ManifestTooLargeError is returned when generating a manifest would exceed
+// the MaxEdges option
+type ManifestTooLargeError struct {
+	// Edges is the link count that would have exceeded the limit
+	Edges    int
+	MaxEdges int
+}
+
+// Error implements the error interface
+func (e ManifestTooLargeError) Error() string {
+	return fmt.Sprintf("manifest too large: %d links exceeds limit of %d", e.Edges, e.MaxEdges)
+}
+
+// StoredSizer is an optional interface a NodeGetter can implement to report the
+// stored size of a block, eg: after compression, when it differs from the
+// logical size of the node
+type StoredSizer interface {
+	StoredSize(ctx context.Context, id *cid.Cid) (uint64, error)
+}
+
+// CIDMismatchError is returned when a node getter returns a node with a
+// different cid than the one requested
+type CIDMismatchError struct {
+	Requested, Returned *cid.Cid
+}
+
+// Error implements the error interface
+func (e CIDMismatchError) Error() string {
+	return fmt.Sprintf("cid mismatch. requested: %s, returned: %s", e.Requested.String(), e.Returned.String())
 }
 
 // Node is a subset of the ipld format.Node interface
@@ -28,64 +121,1087 @@ type Node interface {
 
 // NewManifest generates a manifest from an ipld node
 func NewManifest(ctx context.Context, ng format.NodeGetter, node Node) (*Manifest, error) {
+	return newManifest(ctx, ng, node, Options{})
+}
+
+func newManifest(ctx context.Context, ng format.NodeGetter, node Node, opts Options) (*Manifest, error) {
+	return newMstate(ctx, ng, opts).build(node)
+}
+
+func newMstate(ctx context.Context, ng format.NodeGetter, opts Options) *mstate {
 	ms := &mstate{
-		ctx:  ctx,
-		ng:   ng,
-		cids: map[string]int{},
-		m:    &Manifest{},
+		ctx:        ctx,
+		ng:         ng,
+		opts:       opts,
+		cids:       map[string]int{},
+		skipped:    map[string]bool{},
+		known:      keySet(opts.Known),
+		boundaries: keySet(opts.Boundaries),
+		external:   keySet(opts.ExternalRefs),
+		leaves:     map[string]bool{},
+		m:          &Manifest{Version: CurrentVersion, CreatedAt: opts.CreatedAt},
+	}
+	ms.stored, _ = ng.(StoredSizer)
+	if ms.m.CreatedAt == 0 && !opts.OmitCreatedAt {
+		ms.m.CreatedAt = time.Now().Unix()
+	}
+	if opts.RecordTimings {
+		ms.durations = map[string]time.Duration{}
+	}
+	if opts.ApproximateDedup {
+		fpr := opts.DedupFalsePositiveRate
+		if fpr <= 0 || fpr >= 1 {
+			fpr = defaultDedupFalsePositiveRate
+		}
+		ms.visited = newBloomFilter(fpr)
+		ms.deferred = map[string][]int{}
 	}
+	return ms
+}
 
-	if _, err := ms.addNode(node); err != nil {
-		return nil, err
+// build adds node & everything it links to, returning the finished manifest
+func (ms *mstate) build(node Node) (*Manifest, error) {
+	if ms.opts.MaxNodesPerLevel > 0 {
+		ms.admitLevels(node)
+	}
+	_, err := ms.addNode(node, ms.linksOf(node), 0)
+	if err != nil {
+		if _, ok := err.(ManifestTooLargeError); !ok {
+			return nil, err
+		}
 	}
-	return ms.m, nil
+	if ms.visited != nil {
+		ms.resolveDeferred()
+	}
+	// weak links are only kept if the node they point to was added
+	for _, l := range ms.weak {
+		if to, ok := ms.cids[l.to]; ok {
+			ms.m.WeakLinks = append(ms.m.WeakLinks, [2]int{l.from, to})
+		}
+	}
+	if len(ms.bypassed) > 0 {
+		ms.m = ms.m.bypass(ms.bypassed)
+	}
+	return ms.m, err
 }
 
 // mstate is a state machine for generating a manifest
 type mstate struct {
-	ctx  context.Context
-	ng   format.NodeGetter
-	idx  int
-	cids map[string]int // lookup table of already-added cids
-	m    *Manifest
+	ctx   context.Context
+	ng    format.NodeGetter
+	opts  Options
+	idx   int
+	cids  map[string]int  // lookup table of already-added cids, by cid key
+	known map[string]bool // cids to add without fetching, by cid key
+	// boundary cids to add without fetching, by cid key
+	boundaries map[string]bool
+	// external cids to add without fetching, by cid key
+	external map[string]bool
+	// stored reports stored sizes if the node getter supports it
+	stored StoredSizer
+	// skipSizes records every node with a size of 0 instead of calling Size
+	skipSizes bool
+	// bypassed lists the indexes of nodes to remove once the manifest is built,
+	// linking their parents directly to their children
+	bypassed []int
+	// skipped cids were rejected by the node filter, by cid key
+	skipped map[string]bool
+	// admitted cids are the only ones added when MaxNodesPerLevel is set, by
+	// cid key. fetched holds admitted nodes already fetched while admitting
+	admitted map[string]bool
+	fetched  map[string]format.Node
+	// classified holds the links of nodes classified while admitting, by cid
+	// key, until they're added
+	classified map[string]nodeLinks
+	// weak links found so far, resolved once every node is added
+	weak []weakLink
+	// visited replaces cids with the ApproximateDedup option. Links to nodes
+	// it has seen are added with a target of deferredIdx & their positions in
+	// Links listed in deferred by cid key, to be resolved once every node is
+	// added
+	visited  *bloomFilter
+	deferred map[string][]int
+	// leaves are nodes left out by the SkipLeaves option, by cid key
+	leaves map[string]bool
+	// durations holds how long fetching took with the RecordTimings option, by
+	// cid key, until the node is recorded. Nodes fetched but left out are
+	// removed
+	durations map[string]time.Duration
+	m         *Manifest
+}
+
+// deferredIdx is the index position visit returns for links to resolve later
+const deferredIdx = -2
+
+// leafIdx is the index position visit returns for links to leaves left out by
+// the SkipLeaves option
+const leafIdx = -3
+
+// weakLink is a weak link from an index position to a cid key
+type weakLink struct {
+	from int
+	to   string
 }
 
 // addNode places a node in the manifest & state machine, recursively adding linked nodes
-// addNode returns early if this node is already added to the manifest
-func (ms *mstate) addNode(node Node) (int, error) {
-	id := node.Cid().String()
+// addNode returns early if this node is already added to the manifest. depth is
+// the distance from the root node. nl holds the node's classified links. Links
+// from a node are always appended in the order the node lists them
+func (ms *mstate) addNode(node Node, nl nodeLinks, depth int) (int, error) {
+	key := node.Cid().KeyString()
+	if idx, ok := ms.cids[key]; ok {
+		return idx, nil
+	}
+	keep, descend, err := ms.filter(node)
+	if err != nil {
+		return -1, err
+	}
+	if !keep && !descend {
+		ms.skipped[key] = true
+		delete(ms.durations, key)
+		return -1, nil
+	}
 
-	if idx, ok := ms.cids[id]; ok {
+	idx, _ := ms.insert(node, nl)
+	if !keep {
+		ms.bypassed = append(ms.bypassed, idx)
+	}
+	if ms.stored != nil {
+		size, err := ms.stored.StoredSize(ms.ctx, node.Cid())
+		if err != nil {
+			return -1, err
+		}
+		ms.m.StoredSizes[idx] = size
+	}
+	if !descend || (ms.opts.MaxDepth > 0 && depth >= ms.opts.MaxDepth) {
 		return idx, nil
 	}
 
-	// add the node
-	idx := ms.idx
-	ms.idx++
+	links, dropped := ms.fanout(nl.structural)
+	ms.m.DroppedLinks += dropped
+	if dropped > 0 {
+		ms.m.DroppedLinkCounts[idx] += dropped
+	}
+	for _, l := range nl.weak {
+		ms.weak = append(ms.weak, weakLink{idx, l.Cid.KeyString()})
+	}
+
+	for _, link := range links {
+		nodeIdx, err := ms.visit(link, depth+1)
+		if err != nil {
+			return -1, err
+		}
+		if nodeIdx < 0 && nodeIdx != deferredIdx && nodeIdx != leafIdx {
+			// skipped
+			continue
+		}
+		// skipped leaves aren't edges, so they don't count toward MaxEdges
+		if nodeIdx == leafIdx {
+			ms.m.LeafCounts[idx]++
+			continue
+		}
+		if max := ms.opts.MaxEdges; max > 0 && len(ms.m.Links) >= max {
+			return -1, ManifestTooLargeError{Edges: len(ms.m.Links) + 1, MaxEdges: max}
+		}
+		if nodeIdx == deferredIdx {
+			key := link.Cid.KeyString()
+			ms.deferred[key] = append(ms.deferred[key], len(ms.m.Links))
+		}
+		ms.m.Links = append(ms.m.Links, [2]int{idx, nodeIdx})
+	}
+
+	return idx, nil
+}
+
+// fanout picks the structural links of a node to follow, keeping the
+// MaxFanoutPerNode links with the lowest cid strings. fanout also returns how
+// many links were dropped
+func (ms *mstate) fanout(links []*format.Link) ([]*format.Link, int) {
+	max := ms.opts.MaxFanoutPerNode
+	if max <= 0 || len(links) <= max {
+		return links, 0
+	}
+	links = append([]*format.Link(nil), links...)
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Cid.String() < links[j].Cid.String()
+	})
+	return links[:max], len(links) - max
+}
+
+// admitLevels walks breadth-first from node, admitting up to MaxNodesPerLevel
+// nodes at each depth. Nodes past the cap are counted in DroppedPerLevel & left
+// out of the manifest without being fetched. Nodes that fail to fetch or
+// filter are admitted, leaving the error for the build to handle
+func (ms *mstate) admitLevels(node Node) {
+	max := ms.opts.MaxNodesPerLevel
+	ms.admitted = map[string]bool{node.Cid().KeyString(): true}
+	ms.fetched = map[string]format.Node{}
+	ms.classified = map[string]nodeLinks{}
+	seen := map[string]bool{node.Cid().KeyString(): true}
+	level := []Node{node}
+	for depth := 1; len(level) > 0; depth++ {
+		if ms.opts.MaxDepth > 0 && depth > ms.opts.MaxDepth {
+			break
+		}
+		var next []Node
+		count := 0
+		for _, n := range level {
+			nl := ms.classify(n)
+			ms.classified[n.Cid().KeyString()] = nl
+			links, _ := ms.fanout(nl.structural)
+			for _, l := range links {
+				key := l.Cid.KeyString()
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				if count >= max {
+					for len(ms.m.DroppedPerLevel) <= depth {
+						ms.m.DroppedPerLevel = append(ms.m.DroppedPerLevel, 0)
+					}
+					ms.m.DroppedPerLevel[depth]++
+					continue
+				}
+				if ms.boundaries[key] || ms.known[key] || ms.external[key] {
+					ms.admitted[key] = true
+					count++
+					continue
+				}
+
+				child, err := ms.fetch(l.Cid)
+				if err != nil {
+					delete(ms.durations, key)
+					ms.admitted[key] = true
+					count++
+					continue
+				}
+				keep, descend, err := ms.filter(child)
+				if err == nil && !keep && !descend {
+					// filtered out nodes don't take up the level
+					delete(ms.durations, key)
+					continue
+				}
+				ms.admitted[key] = true
+				ms.fetched[key] = child
+				count++
+				if err == nil && descend {
+					next = append(next, child)
+				}
+			}
+		}
+		level = next
+	}
+}
 
-	ms.cids[id] = idx
-	ms.m.Nodes = append(ms.m.Nodes, id)
+// resolveDeferred points deferred links at the nodes they link to. Links to
+// nodes the visited filter falsely reported as seen were never added, so
+// they're dropped. Weak links are resolved by cid too, so cids is filled in
+// for the nodes they point to
+func (ms *mstate) resolveDeferred() {
+	want := map[string]bool{}
+	for _, l := range ms.weak {
+		want[l.to] = true
+	}
+	for i, id := range ms.m.Nodes {
+		key := cidKey(id)
+		if pos, ok := ms.deferred[key]; ok {
+			for _, p := range pos {
+				ms.m.Links[p][1] = i
+			}
+			delete(ms.deferred, key)
+		}
+		if want[key] {
+			if _, ok := ms.cids[key]; !ok {
+				ms.cids[key] = i
+			}
+		}
+	}
+
+	// whatever is left was never added
+	if len(ms.deferred) > 0 {
+		drop := map[int]bool{}
+		for _, pos := range ms.deferred {
+			for _, p := range pos {
+				drop[p] = true
+			}
+		}
+		links := ms.m.Links[:0]
+		for i, l := range ms.m.Links {
+			if !drop[i] {
+				links = append(links, l)
+			}
+		}
+		ms.m.Links = links
+	}
+}
+
+// visit resolves a link to the index position of the node it points to,
+// fetching & adding the linked node if it isn't already in the manifest. visit
+// returns an index of -1 if the link should be skipped
+func (ms *mstate) visit(link *format.Link, depth int) (int, error) {
+	key := link.Cid.KeyString()
+	if idx, ok := ms.cids[key]; ok {
+		return idx, nil
+	}
+	if ms.visited != nil && ms.visited.has(key) {
+		return deferredIdx, nil
+	}
+	if ms.skipped[key] || (ms.admitted != nil && !ms.admitted[key]) {
+		return -1, nil
+	}
+
+	// boundary & known nodes are recorded with the size reported by the link,
+	// without fetching or descending into them
+	if ms.boundaries[key] {
+		idx, _ := ms.record(link.Cid, link.Size)
+		ms.m.Boundaries = append(ms.m.Boundaries, idx)
+		return idx, nil
+	}
+	if ms.known[key] {
+		idx, _ := ms.record(link.Cid, link.Size)
+		return idx, nil
+	}
+	if ms.external[key] {
+		idx, _ := ms.record(link.Cid, 0)
+		ms.m.External = append(ms.m.External, idx)
+		return idx, nil
+	}
+	// raw blocks can't link to anything, so they're leaves without fetching
+	if ms.opts.SkipLeaves && (ms.leaves[key] || link.Cid.Type() == cid.Raw) {
+		ms.leaves[key] = true
+		return leafIdx, nil
+	}
+
+	linkNode, err := ms.get(link.Cid)
+	if err == nil && !linkNode.Cid().Equals(link.Cid) {
+		err = CIDMismatchError{Requested: link.Cid, Returned: linkNode.Cid()}
+	}
+	if err != nil {
+		delete(ms.durations, key)
+		if !(ms.opts.BestEffort || ms.opts.RecordMissingEdges) || ms.ctx.Err() != nil {
+			return -1, err
+		}
+		if ms.opts.RecordMissingEdges {
+			idx, _ := ms.record(link.Cid, 0)
+			ms.m.Missing = append(ms.m.Missing, idx)
+			return idx, nil
+		}
+		return -1, nil
+	}
+	nl := ms.linksOf(linkNode)
+	if ms.opts.SkipLeaves && len(nl.structural) == 0 {
+		ms.leaves[key] = true
+		delete(ms.durations, key)
+		return leafIdx, nil
+	}
+	return ms.addNode(linkNode, nl, depth)
+}
+
+// get fetches a node, using the node admitLevels already fetched if there is
+// one
+func (ms *mstate) get(id *cid.Cid) (format.Node, error) {
+	if node, ok := ms.fetched[id.KeyString()]; ok {
+		delete(ms.fetched, id.KeyString())
+		return node, nil
+	}
+	return ms.fetch(id)
+}
+
+// fetch fetches a node with the node getter, retrying according to the retry
+// policy. With the RecordTimings option the time taken, retries included, is
+// kept in durations
+func (ms *mstate) fetch(id *cid.Cid) (format.Node, error) {
+	if ms.opts.RecordTimings {
+		start := time.Now()
+		defer func() {
+			ms.durations[id.KeyString()] = time.Since(start)
+		}()
+	}
+	policy := ms.opts.Retry
+	wait := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		node, err := ms.ng.Get(ms.ctx, id)
+		if err == nil || attempt >= policy.MaxAttempts || ms.ctx.Err() != nil {
+			return node, err
+		}
+		if policy.IsRetryable != nil && !policy.IsRetryable(err) {
+			return node, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ms.ctx.Done():
+			timer.Stop()
+			return nil, ms.ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// insert records a node in the manifest without visiting any of its links.
+// nl holds the node's classified links. insert returns false if the node is
+// already in the manifest
+func (ms *mstate) insert(node Node, nl nodeLinks) (int, bool) {
+	if idx, ok := ms.cids[node.Cid().KeyString()]; ok {
+		return idx, false
+	}
 
 	// ignore size errors b/c uint64 has no way to represent
 	// errored size state as an int (-1), hopefully implementations default to 0
 	// when erroring :/
-	size, _ := node.Size()
+	var size uint64
+	if !ms.skipSizes {
+		size = ms.size(node, nl)
+	}
 
+	idx, _ := ms.record(node.Cid(), size)
+	if size == 0 && ms.opts.ExcludeZeroSize {
+		ms.bypassed = append(ms.bypassed, idx)
+	}
+	if ms.opts.EmbedBlocks {
+		if b, ok := node.(interface{ RawData() []byte }); ok {
+			ms.m.Blocks[idx] = b.RawData()
+		}
+	}
+	return idx, true
+}
+
+// size gets the size of a node, reading it from the size cache if one is set
+func (ms *mstate) size(node Node, nl nodeLinks) uint64 {
+	c := ms.opts.SizeCache
+	if c != nil {
+		if size, ok := c.Get(node.Cid()); ok {
+			return size
+		}
+	}
+	var size uint64
+	raw, ok := node.(interface{ RawData() []byte })
+	if ms.opts.LeafSizeMode == LeafSizeRawData && ok && len(nl.structural) == 0 {
+		size = uint64(len(raw.RawData()))
+	} else {
+		size, _ = node.Size()
+	}
+	if c != nil {
+		c.Put(node.Cid(), size)
+	}
+	return size
+}
+
+// record adds a cid & size to the manifest. record returns false if the cid is
+// already in the manifest
+func (ms *mstate) record(id *cid.Cid, size uint64) (int, bool) {
+	key := id.KeyString()
+	if idx, ok := ms.cids[key]; ok {
+		return idx, false
+	}
+
+	idx := ms.idx
+	ms.idx++
+
+	if ms.visited != nil {
+		ms.visited.add(key)
+	} else {
+		ms.cids[key] = idx
+	}
+	ms.m.Nodes = append(ms.m.Nodes, id.String())
 	ms.m.Sizes = append(ms.m.Sizes, size)
+	if ms.opts.RecordTimings {
+		ms.m.FetchDurations = append(ms.m.FetchDurations, ms.durations[key])
+		delete(ms.durations, key)
+	}
+	if ms.opts.SkipLeaves {
+		ms.m.LeafCounts = append(ms.m.LeafCounts, 0)
+	}
+	if ms.opts.MaxFanoutPerNode > 0 {
+		ms.m.DroppedLinkCounts = append(ms.m.DroppedLinkCounts, 0)
+	}
+	if ms.opts.EmbedBlocks {
+		ms.m.Blocks = append(ms.m.Blocks, nil)
+	}
+	if ms.stored != nil {
+		ms.m.StoredSizes = append(ms.m.StoredSizes, 0)
+	}
+	if ms.opts.RecordVisitOrder {
+		ms.m.VisitOrder = append(ms.m.VisitOrder, idx)
+	}
+	return idx, true
+}
 
-	for _, link := range node.Links() {
-		linkNode, err := link.GetNode(ms.ctx, ms.ng)
-		if err != nil {
-			return -1, err
+// filter runs the configured node filter, keeping & descending into every node
+// when there isn't one
+func (ms *mstate) filter(node Node) (keep, descend bool, err error) {
+	if ms.opts.NodeFilter == nil {
+		return true, true, nil
+	}
+	n, ok := node.(format.Node)
+	if !ok {
+		return true, true, nil
+	}
+	return ms.opts.NodeFilter(n)
+}
+
+// nodeLinks are the links of a node, split into structural & weak links
+type nodeLinks struct {
+	structural, weak []*format.Link
+}
+
+// linksOf gets the classified links of a node, using the classification from
+// admitLevels if the node was already classified there
+func (ms *mstate) linksOf(node Node) nodeLinks {
+	key := node.Cid().KeyString()
+	if nl, ok := ms.classified[key]; ok {
+		delete(ms.classified, key)
+		return nl
+	}
+	return ms.classify(node)
+}
+
+// classify splits the links of a node into structural & weak links, using the
+// configured link extractor if one is set. Every link is structural without a
+// link classifier. Extractors & classifiers are user code, so each node should
+// only be classified once
+func (ms *mstate) classify(node Node) nodeLinks {
+	var nl nodeLinks
+	n, ok := node.(format.Node)
+	if ms.opts.LinkExtractor != nil && ok {
+		nl.structural = ms.opts.LinkExtractor(n)
+	} else {
+		nl.structural = node.Links()
+	}
+	if ms.opts.LinkClassifier == nil || !ok {
+		return nl
+	}
+	all := nl.structural
+	nl.structural = nil
+	for _, l := range all {
+		if ms.opts.LinkClassifier(n, l) == LinkWeak {
+			nl.weak = append(nl.weak, l)
+		} else {
+			nl.structural = append(nl.structural, l)
 		}
+	}
+	return nl
+}
 
-		nodeIdx, err := ms.addNode(linkNode)
-		if err != nil {
-			return -1, err
+// Equal checks if two manifests describe the same graph. Node order is ignored,
+// manifests are equal if they contain the same nodes with the same sizes and
+// the same set of links between them
+func (m *Manifest) Equal(other *Manifest) bool {
+	return m.EqualWithSizeTolerance(other, 0)
+}
+
+// EqualWithSizeTolerance is Equal, but sizes in other may differ from the size
+// of the same node in m by up to tolerancePct percent of it. Nodes with a size
+// of 0 in m must be 0 in other. Manifests without a size for every node are
+// never equal
+func (m *Manifest) EqualWithSizeTolerance(other *Manifest, tolerancePct float64) bool {
+	if len(m.Nodes) != len(other.Nodes) || len(m.Sizes) != len(m.Nodes) || len(other.Sizes) != len(other.Nodes) {
+		return false
+	}
+
+	sizes := other.sizeMap()
+	for i, key := range m.nodeKeys() {
+		size, ok := sizes[key]
+		if !ok {
+			return false
+		}
+		diff := size - m.Sizes[i]
+		if size < m.Sizes[i] {
+			diff = m.Sizes[i] - size
 		}
+		if diff > 0 && float64(diff) > float64(m.Sizes[i])*tolerancePct/100 {
+			return false
+		}
+	}
 
-		ms.m.Links = append(ms.m.Links, [2]int{idx, nodeIdx})
+	return m.sameLinkSet(other)
+}
+
+// SameTopology checks if two manifests describe the same graph, ignoring
+// sizes. Nodes & links are compared by cid, like Equal
+func (m *Manifest) SameTopology(other *Manifest) bool {
+	a, b := m.index(), other.index()
+	if len(a) != len(b) {
+		return false
 	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return m.sameLinkSet(other)
+}
 
-	return idx, nil
+// sameLinkSet checks if two manifests have the same set of links by cid
+func (m *Manifest) sameLinkSet(other *Manifest) bool {
+	a, err := m.linkKeys()
+	if err != nil {
+		return false
+	}
+	b, err := other.linkKeys()
+	if err != nil {
+		return false
+	}
+	as, bs := pairSet(a), pairSet(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for l := range as {
+		if !bs[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSizes errors if the manifest doesn't have exactly one size per node
+func (m *Manifest) checkSizes() error {
+	if len(m.Sizes) != len(m.Nodes) {
+		return fmt.Errorf("nodes/sizes length mismatch. %d != %d", len(m.Nodes), len(m.Sizes))
+	}
+	return nil
+}
+
+// sizeMap returns a map of cid key to size
+func (m *Manifest) sizeMap() map[string]uint64 {
+	sizes := make(map[string]uint64, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		if i < len(m.Sizes) {
+			sizes[key] = m.Sizes[i]
+		}
+	}
+	return sizes
+}
+
+// linkPairs resolves links from index positions to node ids
+func (m *Manifest) linkPairs() ([][2]string, error) {
+	return resolveLinks(m.Links, m.Nodes)
+}
+
+// linkKeys resolves links from index positions to cid keys
+func (m *Manifest) linkKeys() ([][2]string, error) {
+	return resolveLinks(m.Links, m.nodeKeys())
+}
+
+func resolveLinks(links [][2]int, ids []string) ([][2]string, error) {
+	pairs := make([][2]string, len(links))
+	for i, l := range links {
+		if l[0] < 0 || l[0] >= len(ids) || l[1] < 0 || l[1] >= len(ids) {
+			return nil, fmt.Errorf("link %d references out of range node index: %v", i, l)
+		}
+		pairs[i] = [2]string{ids[l[0]], ids[l[1]]}
+	}
+	return pairs, nil
+}
+
+// IndexOf returns the index position of a cid in the manifest, -1 if the cid
+// isn't in the manifest
+func (m *Manifest) IndexOf(id *cid.Cid) int {
+	str, key := id.String(), id.KeyString()
+	for i, n := range m.Nodes {
+		if n == str {
+			return i
+		}
+	}
+	// fall back to comparing binary forms in case the manifest stores id with
+	// a different multibase encoding
+	for i, n := range m.Nodes {
+		if cidKey(n) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Contains checks if a cid is in the manifest
+func (m *Manifest) Contains(id *cid.Cid) bool {
+	return m.IndexOf(id) >= 0
+}
+
+// cidKey converts a cid string to its binary form for use as a map key, so
+// equivalent cids with different multibase encodings match. Strings that
+// don't parse as a cid are used as-is
+func cidKey(id string) string {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return id
+	}
+	return c.KeyString()
+}
+
+// buildIndex builds a lookup table of cid key to first index position
+func (m *Manifest) buildIndex() map[string]int {
+	idx := make(map[string]int, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		if _, ok := idx[key]; !ok {
+			idx[key] = i
+		}
+	}
+	return idx
+}
+
+// keySet converts a set of cid strings to a set of cid keys
+func keySet(ids map[string]bool) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for id, ok := range ids {
+		if ok {
+			set[cidKey(id)] = true
+		}
+	}
+	return set
+}
+
+// nodeKeys returns the cid key of every node in the manifest
+func (m *Manifest) nodeKeys() []string {
+	keys := make([]string, len(m.Nodes))
+	for i, id := range m.Nodes {
+		keys[i] = cidKey(id)
+	}
+	return keys
+}
+
+// children builds a forward adjacency list of node index to child indexes
+func (m *Manifest) children() [][]int {
+	ch := make([][]int, len(m.Nodes))
+	for _, l := range m.Links {
+		ch[l[0]] = append(ch[l[0]], l[1])
+	}
+	return ch
+}
+
+// TotalSize sums the sizes of all nodes in the manifest. If the sum overflows
+// TotalSize saturates, returning math.MaxUint64
+func (m *Manifest) TotalSize() uint64 {
+	total, _ := m.TotalSizeChecked()
+	return total
+}
+
+// TotalStoredSize sums the stored sizes of all nodes in the manifest,
+// saturating to math.MaxUint64 on overflow. TotalStoredSize is 0 if the
+// manifest has no stored sizes
+func (m *Manifest) TotalStoredSize() uint64 {
+	total, _ := sumSizes(m.StoredSizes)
+	return total
+}
+
+// TotalSizeChecked sums the sizes of all nodes in the manifest, ok is false if
+// the sum overflows, in which case total is math.MaxUint64
+func (m *Manifest) TotalSizeChecked() (total uint64, ok bool) {
+	return sumSizes(m.Sizes)
+}
+
+// DedupedSize sums the sizes of all distinct cids in the manifest, counting
+// nodes listed more than once a single time. Like TotalSize, DedupedSize
+// saturates to math.MaxUint64 on overflow
+func (m *Manifest) DedupedSize() uint64 {
+	seen := map[string]bool{}
+	var sizes []uint64
+	for i, key := range m.nodeKeys() {
+		if !seen[key] {
+			seen[key] = true
+			sizes = append(sizes, m.Sizes[i])
+		}
+	}
+	total, _ := sumSizes(sizes)
+	return total
+}
+
+// sumSizes adds sizes together, saturating to math.MaxUint64 on overflow
+func sumSizes(sizes []uint64) (uint64, bool) {
+	total := uint64(0)
+	for _, s := range sizes {
+		if total > math.MaxUint64-s {
+			return math.MaxUint64, false
+		}
+		total += s
+	}
+	return total, true
+}
+
+// Copy returns a deep copy of the manifest
+func (m *Manifest) Copy() *Manifest {
+	c := &Manifest{
+		Version:           m.Version,
+		Nodes:             append([]string(nil), m.Nodes...),
+		Links:             append([][2]int(nil), m.Links...),
+		Sizes:             append([]uint64(nil), m.Sizes...),
+		StoredSizes:       append([]uint64(nil), m.StoredSizes...),
+		VisitOrder:        append([]int(nil), m.VisitOrder...),
+		FetchDurations:    append([]time.Duration(nil), m.FetchDurations...),
+		LeafCounts:        append([]int(nil), m.LeafCounts...),
+		DroppedLinks:      m.DroppedLinks,
+		DroppedLinkCounts: append([]int(nil), m.DroppedLinkCounts...),
+		DroppedPerLevel:   append([]int(nil), m.DroppedPerLevel...),
+		WeakLinks:         append([][2]int(nil), m.WeakLinks...),
+		CreatedAt:         m.CreatedAt,
+	}
+	if m.Blocks != nil {
+		c.Blocks = make([][]byte, len(m.Blocks))
+		for i, b := range m.Blocks {
+			if b != nil {
+				c.Blocks[i] = append(make([]byte, 0, len(b)), b...)
+			}
+		}
+	}
+	sets := c.indexSets()
+	for i, set := range m.indexSets() {
+		*sets[i] = append([]int(nil), *set...)
+	}
+	return c
+}
+
+// Compact rewrites the manifest's cid strings & blocks to share one backing
+// array each, deduplicating repeated cids. Decoded manifests hold a separate
+// allocation per cid, compacting leaves one for the whole manifest. No cid,
+// size or block changes. A frozen manifest is left as is
+func (m *Manifest) Compact() {
+	if m.frozen {
+		return
+	}
+	total := 0
+	for _, id := range m.Nodes {
+		total += len(id)
+	}
+	sb := &strings.Builder{}
+	sb.Grow(total)
+	offsets := map[string][2]int{}
+	for _, id := range m.Nodes {
+		if _, ok := offsets[id]; !ok {
+			offsets[id] = [2]int{sb.Len(), sb.Len() + len(id)}
+			sb.WriteString(id)
+		}
+	}
+	all := sb.String()
+	for i, id := range m.Nodes {
+		o := offsets[id]
+		m.Nodes[i] = all[o[0]:o[1]]
+	}
+
+	if m.Blocks == nil {
+		return
+	}
+	size := 0
+	for _, b := range m.Blocks {
+		size += len(b)
+	}
+	buf := make([]byte, 0, size)
+	for i, b := range m.Blocks {
+		if b == nil {
+			continue
+		}
+		start := len(buf)
+		buf = append(buf, b...)
+		// cap each block so appending to one can't overwrite the next
+		m.Blocks[i] = buf[start:len(buf):len(buf)]
+	}
+}
+
+// RepairLinks drops links that reference an index position outside of Nodes,
+// eg: left behind after removing nodes by hand, returning how many were
+// dropped. All other links are kept in order. Nothing is dropped from a frozen
+// manifest
+func (m *Manifest) RepairLinks() (removed int) {
+	if m.frozen {
+		return 0
+	}
+	links := m.Links[:0]
+	for _, l := range m.Links {
+		if l[0] < 0 || l[0] >= len(m.Nodes) || l[1] < 0 || l[1] >= len(m.Nodes) {
+			removed++
+			continue
+		}
+		links = append(links, l)
+	}
+	m.Links = links
+	if removed > 0 {
+		m.Invalidate()
+	}
+	return removed
+}
+
+// ErrFrozen is returned when modifying a frozen manifest
+var ErrFrozen = errors.New("manifest is frozen")
+
+// Freeze marks the manifest as immutable, eg: once it's validated & shared.
+// Methods that modify a frozen manifest return ErrFrozen, or leave it unchanged
+// if they don't return an error, catching accidental changes at runtime. Reading
+// is unaffected, as are copies of a frozen manifest. Freeze can't stop direct
+// changes to the exported fields
+func (m *Manifest) Freeze() {
+	m.frozen = true
+}
+
+// Frozen checks if the manifest has been frozen
+func (m *Manifest) Frozen() bool {
+	return m.frozen
+}
+
+// Age is how long before now the manifest was created. Age is 0 if the
+// creation time is unknown
+func (m *Manifest) Age(now time.Time) time.Duration {
+	if m.CreatedAt == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(m.CreatedAt, 0))
+}
+
+// indexSets returns pointers to every field that holds a set of node index
+// positions, so they can be kept in sync when nodes are moved or removed
+func (m *Manifest) indexSets() []*[]int {
+	return []*[]int{&m.Boundaries, &m.MarkedRoots, &m.Missing, &m.External}
+}
+
+// findRoots lists the indexes of all nodes no other node links to
+func (m *Manifest) findRoots() []int {
+	hasParent := make([]bool, len(m.Nodes))
+	for _, l := range m.Links {
+		hasParent[l[1]] = true
+	}
+	var roots []int
+	for i, p := range hasParent {
+		if !p {
+			roots = append(roots, i)
+		}
+	}
+	return roots
+}
+
+// depths calculates the shortest distance from a root for each node, nodes
+// that can't be reached from a root have a depth of -1
+func (m *Manifest) depths() []int {
+	depth := make([]int, len(m.Nodes))
+	for i := range depth {
+		depth[i] = -1
+	}
+	ch := m.children()
+	queue := m.roots()
+	for _, r := range queue {
+		depth[r] = 0
+	}
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		for _, c := range ch[idx] {
+			if depth[c] < 0 {
+				depth[c] = depth[idx] + 1
+				queue = append(queue, c)
+			}
+		}
+	}
+	return depth
+}
+
+// subManifest builds a new manifest of only the nodes marked in keep, dropping
+// any links that reference a node that isn't kept
+func (m *Manifest) subManifest(keep []bool) *Manifest {
+	sub := &Manifest{Version: m.Version, CreatedAt: m.CreatedAt}
+	idx := make([]int, len(m.Nodes))
+	for i, id := range m.Nodes {
+		idx[i] = -1
+		if keep[i] {
+			idx[i] = len(sub.Nodes)
+			sub.Nodes = append(sub.Nodes, id)
+			sub.Sizes = append(sub.Sizes, m.Sizes[i])
+			if m.Blocks != nil {
+				sub.Blocks = append(sub.Blocks, m.Blocks[i])
+			}
+			if m.StoredSizes != nil {
+				sub.StoredSizes = append(sub.StoredSizes, m.StoredSizes[i])
+			}
+			if m.VisitOrder != nil {
+				sub.VisitOrder = append(sub.VisitOrder, m.VisitOrder[i])
+			}
+			if m.FetchDurations != nil {
+				sub.FetchDurations = append(sub.FetchDurations, m.FetchDurations[i])
+			}
+			if m.LeafCounts != nil {
+				sub.LeafCounts = append(sub.LeafCounts, m.LeafCounts[i])
+			}
+			if m.DroppedLinkCounts != nil {
+				sub.DroppedLinkCounts = append(sub.DroppedLinkCounts, m.DroppedLinkCounts[i])
+			}
+		}
+	}
+	for _, l := range m.Links {
+		if keep[l[0]] && keep[l[1]] {
+			sub.Links = append(sub.Links, [2]int{idx[l[0]], idx[l[1]]})
+		}
+	}
+	for _, l := range m.WeakLinks {
+		if keep[l[0]] && keep[l[1]] {
+			sub.WeakLinks = append(sub.WeakLinks, [2]int{idx[l[0]], idx[l[1]]})
+		}
+	}
+	subSets := sub.indexSets()
+	for i, set := range m.indexSets() {
+		*subSets[i] = remapIndexes(*set, idx)
+	}
+	return sub
+}
+
+// bypass removes the nodes at idxs, linking the parents of each removed node
+// directly to its children so descendants stay connected
+func (m *Manifest) bypass(idxs []int) *Manifest {
+	drop := make([]bool, len(m.Nodes))
+	for _, i := range idxs {
+		drop[i] = true
+	}
+
+	ch := m.children()
+	res := m.Copy()
+	res.Links = nil
+	added := map[[2]int]bool{}
+	for from := range m.Nodes {
+		if drop[from] {
+			continue
+		}
+		// follow links through removed nodes until reaching kept ones
+		seen := map[int]bool{}
+		stack := append([]int(nil), ch[from]...)
+		for len(stack) > 0 {
+			to := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[to] {
+				continue
+			}
+			seen[to] = true
+			if drop[to] {
+				// leaves skipped under a removed node move up with its links
+				if res.LeafCounts != nil {
+					res.LeafCounts[from] += m.LeafCounts[to]
+				}
+				if res.DroppedLinkCounts != nil {
+					res.DroppedLinkCounts[from] += m.DroppedLinkCounts[to]
+				}
+				stack = append(stack, ch[to]...)
+				continue
+			}
+			if l := [2]int{from, to}; !added[l] {
+				added[l] = true
+				res.Links = append(res.Links, l)
+			}
+		}
+	}
+
+	keep := make([]bool, len(m.Nodes))
+	for i := range keep {
+		keep[i] = !drop[i]
+	}
+	sub := res.subManifest(keep)
+	sub.DroppedLinks = m.DroppedLinks
+	sub.DroppedPerLevel = m.DroppedPerLevel
+	return sub
+}
+
+// remapIndexes translates a list of index positions through remap, dropping
+// any index that remaps to a negative position
+func remapIndexes(idxs []int, remap []int) []int {
+	var res []int
+	for _, i := range idxs {
+		if remap[i] >= 0 {
+			res = append(res, remap[i])
+		}
+	}
+	return res
 }
@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipld-format"
@@ -21,15 +26,18 @@ type layer struct {
 type node struct {
 	cid   *cid.Cid
 	size  uint64
+	data  []byte
 	links []*node
 }
 
 func (n node) String() string        { return n.cid.String() }
 func (n node) Cid() *cid.Cid         { return n.cid }
 func (n node) Size() (uint64, error) { return n.size, nil }
+func (n node) RawData() []byte       { return n.data }
 func (n node) Links() (links []*format.Link) {
-	for _, l := range n.links {
+	for i, l := range n.links {
 		links = append(links, &format.Link{
+			Name: strconv.Itoa(i),
 			Size: l.size,
 			Cid:  l.Cid(),
 		})
@@ -37,14 +45,25 @@ func (n node) Links() (links []*format.Link) {
 	return
 }
 
+// ResolveLink treats the first path element as a link name
+func (n node) ResolveLink(path []string) (*format.Link, []string, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("empty path")
+	}
+	for _, l := range n.Links() {
+		if l.Name == path[0] {
+			return l, path[1:], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no link named %q", path[0])
+}
+
 // Not needed for manifest test:
-func (n node) Loggable() map[string]interface{}                          { return nil }
-func (n node) Copy() format.Node                                         { return nil }
-func (n node) RawData() []byte                                           { return nil }
-func (n node) Resolve(path []string) (interface{}, []string, error)      { return nil, nil, nil }
-func (n node) ResolveLink(path []string) (*format.Link, []string, error) { return nil, nil, nil }
-func (n node) Stat() (*format.NodeStat, error)                           { return nil, nil }
-func (n node) Tree(path string, depth int) []string                      { return nil }
+func (n node) Loggable() map[string]interface{}                     { return nil }
+func (n node) Copy() format.Node                                    { return nil }
+func (n node) Resolve(path []string) (interface{}, []string, error) { return nil, nil, nil }
+func (n node) Stat() (*format.NodeStat, error)                      { return nil, nil }
+func (n node) Tree(path string, depth int) []string                 { return nil }
 
 func NewGraph(layers []layer) (list []format.Node) {
 	root := newNode(2 * kb)
@@ -64,6 +83,26 @@ func insert(n *node, layers []layer, list *[]format.Node) {
 	}
 }
 
+// NewSharedGraph creates a graph where every node in a layer links to every
+// node in the next layer, giving a single root and lots of shared nodes
+func NewSharedGraph(layers []layer) (list []format.Node) {
+	prev := []*node{newNode(2 * kb)}
+	list = append(list, prev[0])
+	for _, l := range layers {
+		var next []*node
+		for i := 0; i < l.numChildren; i++ {
+			ch := newNode(l.size)
+			next = append(next, ch)
+			list = append(list, ch)
+		}
+		for _, p := range prev {
+			p.links = append(p.links, next...)
+		}
+		prev = next
+	}
+	return
+}
+
 // monotonic content counter for unique, consistent cids
 var content = 0
 
@@ -77,7 +116,8 @@ func newNode(size uint64) *node {
 	}
 
 	// And then feed it some data
-	c, err := pref.Sum([]byte(strconv.Itoa(content)))
+	data := []byte(strconv.Itoa(content))
+	c, err := pref.Sum(data)
 	if err != nil {
 		panic(err)
 	}
@@ -86,6 +126,7 @@ func newNode(size uint64) *node {
 	return &node{
 		cid:  c,
 		size: size,
+		data: data,
 	}
 }
 
@@ -131,6 +172,226 @@ func TestNewManifest(t *testing.T) {
 	t.Logf("manifest representing %d nodes and %s of content is %s as CBOR", len(mf.Nodes), fileSize(size), fileSize(buf.Len()))
 }
 
+func TestTotalSizeOverflow(t *testing.T) {
+	mf := &Manifest{
+		Nodes: []string{"a", "b", "c"},
+		Sizes: []uint64{math.MaxUint64 - 1, 1, 1},
+	}
+
+	if total, ok := mf.TotalSizeChecked(); ok || total != math.MaxUint64 {
+		t.Errorf("expected overflow to be reported & saturate, got: %d, %t", total, ok)
+	}
+	if total := mf.TotalSize(); total != math.MaxUint64 {
+		t.Errorf("expected total size to saturate, got: %d", total)
+	}
+
+	mf.Sizes = mf.Sizes[:2]
+	mf.Nodes = mf.Nodes[:2]
+	if total, ok := mf.TotalSizeChecked(); !ok || total != math.MaxUint64 {
+		t.Errorf("expected exact sum of max uint64 without overflow, got: %d, %t", total, ok)
+	}
+}
+
+func TestCreatedAt(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.CreatedAt == 0 {
+		t.Error("expected NewManifest to stamp CreatedAt")
+	}
+	if age := mf.Age(time.Now()); age < 0 || age > time.Minute {
+		t.Errorf("expected a freshly built manifest to be recent, got age: %s", age)
+	}
+
+	// opting out encodes the same DAG identically
+	omit := Options{OmitCreatedAt: true}
+	mf, err = NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], omit)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	again, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], omit)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.CreatedAt != 0 {
+		t.Errorf("expected CreatedAt to be omitted, got: %d", mf.CreatedAt)
+	}
+	a, _ := mf.MarshalBinary()
+	b, _ := again.MarshalBinary()
+	if !bytes.Equal(a, b) {
+		t.Error("expected building the same DAG twice to encode identically")
+	}
+
+	mf, err = NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{CreatedAt: 1000})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.CreatedAt != 1000 {
+		t.Errorf("expected CreatedAt option to override, got: %d", mf.CreatedAt)
+	}
+	if age := mf.Age(time.Unix(1090, 0)); age != 90*time.Second {
+		t.Errorf("expected age of 90s, got: %s", age)
+	}
+
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.CreatedAt != 1000 {
+		t.Errorf("expected CreatedAt to survive encoding, got: %d", got.CreatedAt)
+	}
+
+	if age := (&Manifest{}).Age(time.Now()); age != 0 {
+		t.Errorf("expected unset CreatedAt to have an age of 0, got: %s", age)
+	}
+}
+
+func TestRepairLinks(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := append([][2]int(nil), mf.Links...)
+
+	if removed := mf.RepairLinks(); removed != 0 {
+		t.Errorf("expected a valid manifest to need no repair, removed: %d", removed)
+	}
+
+	// drop the last node by hand, leaving its link dangling
+	mf.Nodes = mf.Nodes[:len(mf.Nodes)-1]
+	mf.Sizes = mf.Sizes[:len(mf.Sizes)-1]
+	mf.Links = append(mf.Links, [2]int{-1, 0})
+	if removed := mf.RepairLinks(); removed != 2 {
+		t.Errorf("expected 2 dangling links to be removed, got: %d", removed)
+	}
+	var kept [][2]int
+	for _, l := range expect {
+		if l[1] != len(mf.Nodes) {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) != len(expect)-1 || !reflect.DeepEqual(mf.Links, kept) {
+		t.Errorf("expected only the dangling links to be dropped. expected: %v, got: %v", kept, mf.Links)
+	}
+	if _, err := mf.linkKeys(); err != nil {
+		t.Errorf("expected repaired links to be valid, got: %s", err.Error())
+	}
+}
+
+func TestDedupedSize(t *testing.T) {
+	a, b := newNode(kb), newNode(kb)
+	mf := &Manifest{
+		Nodes: []string{a.Cid().String(), b.Cid().String(), a.Cid().String()},
+		Sizes: []uint64{2, 3, 2},
+	}
+	if size := mf.DedupedSize(); size != 5 {
+		t.Errorf("expected deduped size of 5, got: %d", size)
+	}
+
+	mf.Sizes[0] = math.MaxUint64
+	if size := mf.DedupedSize(); size != math.MaxUint64 {
+		t.Errorf("expected deduped size to saturate, got: %d", size)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := mf.Copy()
+
+	mf.Compact()
+	verifyManifest(t, mf)
+	if !mf.Equal(expect) {
+		t.Error("expected compacted manifest to equal the original")
+	}
+	for i, b := range mf.Blocks {
+		if mf.Nodes[i] != expect.Nodes[i] || !bytes.Equal(b, expect.Blocks[i]) {
+			t.Errorf("node %d changed by compacting", i)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{EmbedBlocks: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Blocks[1] = nil
+	c := mf.Copy()
+	if !c.Equal(mf) || c.Blocks[1] != nil {
+		t.Fatal("expected copy to equal the original")
+	}
+
+	// writing to a copied block mustn't touch the original
+	orig := append([]byte(nil), mf.Blocks[0]...)
+	c.Blocks[0][0]++
+	if !bytes.Equal(mf.Blocks[0], orig) {
+		t.Error("expected copy to have its own blocks")
+	}
+}
+
+func BenchmarkCompact(b *testing.B) {
+	g := NewGraph([]layer{
+		{10, 4 * kb},
+		{100, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	// report how many heap objects a decoded manifest keeps alive
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%t", compact), func(b *testing.B) {
+			var before, after runtime.MemStats
+			live := int64(0)
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				got := &Manifest{}
+				if err := got.UnmarshalBinary(data); err != nil {
+					b.Fatal(err.Error())
+				}
+				if compact {
+					got.Compact()
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				runtime.KeepAlive(got)
+				live += int64(after.HeapObjects) - int64(before.HeapObjects)
+			}
+			b.ReportMetric(float64(live)/float64(b.N), "live-objects/op")
+		})
+	}
+}
+
 func verifyManifest(t *testing.T, mf *Manifest) {
 	if len(mf.Nodes) != len(mf.Sizes) {
 		t.Errorf("nodes/sizes length mismatch. %d != %d", len(mf.Nodes), len(mf.Sizes))
@@ -161,3 +422,127 @@ func (f fileSize) String() string {
 	}
 	return "NaN"
 }
+
+func TestSameTopology(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resized := mf.Copy()
+	for i := range resized.Sizes {
+		resized.Sizes[i]++
+	}
+	if !mf.SameTopology(resized) {
+		t.Error("expected manifests that only differ in size to have the same topology")
+	}
+	if mf.Equal(resized) {
+		t.Error("expected manifests with different sizes to not be equal")
+	}
+
+	relinked := mf.Copy()
+	relinked.Links = relinked.Links[1:]
+	if mf.SameTopology(relinked) {
+		t.Error("expected dropping a link to change the topology")
+	}
+	renamed := mf.Copy()
+	renamed.Nodes[len(renamed.Nodes)-1] = newNode(kb).Cid().String()
+	if mf.SameTopology(renamed) {
+		t.Error("expected swapping a node to change the topology")
+	}
+}
+
+func TestEqualWithSizeTolerance(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resized := mf.Copy()
+	for i := range resized.Sizes {
+		if i%2 == 0 {
+			resized.Sizes[i] += resized.Sizes[i] / 100
+		} else {
+			resized.Sizes[i] -= resized.Sizes[i] / 100
+		}
+	}
+	if !mf.EqualWithSizeTolerance(resized, 2) {
+		t.Error("expected sizes 1% apart to be equal at 2% tolerance")
+	}
+	if mf.EqualWithSizeTolerance(resized, 0.5) {
+		t.Error("expected sizes 1% apart not to be equal at 0.5% tolerance")
+	}
+
+	mf.Sizes[1], resized.Sizes[1] = 0, 0
+	if !mf.EqualWithSizeTolerance(resized, 2) {
+		t.Error("expected zero sizes to be equal")
+	}
+	resized.Sizes[1] = 1
+	if mf.EqualWithSizeTolerance(resized, 2) {
+		t.Error("expected a zero size to need an exact match")
+	}
+
+	relinked := mf.Copy()
+	relinked.Links = relinked.Links[1:]
+	if mf.EqualWithSizeTolerance(relinked, 100) {
+		t.Error("expected different links not to be equal")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	total := mf.TotalSize()
+	mf.Freeze()
+	if !mf.Frozen() {
+		t.Error("expected manifest to be frozen")
+	}
+
+	if err := mf.AddRoot(g[1].Cid()); err != ErrFrozen {
+		t.Errorf("expected ErrFrozen adding a root, got: %v", err)
+	}
+	if len(mf.MarkedRoots) != 0 {
+		t.Error("expected frozen manifest to be unchanged")
+	}
+	if err := mf.NormalizeCIDs(1); err != ErrFrozen {
+		t.Errorf("expected ErrFrozen normalizing cids, got: %v", err)
+	}
+	nodes := append([]string(nil), mf.Nodes...)
+	links := append([][2]int(nil), mf.Links...)
+	mf.Canonicalize()
+	sort.Sort(mf.BySize())
+	mf.Compact()
+	mf.Links = append(mf.Links, [2]int{0, len(mf.Nodes)})
+	if removed := mf.RepairLinks(); removed != 0 {
+		t.Errorf("expected no links repaired on frozen manifest, got: %d", removed)
+	}
+	mf.Links = mf.Links[:len(links)]
+	if !reflect.DeepEqual(mf.Nodes, nodes) || !reflect.DeepEqual(mf.Links, links) {
+		t.Error("expected frozen manifest to be unchanged")
+	}
+
+	if mf.TotalSize() != total {
+		t.Errorf("expected total size %d on frozen manifest, got: %d", total, mf.TotalSize())
+	}
+	c := mf.Copy()
+	if c.Frozen() {
+		t.Error("expected copy of a frozen manifest to be mutable")
+	}
+	if err := c.AddRoot(g[1].Cid()); err != nil {
+		t.Errorf("expected copy to accept changes, got: %s", err.Error())
+	}
+}
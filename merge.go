@@ -0,0 +1,341 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Union combines manifests into a single manifest of all their nodes, links &
+// weak links. Nodes are deduplicated by the binary form of their cid. When a
+// node appears in more than one manifest the first occurrence's cid string &
+// size are kept. Nodes past the end of a manifest's Sizes are skipped, along
+// with their links, unless another manifest already added them
+func Union(manifests ...*Manifest) *Manifest {
+	u := newUnion(&Manifest{Version: CurrentVersion})
+	for _, m := range manifests {
+		u.add(m)
+	}
+	return u.m
+}
+
+// MergeStream folds each manifest received from in into out, like Union, until
+// in is closed. Only out & the manifest being merged need to be held in
+// memory. Per-node fields Union doesn't keep, like Blocks, are dropped from
+// out. MergeStream returns the context's error if it's cancelled first
+func MergeStream(ctx context.Context, out *Manifest, in <-chan *Manifest) error {
+	if out.frozen {
+		return ErrFrozen
+	}
+	out.Blocks, out.StoredSizes, out.VisitOrder, out.FetchDurations, out.LeafCounts, out.DroppedLinkCounts = nil, nil, nil, nil, nil, nil
+	u := newUnion(out)
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return nil
+			}
+			u.add(m)
+			out.Invalidate()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// union accumulates manifests into one, tracking nodes & links already added
+type union struct {
+	m     *Manifest
+	idx   map[string]int
+	links map[[2]int]bool
+	weak  map[[2]int]bool
+}
+
+func newUnion(m *Manifest) *union {
+	u := &union{m: m, idx: m.buildIndex(), links: map[[2]int]bool{}, weak: map[[2]int]bool{}}
+	for _, l := range m.Links {
+		u.links[l] = true
+	}
+	for _, l := range m.WeakLinks {
+		u.weak[l] = true
+	}
+	return u
+}
+
+func (u *union) add(m *Manifest) {
+	remap := make([]int, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		j, ok := u.idx[key]
+		if !ok && i >= len(m.Sizes) {
+			remap[i] = -1
+			continue
+		}
+		if !ok {
+			j = len(u.m.Nodes)
+			u.idx[key] = j
+			u.m.Nodes = append(u.m.Nodes, m.Nodes[i])
+			u.m.Sizes = append(u.m.Sizes, m.Sizes[i])
+		}
+		remap[i] = j
+	}
+	for _, l := range m.Links {
+		ul := [2]int{remap[l[0]], remap[l[1]]}
+		if ul[0] < 0 || ul[1] < 0 {
+			continue
+		}
+		if !u.links[ul] {
+			u.links[ul] = true
+			u.m.Links = append(u.m.Links, ul)
+		}
+	}
+	for _, l := range m.WeakLinks {
+		ul := [2]int{remap[l[0]], remap[l[1]]}
+		if ul[0] < 0 || ul[1] < 0 {
+			continue
+		}
+		if !u.weak[ul] {
+			u.weak[ul] = true
+			u.m.WeakLinks = append(u.m.WeakLinks, ul)
+		}
+	}
+	uSets := u.m.indexSets()
+	for i, set := range m.indexSets() {
+		*uSets[i] = appendIndexSet(*uSets[i], remapIndexes(*set, remap))
+	}
+}
+
+// appendIndexSet adds idxs to set, skipping indexes already in set
+func appendIndexSet(set []int, idxs []int) []int {
+	for _, i := range idxs {
+		if !containsIndex(set, i) {
+			set = append(set, i)
+		}
+	}
+	return set
+}
+
+func containsIndex(idxs []int, idx int) bool {
+	for _, i := range idxs {
+		if i == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlap measures how much of b is already covered by a, as the fraction of
+// b's deduplicated bytes & distinct nodes that are also in a. Both fractions
+// are 0 if b is empty. Like Union, nodes of b past the end of its Sizes are
+// skipped
+func Overlap(a, b *Manifest) (byteOverlapFrac, nodeOverlapFrac float64) {
+	inA := a.index()
+	seen := map[string]bool{}
+	var nodes, shared int
+	var total, sharedBytes float64
+	for i, key := range b.nodeKeys() {
+		if seen[key] || i >= len(b.Sizes) {
+			continue
+		}
+		seen[key] = true
+		nodes++
+		total += float64(b.Sizes[i])
+		if _, ok := inA[key]; ok {
+			shared++
+			sharedBytes += float64(b.Sizes[i])
+		}
+	}
+
+	if nodes == 0 {
+		return 0, 0
+	}
+	if total > 0 {
+		byteOverlapFrac = sharedBytes / total
+	}
+	return byteOverlapFrac, float64(shared) / float64(nodes)
+}
+
+// SymmetricDiff returns a manifest of the nodes that are in exactly one of a
+// & b, keeping links between them. Links that cross into nodes both manifests
+// share are dropped, so the result may have more than one root
+func SymmetricDiff(a, b *Manifest) *Manifest {
+	return Union(a.exclude(b), b.exclude(a))
+}
+
+// WindowDeltas returns what each of an ordered list of versions adds over the
+// version before it: one manifest per adjacent pair, of the nodes in the
+// newer version that aren't in the older one. Links from new nodes into nodes
+// both versions share are dropped, as in SymmetricDiff
+func WindowDeltas(versions []*Manifest) []*Manifest {
+	if len(versions) < 2 {
+		return nil
+	}
+	deltas := make([]*Manifest, len(versions)-1)
+	for i := range deltas {
+		deltas[i] = versions[i+1].exclude(versions[i])
+	}
+	return deltas
+}
+
+// exclude builds a sub-manifest of the nodes in m that aren't in other
+func (m *Manifest) exclude(other *Manifest) *Manifest {
+	idx := other.index()
+	keep := make([]bool, len(m.Nodes))
+	for i, key := range m.nodeKeys() {
+		_, shared := idx[key]
+		keep[i] = !shared
+	}
+	return m.subManifest(keep)
+}
+
+// IsSubsetOf checks if every node in m is also in other. Nodes are compared by
+// cid binary form, so cids that only differ in multibase match. Links & sizes
+// are ignored
+func (m *Manifest) IsSubsetOf(other *Manifest) bool {
+	idx := other.index()
+	for _, key := range m.nodeKeys() {
+		if _, ok := idx[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSupersetOf checks if every node in other is also in m, like IsSubsetOf
+func (m *Manifest) IsSupersetOf(other *Manifest) bool {
+	return other.IsSubsetOf(m)
+}
+
+// SafeToDelete lists the cids in candidate that no manifest in keep refers
+// to, the blocks that can be garbage collected when candidate is dropped
+func SafeToDelete(keep []*Manifest, candidate *Manifest) ([]*cid.Cid, error) {
+	return candidate.cidsAt(candidate.absentFrom(nodeKeySet(keep)))
+}
+
+// nodeKeySet combines the node keys of manifests into one set
+func nodeKeySet(manifests []*Manifest) map[string]bool {
+	set := map[string]bool{}
+	for _, m := range manifests {
+		for _, key := range m.nodeKeys() {
+			set[key] = true
+		}
+	}
+	return set
+}
+
+// absentFrom lists the index positions of distinct nodes in m whose key isn't
+// in set
+func (m *Manifest) absentFrom(set map[string]bool) []int {
+	var idxs []int
+	seen := map[string]bool{}
+	for i, key := range m.nodeKeys() {
+		if !set[key] && !seen[key] {
+			seen[key] = true
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// Similarity scores how alike two manifests are as the Jaccard index of their
+// node sets & link sets: the size of the intersection over the size of the
+// union. Two empty sets are identical, scoring 1. Links are only compared if
+// both manifests have valid links, otherwise edgeJaccard is 0
+func Similarity(a, b *Manifest) (nodeJaccard, edgeJaccard float64) {
+	nodeJaccard = jaccard(keysToSet(a.nodeKeys()), keysToSet(b.nodeKeys()))
+
+	al, err := a.linkKeys()
+	if err != nil {
+		return nodeJaccard, 0
+	}
+	bl, err := b.linkKeys()
+	if err != nil {
+		return nodeJaccard, 0
+	}
+	return nodeJaccard, jaccardPairs(pairSet(al), pairSet(bl))
+}
+
+func keysToSet(keys []string) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	shared := 0
+	for key := range a {
+		if b[key] {
+			shared++
+		}
+	}
+	if union := len(a) + len(b) - shared; union > 0 {
+		return float64(shared) / float64(union)
+	}
+	return 1
+}
+
+func jaccardPairs(a, b map[[2]string]bool) float64 {
+	shared := 0
+	for l := range a {
+		if b[l] {
+			shared++
+		}
+	}
+	if union := len(a) + len(b) - shared; union > 0 {
+		return float64(shared) / float64(union)
+	}
+	return 1
+}
+
+// PinCost is what pinning candidate would add on top of the existing pinned
+// manifests: the nodes in candidate that no existing manifest has, and the sum
+// of their sizes
+func PinCost(existing []*Manifest, candidate *Manifest) (newNodes []*cid.Cid, newBytes uint64, err error) {
+	idxs := candidate.absentFrom(nodeKeySet(existing))
+	if newNodes, err = candidate.cidsAt(idxs); err != nil {
+		return nil, 0, err
+	}
+	sizes := make([]uint64, len(idxs))
+	for i, idx := range idxs {
+		sizes[i] = candidate.Sizes[idx]
+	}
+	newBytes, _ = sumSizes(sizes)
+	return newNodes, newBytes, nil
+}
+
+// SharedAtLeast lists the distinct cids present in at least k of manifests,
+// sorted by cid string. A k of 0 or less lists every distinct cid
+func SharedAtLeast(k int, manifests ...*Manifest) ([]*cid.Cid, error) {
+	counts := map[string]int{}
+	strs := map[string]string{}
+	for _, m := range manifests {
+		for i, key := range m.nodeKeys() {
+			if _, ok := strs[key]; !ok {
+				strs[key] = m.Nodes[i]
+			}
+		}
+		for key := range keysToSet(m.nodeKeys()) {
+			counts[key]++
+		}
+	}
+
+	var found []string
+	for key, n := range counts {
+		if n >= k {
+			found = append(found, strs[key])
+		}
+	}
+	sort.Strings(found)
+
+	ids := make([]*cid.Cid, 0, len(found))
+	for _, str := range found {
+		id, err := cid.Decode(str)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
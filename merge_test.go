@@ -0,0 +1,455 @@
+package manifest
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multibase"
+)
+
+func TestUnion(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+
+	a, err := NewManifest(context.Background(), TestNodeGetter{g}, root.links[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	u := Union(a, b)
+	verifyManifest(t, u)
+	if !u.Equal(b) {
+		t.Error("expected union of a subgraph & graph to equal graph")
+	}
+}
+
+func TestUnionMisalignedSizes(t *testing.T) {
+	a := &Manifest{Nodes: []string{newNode(kb).Cid().String(), newNode(kb).Cid().String()}, Sizes: []uint64{kb}, Links: [][2]int{{0, 1}}}
+	b := &Manifest{Nodes: []string{a.Nodes[0], newNode(kb).Cid().String()}, Sizes: []uint64{2 * kb, kb}, Links: [][2]int{{0, 1}}}
+
+	u := Union(a, b)
+	verifyManifest(t, u)
+	if len(u.Nodes) != 2 || u.Nodes[0] == a.Nodes[1] || u.Nodes[1] == a.Nodes[1] {
+		t.Errorf("expected the node without a size to be skipped, got %d nodes", len(u.Nodes))
+	}
+	if len(u.Links) != 1 || u.Sizes[0] != kb {
+		t.Errorf("expected only b's link & a's size, got %d links & size %d", len(u.Links), u.Sizes[0])
+	}
+
+	// nodes without a size are linked if they were already added
+	u = Union(b, &Manifest{Nodes: []string{b.Nodes[1], b.Nodes[0]}, Links: [][2]int{{0, 1}}})
+	if len(u.Nodes) != 2 || len(u.Links) != 2 {
+		t.Errorf("expected 2 nodes & 2 links, got %d & %d", len(u.Nodes), len(u.Links))
+	}
+	if u.Equal(a) || a.Equal(u) {
+		t.Error("expected a manifest with missing sizes to never be equal")
+	}
+}
+
+func TestUnionWeakLinks(t *testing.T) {
+	a := &Manifest{Nodes: []string{newNode(kb).Cid().String(), newNode(kb).Cid().String()}, Sizes: []uint64{kb, kb}, WeakLinks: [][2]int{{1, 0}}}
+	b := &Manifest{Nodes: []string{a.Nodes[1], newNode(kb).Cid().String(), a.Nodes[0]}, Sizes: []uint64{kb, kb, kb}, WeakLinks: [][2]int{{0, 2}, {1, 0}}}
+
+	u := Union(a, b)
+	expect := [][2]int{{1, 0}, {2, 1}}
+	if !reflect.DeepEqual(u.WeakLinks, expect) {
+		t.Errorf("expected weak links %v, got: %v", expect, u.WeakLinks)
+	}
+
+	in := make(chan *Manifest, 2)
+	in <- a
+	in <- b
+	close(in)
+	out := &Manifest{}
+	if err := MergeStream(context.Background(), out, in); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(out.WeakLinks, expect) {
+		t.Errorf("expected streamed weak links %v, got: %v", expect, out.WeakLinks)
+	}
+}
+
+func TestUnionMultibase(t *testing.T) {
+	n := newNode(kb)
+	b58 := n.Cid().String()
+	b32, err := n.Cid().StringOfBase(multibase.Base32)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if b58 == b32 {
+		t.Fatal("expected differing cid string encodings")
+	}
+
+	a := &Manifest{Nodes: []string{b58}, Sizes: []uint64{kb}}
+	b := &Manifest{Nodes: []string{b32}, Sizes: []uint64{kb}}
+
+	u := Union(a, b)
+	if len(u.Nodes) != 1 {
+		t.Errorf("expected equivalent cids to dedupe to 1 node, got: %d", len(u.Nodes))
+	}
+	if idx := b.IndexOf(n.Cid()); idx != 0 {
+		t.Errorf("expected IndexOf to match base32 cid string, got: %d", idx)
+	}
+	if !a.Equal(b) {
+		t.Error("expected manifests of equivalent cids to be equal")
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	// b is a root linking to 3 leaves a already has & one new leaf
+	oldLeaves := []*node{newNode(100 * kb), newNode(100 * kb), newNode(100 * kb)}
+	rootA := newNode(0)
+	rootA.links = oldLeaves
+	added := newNode(100 * kb)
+	rootB := newNode(0)
+	rootB.links = append(append([]*node{}, oldLeaves...), added)
+
+	ng := TestNodeGetter{[]format.Node{rootA, rootB, oldLeaves[0], oldLeaves[1], oldLeaves[2], added}}
+	a, err := NewManifest(context.Background(), ng, rootA)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), ng, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	bytes, nodes := Overlap(a, b)
+	if math.Abs(bytes-0.75) > 0.001 {
+		t.Errorf("expected byte overlap of 0.75, got: %f", bytes)
+	}
+	if math.Abs(nodes-0.6) > 0.001 {
+		t.Errorf("expected node overlap of 0.6, got: %f", nodes)
+	}
+
+	if bytes, nodes := Overlap(a, &Manifest{}); bytes != 0 || nodes != 0 {
+		t.Errorf("expected no overlap with an empty manifest, got: %f, %f", bytes, nodes)
+	}
+
+	// nodes without a size are skipped
+	short := &Manifest{Nodes: []string{newNode(kb).Cid().String(), newNode(kb).Cid().String()}, Sizes: []uint64{kb}}
+	if bytes, nodes := Overlap(a, short); bytes != 0 || nodes != 0 {
+		t.Errorf("expected no overlap with unsized nodes skipped, got: %f, %f", bytes, nodes)
+	}
+}
+
+func TestSymmetricDiff(t *testing.T) {
+	shared := newNode(4 * kb)
+	shared.links = []*node{newNode(kb), newNode(kb)}
+	onlyA := newNode(2 * kb)
+	onlyA.links = []*node{newNode(kb)}
+	onlyB := newNode(3 * kb)
+	rootA, rootB := newNode(kb), newNode(kb)
+	rootA.links = []*node{shared, onlyA}
+	rootB.links = []*node{onlyB, shared}
+
+	ng := TestNodeGetter{[]format.Node{rootA, rootB, shared, shared.links[0], shared.links[1], onlyA, onlyA.links[0], onlyB}}
+	a, err := NewManifest(context.Background(), ng, rootA)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), ng, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	diff := SymmetricDiff(a, b)
+	verifyManifest(t, diff)
+	expect := []*node{rootA, onlyA, onlyA.links[0], rootB, onlyB}
+	if len(diff.Nodes) != len(expect) {
+		t.Errorf("expected %d nodes, got: %d", len(expect), len(diff.Nodes))
+	}
+	for _, n := range expect {
+		if !diff.Contains(n.Cid()) {
+			t.Errorf("expected diff to contain %s", n.Cid().String())
+		}
+	}
+	// rootA -> onlyA -> leaf, rootB -> onlyB
+	if len(diff.Links) != 3 {
+		t.Errorf("expected 3 links, got: %d", len(diff.Links))
+	}
+	if roots, _ := diff.Roots(); len(roots) != 2 {
+		t.Errorf("expected 2 roots, got: %d", len(roots))
+	}
+}
+
+func TestWindowDeltas(t *testing.T) {
+	// each version links to the previous version's subtrees plus a new one
+	var subtrees []*node
+	var nodes []format.Node
+	var versions []*Manifest
+	for i := 0; i < 3; i++ {
+		sub := newNode(4 * kb)
+		sub.links = []*node{newNode(kb), newNode(kb)}
+		subtrees = append(subtrees, sub)
+		root := newNode(kb)
+		root.links = append([]*node(nil), subtrees...)
+		nodes = append(nodes, root, sub, sub.links[0], sub.links[1])
+
+		v, err := NewManifest(context.Background(), TestNodeGetter{nodes}, root)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		versions = append(versions, v)
+	}
+
+	deltas := WindowDeltas(versions)
+	if len(deltas) != 2 {
+		t.Fatalf("expected 2 deltas, got: %d", len(deltas))
+	}
+	for i, d := range deltas {
+		verifyManifest(t, d)
+		// the new root & its new subtree of 3 nodes
+		added := nodes[4*(i+1) : 4*(i+2)]
+		if len(d.Nodes) != len(added) {
+			t.Errorf("delta %d: expected %d nodes, got: %d", i, len(added), len(d.Nodes))
+		}
+		for _, n := range added {
+			if !d.Contains(n.Cid()) {
+				t.Errorf("delta %d: expected %s", i, n.Cid().String())
+			}
+		}
+		if roots, _ := d.Roots(); len(roots) != 1 || !roots[0].Equals(added[0].Cid()) {
+			t.Errorf("delta %d: expected the new version root as its only root, got: %v", i, roots)
+		}
+	}
+
+	if WindowDeltas(versions[:1]) != nil {
+		t.Error("expected no deltas for a single version")
+	}
+}
+
+func TestIsSubsetOf(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	full, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sub, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0].(*node).links[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !sub.IsSubsetOf(full) || !full.IsSupersetOf(sub) {
+		t.Error("expected subgraph manifest to be a subset of the full manifest")
+	}
+	if full.IsSubsetOf(sub) || sub.IsSupersetOf(full) {
+		t.Error("expected full manifest not to be a subset of the subgraph manifest")
+	}
+	if !full.IsSubsetOf(full) || !(&Manifest{}).IsSubsetOf(sub) {
+		t.Error("expected a manifest & the empty manifest to be subsets")
+	}
+
+	b32, err := g[0].(*node).links[1].Cid().StringOfBase(multibase.Base32)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rebased := &Manifest{Nodes: []string{b32}, Sizes: []uint64{4 * kb}}
+	if !rebased.IsSubsetOf(full) {
+		t.Error("expected cids to match across multibase encodings")
+	}
+}
+
+func TestSafeToDelete(t *testing.T) {
+	shared := newNode(4 * kb)
+	shared.links = []*node{newNode(kb), newNode(kb)}
+	onlyA, onlyB := newNode(2*kb), newNode(3*kb)
+	rootA, rootB := newNode(kb), newNode(kb)
+	rootA.links = []*node{shared, onlyA}
+	rootB.links = []*node{onlyB, shared}
+
+	ng := TestNodeGetter{[]format.Node{rootA, rootB, shared, shared.links[0], shared.links[1], onlyA, onlyB}}
+	a, err := NewManifest(context.Background(), ng, rootA)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), ng, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	freed, err := SafeToDelete([]*Manifest{b}, a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "SafeToDelete", freed, rootA.Cid(), onlyA.Cid())
+
+	freed, err = SafeToDelete(nil, a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(freed) != len(a.Nodes) {
+		t.Errorf("expected every node to be freed when keeping nothing, got: %d", len(freed))
+	}
+	if freed, _ := SafeToDelete([]*Manifest{a, b}, a); len(freed) != 0 {
+		t.Errorf("expected nothing to be freed when keeping the candidate, got: %d", len(freed))
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	shared := newNode(4 * kb)
+	shared.links = []*node{newNode(kb), newNode(kb)}
+	onlyA, onlyB := newNode(2*kb), newNode(3*kb)
+	rootA, rootB := newNode(kb), newNode(kb)
+	rootA.links = []*node{shared, onlyA}
+	rootB.links = []*node{onlyB, shared}
+
+	ng := TestNodeGetter{[]format.Node{rootA, rootB, shared, shared.links[0], shared.links[1], onlyA, onlyB}}
+	a, err := NewManifest(context.Background(), ng, rootA)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), ng, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 3 shared of 7 nodes, 2 shared of 6 links
+	nodes, edges := Similarity(a, b)
+	if math.Abs(nodes-3.0/7) > 0.0001 {
+		t.Errorf("expected node similarity of 3/7, got: %f", nodes)
+	}
+	if math.Abs(edges-2.0/6) > 0.0001 {
+		t.Errorf("expected edge similarity of 2/6, got: %f", edges)
+	}
+
+	if nodes, edges := Similarity(a, a); nodes != 1 || edges != 1 {
+		t.Errorf("expected a manifest to be identical to itself, got: %f, %f", nodes, edges)
+	}
+	if nodes, edges := Similarity(&Manifest{}, &Manifest{}); nodes != 1 || edges != 1 {
+		t.Errorf("expected empty manifests to be identical, got: %f, %f", nodes, edges)
+	}
+}
+
+func TestPinCost(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	old, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the candidate adds a new root & one new leaf to the existing DAG
+	added := newNode(10 * kb)
+	rootB := newNode(2 * kb)
+	rootB.links = []*node{root.links[0], root.links[1], added}
+	other := newNode(kb)
+	existing2 := &Manifest{Nodes: []string{other.Cid().String()}, Sizes: []uint64{kb}}
+
+	candidate, err := NewManifest(context.Background(), TestNodeGetter{append(g, rootB, added)}, rootB)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nodes, bytes, err := PinCost([]*Manifest{old, existing2}, candidate)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "PinCost", nodes, rootB.Cid(), added.Cid())
+	if bytes != 12*kb {
+		t.Errorf("expected 12kb of new bytes, got: %d", bytes)
+	}
+}
+
+func TestSharedAtLeast(t *testing.T) {
+	common, a, b, c := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	manifest := func(nodes ...*node) *Manifest {
+		m := &Manifest{}
+		for _, n := range nodes {
+			m.Nodes = append(m.Nodes, n.Cid().String())
+			m.Sizes = append(m.Sizes, n.size)
+		}
+		return m
+	}
+	ms := []*Manifest{manifest(common, a, b), manifest(common, b), manifest(c, common, common)}
+
+	got, err := SharedAtLeast(3, ms...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "k=3", got, common.Cid())
+
+	got, err = SharedAtLeast(2, ms...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(got) != 2 || got[0].String() > got[1].String() {
+		t.Errorf("expected 2 cids sorted by cid string, got: %v", got)
+	}
+
+	if got, _ := SharedAtLeast(0, ms...); len(got) != 4 {
+		t.Errorf("expected k=0 to list all 4 distinct cids, got: %d", len(got))
+	}
+	if got, _ := SharedAtLeast(4, ms...); len(got) != 0 {
+		t.Errorf("expected k above the manifest count to list nothing, got: %v", got)
+	}
+}
+
+func TestMergeStream(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+	root := g[0].(*node)
+	var ms []*Manifest
+	for _, n := range append([]*node{root}, root.links...) {
+		m, err := NewManifest(context.Background(), ng, n)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		ms = append(ms, m)
+	}
+	// merge subtrees first so the whole DAG overlaps all of them
+	ms = append(ms[1:], ms[0])
+
+	in := make(chan *Manifest)
+	go func() {
+		for _, m := range ms {
+			in <- m
+		}
+		close(in)
+	}()
+	out := &Manifest{Version: CurrentVersion}
+	if err := MergeStream(context.Background(), out, in); err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, out)
+	if expect := Union(ms...); !out.Equal(expect) || len(out.Nodes) != len(expect.Nodes) || len(out.Links) != len(expect.Links) {
+		t.Error("expected streamed merge to equal Union")
+	}
+
+	// merging into a manifest with content keeps it
+	in = make(chan *Manifest, 1)
+	in <- ms[len(ms)-1]
+	close(in)
+	out = ms[0].Copy()
+	if err := MergeStream(context.Background(), out, in); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !out.Equal(Union(ms[0], ms[len(ms)-1])) {
+		t.Error("expected merge into a non-empty manifest to equal Union")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := MergeStream(ctx, &Manifest{}, make(chan *Manifest)); err != context.Canceled {
+		t.Errorf("expected cancelled merge to return context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package manifest
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-ipld-format"
+)
+
+// Options configures manifest generation
+type Options struct {
+	// LinkExtractor overrides how links are read from a node, for node types
+	// that don't surface all of their links through Links(). The default
+	// extractor is just node.Links()
+	LinkExtractor func(format.Node) []*format.Link
+	// LinkClassifier marks links as structural or weak, eg: to keep parent
+	// backpointers out of the tree. Weak links aren't followed, they're
+	// recorded in Manifest.WeakLinks if the node they point to is added through
+	// a structural link. Every link is structural by default
+	LinkClassifier func(from format.Node, l *format.Link) LinkKind
+	// EmbedBlocks stores the raw data of every node in the manifest, making it
+	// a self-contained archive of the DAG. Off by default, this grows the
+	// manifest to at least the total size of the DAG
+	EmbedBlocks bool
+	// Known is a set of cid strings the caller already has, along with their
+	// subgraphs. Known cids are added to the manifest using the size of the
+	// link that points to them, but aren't fetched or descended into
+	Known map[string]bool
+	// Boundaries is a set of cid strings that mark the edge of the DAG, eg:
+	// subgraphs managed elsewhere. Boundary cids are added to the manifest as
+	// leaves using the size of the link that points to them, but aren't fetched
+	// or descended into. Use Manifest.IsBoundary to tell them apart from leaves
+	Boundaries map[string]bool
+	// ExternalRefs is a set of cid strings of content in other networks, that
+	// the node getter can't resolve. External cids are added to the manifest
+	// with a size of 0 without being fetched. Use Manifest.IsExternal to tell
+	// them apart from other nodes
+	ExternalRefs map[string]bool
+	// BestEffort skips linked nodes that can't be fetched instead of failing,
+	// including nodes the node getter returns under the wrong cid. Links to
+	// skipped nodes are dropped
+	BestEffort bool
+	// RecordMissingEdges keeps links to nodes that can't be fetched by adding a
+	// placeholder node with a size of 0, flagged as missing. Use
+	// Manifest.IsMissing to check for placeholders. Implies BestEffort
+	RecordMissingEdges bool
+	// MaxDepth stops descending into nodes this many links away from the root.
+	// Nodes at MaxDepth are recorded as leaves. A node reachable at more than
+	// one depth is expanded according to the depth it's first reached at.
+	// 0 means no limit
+	MaxDepth int
+	// MaxFanoutPerNode caps how many links are followed from any single node.
+	// When a node has more links, only the first MaxFanoutPerNode sorted by cid
+	// string are kept & the rest are counted in Manifest.DroppedLinks.
+	// 0 means no limit
+	MaxFanoutPerNode int
+	// MaxNodesPerLevel caps how many nodes are added at each depth, walking
+	// breadth-first so the nodes nearest the root are kept. Nodes past the cap
+	// aren't fetched & are counted in Manifest.DroppedPerLevel. 0 means no limit
+	MaxNodesPerLevel int
+	// CreatedAt overrides the creation time stamped on the manifest, in unix
+	// seconds. Manifests are stamped with the current time by default
+	CreatedAt int64
+	// OmitCreatedAt leaves CreatedAt at 0, so building the same DAG twice
+	// encodes identically. Fingerprint & Key ignore CreatedAt either way
+	OmitCreatedAt bool
+	// MaxEdges caps the number of links recorded in the manifest. Generation
+	// stops with a ManifestTooLargeError once the limit would be exceeded,
+	// returning the partial manifest built so far. 0 means no limit
+	MaxEdges int
+	// ExcludeZeroSize leaves nodes with a size of 0 out of the manifest. Their
+	// links are still followed, & their parents are linked directly to their
+	// children instead
+	ExcludeZeroSize bool
+	// RecordVisitOrder stores the sequence number each node was discovered at
+	// in Manifest.VisitOrder, which survives reordering nodes
+	RecordVisitOrder bool
+	// SkipLeaves leaves nodes without links out of the manifest, keeping only
+	// the structure of the DAG above them. The number of links from each node
+	// to leaves is counted in Manifest.LeafCounts instead. Raw blocks are known
+	// leaves & aren't fetched, other nodes are fetched to check for links
+	SkipLeaves bool
+	// RecordTimings stores how long fetching each node took in
+	// Manifest.FetchDurations, including any retries
+	RecordTimings bool
+	// NodeFilter is called with every fetched node before it's recorded.
+	// Returning keep false leaves the node out of the manifest, linking its
+	// parents to its children instead. Returning descend false skips the
+	// node's links. Dropping a node & its links omits the whole subtree, unless
+	// parts of it are reached through another node. Returning an error aborts
+	// generating the manifest
+	NodeFilter func(format.Node) (keep bool, descend bool, err error)
+	// SizeCache shares node sizes between manifest builds. Nodes with a cached
+	// size aren't asked for their size, & sizes of other nodes are added to
+	// the cache
+	SizeCache *SizeCache
+	// LeafSizeMode picks how leaf nodes are sized. Interior nodes are always
+	// sized with Size. Sizes in a SizeCache are used whatever mode they were
+	// cached with, so builds sharing a cache should use the same mode
+	LeafSizeMode LeafSizeMode
+	// ApproximateDedup tracks which nodes have been added with a Bloom filter
+	// instead of a map of every cid, saving memory on very large DAGs. Links
+	// to nodes already added are resolved once the walk is done, so a cid key
+	// is still kept for each node linked to more than once. The filter
+	// occasionally reports a node as added when it isn't, at about
+	// DedupFalsePositiveRate, & that node & any part of the DAG only reachable
+	// through it are left out of the manifest. Links are never duplicated or
+	// misdirected, only missed
+	ApproximateDedup bool
+	// DedupFalsePositiveRate is the chance of ApproximateDedup leaving out each
+	// node. Defaults to 0.001
+	DedupFalsePositiveRate float64
+	// Retry retries fetching linked nodes that fail with transient errors. The
+	// zero value tries each fetch once
+	Retry RetryPolicy
+}
+
+// LinkKind classifies a link between two nodes
+type LinkKind int
+
+const (
+	// LinkStructural links are part of the DAG's structure & are followed
+	LinkStructural LinkKind = iota
+	// LinkWeak links are soft references, recorded but not counted as
+	// structure
+	LinkWeak
+)
+
+// LeafSizeMode is how leaf nodes are sized
+type LeafSizeMode int
+
+const (
+	// LeafSizeCumulative sizes leaves with Size, which for unixfs nodes
+	// includes protobuf framing
+	LeafSizeCumulative LeafSizeMode = iota
+	// LeafSizeRawData sizes leaves as the length of their RawData, counting
+	// only content bytes. Nodes must return their real raw data, leaves
+	// without a RawData method fall back to Size
+	LeafSizeRawData
+)
+
+// defaultDedupFalsePositiveRate is the chance of ApproximateDedup leaving out
+// each node when DedupFalsePositiveRate isn't set
+const defaultDedupFalsePositiveRate = 0.001
+
+// RetryPolicy configures retrying failed node fetches
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times to try a fetch, including the
+	// first. 0 & 1 both mean no retries
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling after each one
+	Backoff time.Duration
+	// IsRetryable reports whether an error is worth retrying. If nil every
+	// error is retried. Cancelling the context always stops retrying
+	IsRetryable func(error) bool
+}
+
+// NewManifestWithOpts generates a manifest from an ipld node, configured by opts
+func NewManifestWithOpts(ctx context.Context, ng format.NodeGetter, node format.Node, opts Options) (*Manifest, error) {
+	return newManifest(ctx, ng, node, opts)
+}
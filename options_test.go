@@ -0,0 +1,1015 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// hiddenLinksNode hides its links from Links()
+type hiddenLinksNode struct {
+	*node
+}
+
+func (n hiddenLinksNode) Links() []*format.Link { return nil }
+
+func TestLinkExtractor(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	for i, n := range g {
+		g[i] = hiddenLinksNode{n.(*node)}
+	}
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Nodes) != 1 {
+		t.Errorf("expected default extractor to find 1 node, got: %d", len(mf.Nodes))
+	}
+
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{
+		LinkExtractor: func(n format.Node) []*format.Link {
+			return n.(hiddenLinksNode).node.Links()
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != len(g) {
+		t.Errorf("expected %d nodes, got: %d", len(g), len(mf.Nodes))
+	}
+	if len(mf.Links) != len(g)-1 {
+		t.Errorf("expected %d links, got: %d", len(g)-1, len(mf.Links))
+	}
+}
+
+func TestLinkClassifier(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	// the first leaf points back at its grandparent
+	leaf := root.links[0].links[0]
+	leaf.links = []*node{root}
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{
+		LinkClassifier: func(from format.Node, l *format.Link) LinkKind {
+			if l.Cid.Equals(root.Cid()) {
+				return LinkWeak
+			}
+			return LinkStructural
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Links) != len(g)-1 {
+		t.Errorf("expected %d structural links, got: %d", len(g)-1, len(mf.Links))
+	}
+	expect := [][2]int{{mf.IndexOf(leaf.Cid()), mf.IndexOf(root.Cid())}}
+	if !reflect.DeepEqual(mf.WeakLinks, expect) {
+		t.Errorf("expected back reference in weak links, got: %v", mf.WeakLinks)
+	}
+	if _, err := mf.TopologicalOrder(); err != nil {
+		t.Errorf("expected weak link not to create a cycle, got: %s", err.Error())
+	}
+	if roots, err := mf.Roots(); err != nil || len(roots) != 1 || !roots[0].Equals(root.Cid()) {
+		t.Errorf("expected weak link not to change roots, got: %v", roots)
+	}
+	if err := Verify(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected manifest with weak links to verify, got: %s", err.Error())
+	}
+	if report, err := DriftCheck(context.Background(), ng, mf); err != nil || report.Drifted() {
+		t.Errorf("expected no drift with weak links, got: %+v, %v", report, err)
+	}
+
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded := &Manifest{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(decoded.WeakLinks, expect) {
+		t.Errorf("expected weak links to round trip, got: %v", decoded.WeakLinks)
+	}
+
+	// without a classifier the back reference is a cycle
+	mf, err = NewManifest(context.Background(), ng, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := mf.TopologicalOrder(); err == nil {
+		t.Error("expected back reference to create a cycle")
+	}
+}
+
+// countingNodeGetter records every cid requested from it
+type countingNodeGetter struct {
+	format.NodeGetter
+	fetched map[string]int
+}
+
+func newCountingNodeGetter(ng format.NodeGetter) *countingNodeGetter {
+	return &countingNodeGetter{ng, map[string]int{}}
+}
+
+func (ng *countingNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	ng.fetched[id.String()]++
+	return ng.NodeGetter.Get(ctx, id)
+}
+
+func TestKnown(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	known := g[0].(*node).links[1]
+	ng := newCountingNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{
+		Known: map[string]bool{known.Cid().String(): true},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	// known subtree is 1 + 3 + 12 nodes, of which only the known root is added
+	if expect := len(g) - 15; len(mf.Nodes) != expect {
+		t.Errorf("expected %d nodes, got: %d", expect, len(mf.Nodes))
+	}
+	if idx := mf.IndexOf(known.Cid()); idx < 0 || mf.Sizes[idx] != known.size {
+		t.Error("expected known node to be recorded with its link size")
+	}
+	if ng.fetched[known.Cid().String()] != 0 {
+		t.Error("expected known node not to be fetched")
+	}
+	for _, ch := range known.links {
+		if ng.fetched[ch.Cid().String()] != 0 || mf.Contains(ch.Cid()) {
+			t.Errorf("expected known subtree node %s not to be fetched", ch.Cid().String())
+		}
+	}
+}
+
+func TestBoundaries(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	root := g[0].(*node)
+	a, b := root.links[0].links[0], root.links[1].links[2]
+	ng := newCountingNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{
+		Boundaries: map[string]bool{
+			a.Cid().String(): true,
+			b.Cid().String(): true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	if expect := len(g) - 8; len(mf.Nodes) != expect {
+		t.Errorf("expected %d nodes, got: %d", expect, len(mf.Nodes))
+	}
+	for _, n := range []*node{a, b} {
+		if !mf.IsBoundary(n.Cid()) {
+			t.Errorf("expected %s to be a boundary", n.Cid().String())
+		}
+		if ng.fetched[n.Cid().String()] != 0 {
+			t.Errorf("expected boundary %s not to be fetched", n.Cid().String())
+		}
+		for _, ch := range n.links {
+			if mf.Contains(ch.Cid()) {
+				t.Errorf("expected boundary subtree node %s to be excluded", ch.Cid().String())
+			}
+		}
+	}
+
+	leaf := root.links[0].links[1].links[0]
+	if !mf.Contains(leaf.Cid()) || mf.IsBoundary(leaf.Cid()) {
+		t.Error("expected leaf to be included & not a boundary")
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	gone := root.links[0].links[1]
+	// drop a leaf from the node getter
+	var available []format.Node
+	for _, n := range g {
+		if n != format.Node(gone) {
+			available = append(available, n)
+		}
+	}
+	ng := TestNodeGetter{available}
+
+	if _, err := NewManifestWithOpts(context.Background(), ng, root, Options{}); err == nil {
+		t.Error("expected missing node to error")
+	}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{BestEffort: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if mf.Contains(gone.Cid()) || len(mf.Nodes) != len(g)-1 || len(mf.Links) != len(g)-2 {
+		t.Errorf("expected missing node & its link to be skipped. nodes: %d, links: %d", len(mf.Nodes), len(mf.Links))
+	}
+
+	mf, err = NewManifestWithOpts(context.Background(), ng, root, Options{RecordMissingEdges: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	idx := mf.IndexOf(gone.Cid())
+	if idx < 0 || mf.Sizes[idx] != 0 {
+		t.Fatal("expected missing node to be recorded with a size of 0")
+	}
+	if !mf.IsMissing(gone.Cid()) || mf.IsMissing(root.Cid()) {
+		t.Error("expected only the missing node to be flagged missing")
+	}
+	parent := mf.IndexOf(root.links[0].Cid())
+	if !containsIndex(mf.children()[parent], idx) {
+		t.Error("expected edge to missing node to be recorded")
+	}
+	if err := Verify(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected manifest with placeholders to verify, got: %s", err.Error())
+	}
+}
+
+func TestExternalRefs(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	// the deal isn't in the node getter
+	deal := newNode(mb)
+	root.links = append(root.links, deal)
+	ng := newCountingNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{
+		ExternalRefs: map[string]bool{deal.Cid().String(): true},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	idx := mf.IndexOf(deal.Cid())
+	if idx < 0 || mf.Sizes[idx] != 0 {
+		t.Fatal("expected external node to be recorded with a size of 0")
+	}
+	if !mf.IsExternal(deal.Cid()) || mf.IsExternal(root.Cid()) {
+		t.Error("expected only the external node to be flagged external")
+	}
+	if !containsIndex(mf.children()[mf.IndexOf(root.Cid())], idx) {
+		t.Error("expected link to external node to be recorded")
+	}
+	if ng.fetched[deal.Cid().String()] != 0 {
+		t.Error("expected external node not to be fetched")
+	}
+	if err := Verify(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected manifest with external nodes to verify, got: %s", err.Error())
+	}
+}
+
+func TestMaxDepthAndFanout(t *testing.T) {
+	g := NewGraph([]layer{
+		{8, 4 * kb},
+		{2, 5 * kb},
+		{2, 256 * kb},
+	})
+	root := g[0].(*node)
+
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, Options{MaxFanoutPerNode: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	// 3 of 8 children expanded, each with 2 children of 2 leaves
+	if len(mf.Nodes) != 1+3+3*2+3*2*2 {
+		t.Errorf("expected only 3 root children to be expanded, got %d nodes", len(mf.Nodes))
+	}
+	if mf.DroppedLinks != 5 {
+		t.Errorf("expected 5 dropped links, got: %d", mf.DroppedLinks)
+	}
+	for _, ch := range mf.children() {
+		if len(ch) > 3 {
+			t.Errorf("expected no node to have more than 3 children, got: %d", len(ch))
+		}
+	}
+
+	mf, err = NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, Options{MaxDepth: 2, MaxFanoutPerNode: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != 1+3+3*2 {
+		t.Errorf("expected walk to stop at depth 2, got %d nodes", len(mf.Nodes))
+	}
+	if d := mf.Stats().MaxDepth; d != 2 {
+		t.Errorf("expected max depth of 2, got: %d", d)
+	}
+}
+
+func TestMaxNodesPerLevel(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{10, 256 * kb},
+	})
+	ng := newCountingNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{MaxNodesPerLevel: 5})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	perLevel := map[int]int{}
+	for _, d := range mf.depths() {
+		perLevel[d]++
+	}
+	for d, n := range perLevel {
+		if n > 5 {
+			t.Errorf("expected at most 5 nodes at depth %d, got: %d", d, n)
+		}
+	}
+	if len(mf.Nodes) != 1+3+5 {
+		t.Errorf("expected 9 nodes, got: %d", len(mf.Nodes))
+	}
+	if !reflect.DeepEqual(mf.DroppedPerLevel, []int{0, 0, 25}) {
+		t.Errorf("expected 25 nodes dropped at depth 2, got: %v", mf.DroppedPerLevel)
+	}
+	for id, n := range ng.fetched {
+		if n > 1 {
+			t.Errorf("expected %s to be fetched once, got: %d", id, n)
+		}
+	}
+	if len(ng.fetched) != 3+5 {
+		t.Errorf("expected dropped nodes not to be fetched, got %d fetches", len(ng.fetched))
+	}
+
+	shared := NewSharedGraph([]layer{
+		{4, 4 * kb},
+		{4, 5 * kb},
+	})
+	mf, err = NewManifestWithOpts(context.Background(), TestNodeGetter{shared}, shared[0], Options{MaxNodesPerLevel: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if !reflect.DeepEqual(mf.DroppedPerLevel, []int{0, 2, 2}) {
+		t.Errorf("expected shared nodes to be dropped once, got: %v", mf.DroppedPerLevel)
+	}
+}
+
+func TestMaxEdges(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{4, 4 * kb},
+		{4, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{MaxEdges: 10})
+	tooLarge, ok := err.(ManifestTooLargeError)
+	if !ok {
+		t.Fatalf("expected ManifestTooLargeError, got: %v", err)
+	}
+	if tooLarge.Edges != 11 || tooLarge.MaxEdges != 10 {
+		t.Errorf("unexpected error fields: %+v", tooLarge)
+	}
+	if mf == nil || len(mf.Links) != 10 {
+		t.Fatal("expected partial manifest with 10 links")
+	}
+	verifyManifest(t, mf)
+
+	if _, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{MaxEdges: 36}); err != nil {
+		t.Errorf("expected manifest within the limit to succeed, got: %s", err.Error())
+	}
+}
+
+// wrongCidNodeGetter returns the node stored under a different cid when asked
+// for a swapped cid
+type wrongCidNodeGetter struct {
+	TestNodeGetter
+	swap map[string]format.Node
+}
+
+func (ng wrongCidNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	if n, ok := ng.swap[id.String()]; ok {
+		return n, nil
+	}
+	return ng.TestNodeGetter.Get(ctx, id)
+}
+
+func TestCIDMismatch(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+	})
+	root := g[0].(*node)
+	requested, returned := root.links[0], newNode(kb)
+	ng := wrongCidNodeGetter{TestNodeGetter{g}, map[string]format.Node{requested.Cid().String(): returned}}
+
+	_, err := NewManifest(context.Background(), ng, root)
+	mismatch, ok := err.(CIDMismatchError)
+	if !ok {
+		t.Fatalf("expected CIDMismatchError, got: %v", err)
+	}
+	if !mismatch.Requested.Equals(requested.Cid()) || !mismatch.Returned.Equals(returned.Cid()) {
+		t.Errorf("unexpected error fields: %s", mismatch.Error())
+	}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{RecordMissingEdges: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.Contains(returned.Cid()) {
+		t.Error("expected mismatched node to not be recorded")
+	}
+	if !mf.IsMissing(requested.Cid()) {
+		t.Error("expected requested cid to be recorded as missing")
+	}
+}
+
+func TestExcludeZeroSize(t *testing.T) {
+	// root -> marker -> marker -> leaf, root -> marker -> leaf
+	root, leafA, leafB := newNode(kb), newNode(2*kb), newNode(3*kb)
+	outer, inner, side := newNode(0), newNode(0), newNode(0)
+	root.links = []*node{outer, side}
+	outer.links = []*node{inner}
+	inner.links = []*node{leafA}
+	side.links = []*node{leafB, leafA}
+
+	ng := TestNodeGetter{[]format.Node{root, outer, inner, side, leafA, leafB}}
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{ExcludeZeroSize: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	for _, n := range []*node{outer, inner, side} {
+		if mf.Contains(n.Cid()) {
+			t.Errorf("expected zero size node %s to be excluded", n.Cid().String())
+		}
+	}
+	if len(mf.Nodes) != 3 {
+		t.Errorf("expected 3 nodes, got: %d", len(mf.Nodes))
+	}
+	if len(mf.Links) != 2 {
+		t.Errorf("expected 2 links, got: %d", len(mf.Links))
+	}
+	ch := mf.children()[mf.IndexOf(root.Cid())]
+	for _, n := range []*node{leafA, leafB} {
+		if !containsIndex(ch, mf.IndexOf(n.Cid())) {
+			t.Errorf("expected root to link directly to %s", n.Cid().String())
+		}
+	}
+}
+
+// storedSizeNodeGetter reports stored sizes at half the logical size
+type storedSizeNodeGetter struct {
+	TestNodeGetter
+}
+
+func (ng storedSizeNodeGetter) StoredSize(ctx context.Context, id *cid.Cid) (uint64, error) {
+	n, err := ng.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	size, err := n.Size()
+	return size / 2, err
+}
+
+func TestStoredSizes(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	logical := uint64(2*kb + 2*4*kb + 6*256*kb)
+
+	mf, err := NewManifest(context.Background(), storedSizeNodeGetter{TestNodeGetter{g}}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.StoredSizes) != len(mf.Nodes) {
+		t.Fatalf("expected stored sizes aligned with nodes, got %d for %d nodes", len(mf.StoredSizes), len(mf.Nodes))
+	}
+	if total := mf.TotalSize(); total != logical {
+		t.Errorf("expected total size of %d, got: %d", logical, total)
+	}
+	if total := mf.TotalStoredSize(); total != logical/2 {
+		t.Errorf("expected total stored size of %d, got: %d", logical/2, total)
+	}
+
+	mf, err = NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.StoredSizes != nil || mf.TotalStoredSize() != 0 {
+		t.Error("expected no stored sizes without a StoredSizer")
+	}
+}
+
+func TestRecordVisitOrder(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{RecordVisitOrder: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Canonicalize()
+
+	if len(mf.VisitOrder) != len(mf.Nodes) {
+		t.Fatalf("expected visit order aligned with nodes, got %d for %d nodes", len(mf.VisitOrder), len(mf.Nodes))
+	}
+	seen := make([]bool, len(mf.Nodes))
+	for _, v := range mf.VisitOrder {
+		if v < 0 || v >= len(seen) || seen[v] {
+			t.Fatalf("expected visit order to be a permutation, got: %v", mf.VisitOrder)
+		}
+		seen[v] = true
+	}
+	if v := mf.VisitOrder[mf.IndexOf(g[0].Cid())]; v != 0 {
+		t.Errorf("expected root to be visited first, got: %d", v)
+	}
+
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(got.VisitOrder, mf.VisitOrder) {
+		t.Error("expected visit order to survive encoding")
+	}
+}
+
+func TestNodeFilter(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{2, 7 * kb},
+		{2, 256 * kb},
+	})
+	root := g[0].(*node)
+	// one subtree of 7kb nodes uses a different size so it's kept
+	survivor := root.links[0].links[0]
+	survivor.size = 8 * kb
+
+	skip := func(n format.Node) (bool, bool, error) {
+		size, _ := n.Size()
+		return size != 7*kb, size != 7*kb, nil
+	}
+	mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, Options{NodeFilter: skip})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	// root, 3 children, survivor & its 2 leaves
+	if len(mf.Nodes) != 7 {
+		t.Errorf("expected 7 nodes, got: %d", len(mf.Nodes))
+	}
+	expect := append([]*node{root, survivor}, root.links...)
+	expect = append(expect, survivor.links...)
+	for _, n := range expect {
+		if !mf.Contains(n.Cid()) {
+			t.Errorf("expected manifest to contain %s", n.Cid().String())
+		}
+	}
+
+	// keeping a node without descending records it as a leaf, dropping it while
+	// descending links its parent to its children
+	flatten := func(n format.Node) (bool, bool, error) {
+		size, _ := n.Size()
+		return size != 4*kb, size != 7*kb, nil
+	}
+	mf, err = NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, Options{NodeFilter: flatten})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ch := mf.children()
+	if got := len(ch[mf.IndexOf(root.Cid())]); got != 6 {
+		t.Errorf("expected root to link to 6 grandchildren, got: %d", got)
+	}
+	if got := len(ch[mf.IndexOf(root.links[1].links[0].Cid())]); got != 0 {
+		t.Errorf("expected non-descended node to be a leaf, got %d children", got)
+	}
+
+	abort := func(format.Node) (bool, bool, error) {
+		return false, false, fmt.Errorf("nope")
+	}
+	if _, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, Options{NodeFilter: abort}); err == nil {
+		t.Error("expected filter error to abort")
+	}
+}
+
+// flakyNodeGetter fails to fetch one cid a number of times before succeeding
+type flakyNodeGetter struct {
+	format.NodeGetter
+	flaky    *cid.Cid
+	failures int
+	calls    int
+	onFail   func()
+}
+
+func (ng *flakyNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	if id.Equals(ng.flaky) {
+		ng.calls++
+		if ng.calls <= ng.failures {
+			if ng.onFail != nil {
+				ng.onFail()
+			}
+			return nil, fmt.Errorf("transient error fetching %s", id.String())
+		}
+	}
+	return ng.NodeGetter.Get(ctx, id)
+}
+
+func TestRetry(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	flaky := g[0].(*node).links[1].Cid()
+
+	ng := &flakyNodeGetter{NodeGetter: TestNodeGetter{g}, flaky: flaky, failures: 2}
+	if _, err := NewManifest(context.Background(), ng, g[0]); err == nil {
+		t.Error("expected failed fetch to error without retries")
+	}
+
+	ng = &flakyNodeGetter{NodeGetter: TestNodeGetter{g}, flaky: flaky, failures: 2}
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != len(g) || ng.calls != 3 {
+		t.Errorf("expected build to complete after 3 attempts. nodes: %d, attempts: %d", len(mf.Nodes), ng.calls)
+	}
+
+	ng = &flakyNodeGetter{NodeGetter: TestNodeGetter{g}, flaky: flaky, failures: 2}
+	notRetryable := RetryPolicy{MaxAttempts: 3, IsRetryable: func(error) bool { return false }}
+	if _, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{Retry: notRetryable}); err == nil || ng.calls != 1 {
+		t.Errorf("expected unretryable error to fail after 1 attempt, got: %v after %d", err, ng.calls)
+	}
+
+	// cancelling stops waiting for the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	ng = &flakyNodeGetter{NodeGetter: TestNodeGetter{g}, flaky: flaky, failures: 10, onFail: cancel}
+	start := time.Now()
+	_, err = NewManifestWithOpts(ctx, ng, g[0], Options{Retry: RetryPolicy{MaxAttempts: 10, Backoff: time.Hour}})
+	if err == nil || time.Since(start) > time.Minute || ng.calls != 1 {
+		t.Errorf("expected cancellation to stop retrying, got: %v after %d attempts", err, ng.calls)
+	}
+}
+
+func TestApproximateDedup(t *testing.T) {
+	for _, g := range [][]format.Node{
+		NewGraph([]layer{
+			{10, 4 * kb},
+			{10, 8 * kb},
+			{10, 16 * kb},
+		}),
+		NewSharedGraph([]layer{
+			{30, 4 * kb},
+			{30, 8 * kb},
+			{30, 16 * kb},
+		}),
+	} {
+		ng := TestNodeGetter{g}
+		exact, err := NewManifest(context.Background(), ng, g[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		approx, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{ApproximateDedup: true})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		verifyManifest(t, approx)
+		if !approx.Equal(exact) {
+			t.Errorf("expected approximate manifest to match exact manifest, got %d nodes & %d links, expected %d nodes & %d links",
+				len(approx.Nodes), len(approx.Links), len(exact.Nodes), len(exact.Links))
+		}
+
+		// false positives leave nodes out but never add bad links
+		lossy, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{ApproximateDedup: true, DedupFalsePositiveRate: 0.5})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		verifyManifest(t, lossy)
+		links := map[[2]string]bool{}
+		for _, l := range exact.Links {
+			links[[2]string{exact.Nodes[l[0]], exact.Nodes[l[1]]}] = true
+		}
+		for _, l := range lossy.Links {
+			if !links[[2]string{lossy.Nodes[l[0]], lossy.Nodes[l[1]]}] {
+				t.Errorf("expected only links in the exact manifest, got: %v", l)
+			}
+		}
+	}
+}
+
+func TestApproximateDedupMemory(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{20, 4 * kb},
+		{20, 8 * kb},
+	})
+	ms := newMstate(context.Background(), TestNodeGetter{g}, Options{ApproximateDedup: true})
+	if _, err := ms.addNode(g[0], ms.linksOf(g[0]), 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// every layer 2 node is linked to 20 times but only its first link is
+	// added straight away, the rest are deferred under one key per node
+	if len(ms.cids) != 0 {
+		t.Errorf("expected no cids to be kept, got: %d", len(ms.cids))
+	}
+	if len(ms.deferred) != 20 {
+		t.Errorf("expected 20 deferred keys, got: %d", len(ms.deferred))
+	}
+	deferred := 0
+	for _, pos := range ms.deferred {
+		deferred += len(pos)
+	}
+	if deferred != 20*19 {
+		t.Errorf("expected %d deferred links, got: %d", 20*19, deferred)
+	}
+
+	ms.resolveDeferred()
+	if len(ms.deferred) != 0 || len(ms.cids) != 0 {
+		t.Errorf("expected resolving to keep no keys, got %d deferred & %d cids", len(ms.deferred), len(ms.cids))
+	}
+	verifyManifest(t, ms.m)
+}
+
+// delayingNodeGetter sleeps before fetching some cids, by cid string
+type delayingNodeGetter struct {
+	format.NodeGetter
+	delays map[string]time.Duration
+}
+
+func (ng delayingNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	time.Sleep(ng.delays[id.String()])
+	return ng.NodeGetter.Get(ctx, id)
+}
+
+func TestRecordTimings(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	slow := g[0].(*node).links[1].Cid()
+	ng := delayingNodeGetter{TestNodeGetter{g}, map[string]time.Duration{slow.String(): 20 * time.Millisecond}}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{RecordTimings: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.FetchDurations) != len(mf.Nodes) {
+		t.Fatalf("expected fetch durations aligned with nodes, got %d for %d nodes", len(mf.FetchDurations), len(mf.Nodes))
+	}
+	if d := mf.FetchDurations[mf.IndexOf(g[0].Cid())]; d != 0 {
+		t.Errorf("expected root not to be timed, got: %s", d)
+	}
+	if d := mf.FetchDurations[mf.IndexOf(slow)]; d < 20*time.Millisecond {
+		t.Errorf("expected slow node to take at least 20ms, got: %s", d)
+	}
+
+	mf.Canonicalize()
+	if d := mf.FetchDurations[mf.IndexOf(slow)]; d < 20*time.Millisecond {
+		t.Errorf("expected durations to follow reordered nodes, got: %s", d)
+	}
+	data, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(got.FetchDurations, mf.FetchDurations) {
+		t.Error("expected fetch durations to survive encoding")
+	}
+	if size := mf.EstimatedCBORSize(); size != len(data) {
+		t.Errorf("expected estimated size %d to match encoded size %d", size, len(data))
+	}
+
+	mf, err = NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.FetchDurations != nil {
+		t.Error("expected no fetch durations without RecordTimings")
+	}
+	if ms := newMstate(context.Background(), ng, Options{}); ms.durations != nil {
+		t.Error("expected no durations map without RecordTimings")
+	}
+
+	// nodes prefetched while admitting levels are timed too
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{RecordTimings: true, MaxNodesPerLevel: 10})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if d := mf.FetchDurations[mf.IndexOf(slow)]; d < 20*time.Millisecond {
+		t.Errorf("expected prefetched slow node to take at least 20ms, got: %s", d)
+	}
+
+	// durations of nodes left out aren't kept
+	skip := func(n format.Node) (bool, bool, error) {
+		size, _ := n.Size()
+		return size != 256*kb, size != 256*kb, nil
+	}
+	for _, opts := range []Options{
+		{RecordTimings: true, NodeFilter: skip},
+		{RecordTimings: true, NodeFilter: skip, MaxNodesPerLevel: 10},
+		{RecordTimings: true, SkipLeaves: true},
+	} {
+		ms := newMstate(context.Background(), ng, opts)
+		if _, err := ms.build(g[0]); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(ms.durations) != 0 {
+			t.Errorf("expected no durations left for dropped nodes, got: %d", len(ms.durations))
+		}
+	}
+}
+
+func TestLeafSizeMode(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	for _, mode := range []LeafSizeMode{LeafSizeCumulative, LeafSizeRawData} {
+		mf, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, g[0], Options{LeafSizeMode: mode})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		verifyManifest(t, mf)
+		for _, gn := range g {
+			n := gn.(*node)
+			expect := n.size
+			if mode == LeafSizeRawData && len(n.links) == 0 {
+				expect = uint64(len(n.data))
+			}
+			if expect == n.size && len(n.links) == 0 && mode == LeafSizeRawData {
+				t.Fatal("expected test leaves to have raw data shorter than their size")
+			}
+			if size := mf.Sizes[mf.IndexOf(n.Cid())]; size != expect {
+				t.Errorf("mode %d: expected %s to be sized %d, got: %d", mode, n.Cid().String(), expect, size)
+			}
+		}
+	}
+}
+
+func TestSkipLeaves(t *testing.T) {
+	// a file DAG: dag-pb interior nodes over raw leaf chunks, & one dag-pb leaf
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{4, 256 * kb},
+	})
+	for _, gn := range g {
+		if n := gn.(*node); len(n.links) > 0 {
+			n.cid = cid.NewCidV1(cid.DagProtobuf, n.cid.Hash())
+		}
+	}
+	pbLeaf := newNode(kb)
+	pbLeaf.cid = cid.NewCidV1(cid.DagProtobuf, pbLeaf.cid.Hash())
+	root := g[0].(*node)
+	root.links = append(root.links, pbLeaf)
+	g = append(g, pbLeaf)
+	ng := newCountingNodeGetter(TestNodeGetter{g})
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{SkipLeaves: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != 1+3 {
+		t.Errorf("expected only interior nodes, got %d nodes", len(mf.Nodes))
+	}
+	if len(mf.LeafCounts) != len(mf.Nodes) {
+		t.Fatalf("expected leaf counts aligned with nodes, got %d for %d nodes", len(mf.LeafCounts), len(mf.Nodes))
+	}
+	for _, gn := range g {
+		n := gn.(*node)
+		if len(n.links) > 0 {
+			continue
+		}
+		if mf.IndexOf(n.Cid()) >= 0 {
+			t.Errorf("expected leaf %s to be left out", n.Cid().String())
+		}
+		if n.Cid().Type() == cid.Raw && ng.fetched[n.Cid().String()] > 0 {
+			t.Errorf("expected raw leaf %s not to be fetched", n.Cid().String())
+		}
+	}
+	if c := mf.LeafChildCount(root.Cid()); c != 1 {
+		t.Errorf("expected root to have 1 leaf child, got: %d", c)
+	}
+	for _, ch := range root.links[:3] {
+		if c := mf.LeafChildCount(ch.Cid()); c != 4 {
+			t.Errorf("expected %s to have 4 leaf children, got: %d", ch.Cid().String(), c)
+		}
+	}
+
+	full, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if full.LeafCounts != nil || full.LeafChildCount(root.Cid()) != 0 {
+		t.Error("expected no leaf counts without SkipLeaves")
+	}
+
+	// skipped leaves aren't edges
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{SkipLeaves: true, MaxEdges: 3})
+	if err != nil {
+		t.Fatalf("expected skipped leaves not to count toward MaxEdges, got: %s", err.Error())
+	}
+	if len(mf.Links) != 3 {
+		t.Errorf("expected 3 links, got: %d", len(mf.Links))
+	}
+
+	// leaves under nodes the filter removes move up to the root
+	flatten := func(n format.Node) (bool, bool, error) {
+		size, _ := n.Size()
+		return size != 4*kb, true, nil
+	}
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{SkipLeaves: true, NodeFilter: flatten})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Nodes) != 1 {
+		t.Errorf("expected only the root, got %d nodes", len(mf.Nodes))
+	}
+	if c := mf.LeafChildCount(root.Cid()); c != 1+3*4 {
+		t.Errorf("expected root to have %d leaf children, got: %d", 1+3*4, c)
+	}
+}
+
+func TestClassifyOnce(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	leaf := root.links[0].links[0]
+	leaf.links = []*node{root}
+
+	for i, opts := range []Options{
+		{MaxNodesPerLevel: 10},
+		{SkipLeaves: true},
+		{LeafSizeMode: LeafSizeRawData},
+	} {
+		extracted := map[string]int{}
+		classified := map[[2]string]int{}
+		opts.LinkExtractor = func(n format.Node) []*format.Link {
+			extracted[n.Cid().String()]++
+			return n.Links()
+		}
+		opts.LinkClassifier = func(from format.Node, l *format.Link) LinkKind {
+			classified[[2]string{from.Cid().String(), l.Cid.String()}]++
+			if l.Cid.Equals(root.Cid()) {
+				return LinkWeak
+			}
+			return LinkStructural
+		}
+		if _, err := NewManifestWithOpts(context.Background(), TestNodeGetter{g}, root, opts); err != nil {
+			t.Fatal(err.Error())
+		}
+		for id, n := range extracted {
+			if n != 1 {
+				t.Errorf("options %d: expected links of %s to be extracted once, got: %d", i, id, n)
+			}
+		}
+		for l, n := range classified {
+			if n != 1 {
+				t.Errorf("options %d: expected link %v to be classified once, got: %d", i, l, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// TopologicalOrder lists manifest cids such that every node comes before all
+// of the nodes it links to. TopologicalOrder errors if the manifest has a cycle
+func (m *Manifest) TopologicalOrder() ([]*cid.Cid, error) {
+	order, err := m.topoIndexes()
+	if err != nil {
+		return nil, err
+	}
+	return m.cidsAt(order)
+}
+
+// topoIndexes sorts node indexes topologically, breaking ties by index position
+func (m *Manifest) topoIndexes() ([]int, error) {
+	inDeg := make([]int, len(m.Nodes))
+	for _, l := range m.Links {
+		inDeg[l[1]]++
+	}
+
+	ch := m.children()
+	queue := m.roots()
+	order := make([]int, 0, len(m.Nodes))
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		order = append(order, idx)
+		for _, c := range ch[idx] {
+			inDeg[c]--
+			if inDeg[c] == 0 {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	if len(order) != len(m.Nodes) {
+		return nil, fmt.Errorf("manifest contains a cycle")
+	}
+	return order, nil
+}
+
+// cidsAt parses the cids at a list of index positions
+func (m *Manifest) cidsAt(idxs []int) ([]*cid.Cid, error) {
+	ids := make([]*cid.Cid, len(idxs))
+	for i, idx := range idxs {
+		id, err := cid.Decode(m.Nodes[idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", idx, err.Error())
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// CumulativeSizes gives a running total of bytes after fetching each cid in
+// order. A cid listed more than once is counted each time it appears
+func (m *Manifest) CumulativeSizes(order []*cid.Cid) ([]uint64, error) {
+	idx := m.index()
+	sums := make([]uint64, len(order))
+	total := uint64(0)
+	for i, id := range order {
+		j, ok := idx[id.KeyString()]
+		if !ok {
+			return nil, fmt.Errorf("cid not in manifest: %s", id.String())
+		}
+		total += m.Sizes[j]
+		sums[i] = total
+	}
+	return sums, nil
+}
+
+// FetchDirection selects which way dependencies point in a fetch graph
+type FetchDirection int
+
+const (
+	// ChildrenFirst makes every node depend on its children, for models where
+	// a parent can't be reconstructed until all children are present
+	ChildrenFirst FetchDirection = iota
+	// ParentsFirst makes every node depend on its parents, for models where a
+	// child can't be requested until a parent is fetched
+	ParentsFirst
+)
+
+// FetchTask is a single node to fetch in a fetch graph
+type FetchTask struct {
+	Cid  *cid.Cid
+	Size uint64
+	// DependsOn lists the task indexes that must complete before this task
+	DependsOn []int
+}
+
+// FetchGraph builds a dependency graph of fetch tasks for a DAG scheduler. Task
+// indexes match manifest node indexes
+func (m *Manifest) FetchGraph(dir FetchDirection) ([]FetchTask, error) {
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]FetchTask, len(m.Nodes))
+	for i, id := range ids {
+		tasks[i] = FetchTask{Cid: id, Size: m.Sizes[i]}
+	}
+	deps := map[[2]int]bool{}
+	for _, l := range m.Links {
+		from, to := l[0], l[1]
+		if dir == ParentsFirst {
+			from, to = to, from
+		}
+		if !deps[[2]int{from, to}] {
+			deps[[2]int{from, to}] = true
+			tasks[from].DependsOn = append(tasks[from].DependsOn, to)
+		}
+	}
+	return tasks, nil
+}
+
+// NodesBySize lists manifest cids ordered by size, breaking ties by cid string
+func (m *Manifest) NodesBySize(descending bool) ([]*cid.Cid, error) {
+	idxs := allIndexes(len(m.Nodes))
+	sort.SliceStable(idxs, func(i, j int) bool {
+		a, b := idxs[i], idxs[j]
+		if m.Sizes[a] != m.Sizes[b] {
+			return (m.Sizes[a] > m.Sizes[b]) == descending
+		}
+		return m.Nodes[a] < m.Nodes[b]
+	})
+	return m.cidsAt(idxs)
+}
+
+// StorageOrder lists each distinct manifest cid once, sorted by binary cid
+// bytes. Blockstores commonly keep blocks in key order, so fetching in storage
+// order reads blocks sequentially rather than seeking. Unlike TopologicalOrder
+// it ignores links entirely
+func (m *Manifest) StorageOrder() ([]*cid.Cid, error) {
+	ids, err := m.CIDs()
+	if err != nil {
+		return nil, err
+	}
+	idx := m.index()
+	res := ids[:0]
+	for i, id := range ids {
+		if idx[id.KeyString()] == i {
+			res = append(res, id)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Bytes(), res[j].Bytes()) < 0
+	})
+	return res, nil
+}
+
+// CriticalPath returns the longest path from a root to a leaf by node count,
+// the number of fetches that must happen one after another to get the whole
+// DAG. Ties are broken by index position. CriticalPath errors if the manifest
+// has a cycle
+func (m *Manifest) CriticalPath() ([]*cid.Cid, error) {
+	return m.longestPath(func(int) uint64 { return 1 })
+}
+
+// CriticalPathBySize returns the root to leaf path with the greatest summed
+// size. CriticalPathBySize errors if the manifest has a cycle
+func (m *Manifest) CriticalPathBySize() ([]*cid.Cid, error) {
+	return m.longestPath(func(idx int) uint64 { return m.Sizes[idx] })
+}
+
+// longestPath finds the heaviest root to leaf path, weighing each node with
+// weight
+func (m *Manifest) longestPath(weight func(int) uint64) ([]*cid.Cid, error) {
+	path, err := m.longestPathIndexes(weight)
+	if err != nil {
+		return nil, err
+	}
+	return m.cidsAt(path)
+}
+
+// longestPathIndexes is longestPath as index positions
+func (m *Manifest) longestPathIndexes(weight func(int) uint64) ([]int, error) {
+	if len(m.Nodes) == 0 {
+		return nil, nil
+	}
+	order, err := m.topoIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := m.children()
+	best := make([]uint64, len(m.Nodes))
+	next := make([]int, len(m.Nodes))
+	// children come after parents in topological order, walk it backwards
+	for i := len(order) - 1; i >= 0; i-- {
+		idx := order[i]
+		next[idx] = -1
+		for _, c := range ch[idx] {
+			if next[idx] < 0 || best[c] > best[next[idx]] {
+				next[idx] = c
+			}
+		}
+		best[idx] = weight(idx)
+		if next[idx] >= 0 {
+			best[idx] += best[next[idx]]
+		}
+	}
+
+	start := 0
+	for idx := range best {
+		if best[idx] > best[start] {
+			start = idx
+		}
+	}
+	var path []int
+	for idx := start; idx >= 0; idx = next[idx] {
+		path = append(path, idx)
+	}
+	return path, nil
+}
+
+// EstimatedTransferTime estimates how long fetching the remaining nodes takes
+// at bytesPerSec, with up to parallelism fetches at once. remaining is a set of
+// cid strings, nil means every node. Bytes are spread evenly over parallel
+// fetches, but never faster than the path of remaining bytes from a root that
+// has to be fetched one node after another. The critical path is ignored if
+// the manifest has a cycle. EstimatedTransferTime is 0 if bytesPerSec isn't
+// positive
+func (m *Manifest) EstimatedTransferTime(remaining map[string]bool, bytesPerSec float64, parallelism int) time.Duration {
+	if bytesPerSec <= 0 {
+		return 0
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	weight := func(idx int) uint64 {
+		if remaining == nil || remaining[m.Nodes[idx]] {
+			return m.Sizes[idx]
+		}
+		return 0
+	}
+
+	var total float64
+	for i := range m.Nodes {
+		total += float64(weight(i))
+	}
+	bytes := total / float64(parallelism)
+	if path, err := m.longestPathIndexes(weight); err == nil {
+		var critical float64
+		for _, idx := range path {
+			critical += float64(weight(idx))
+		}
+		bytes = math.Max(bytes, critical)
+	}
+	return time.Duration(bytes / bytesPerSec * float64(time.Second))
+}
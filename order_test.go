@@ -0,0 +1,285 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestTopologicalOrder(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	order, err := mf.TopologicalOrder()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(order) != len(mf.Nodes) {
+		t.Fatalf("expected %d cids, got: %d", len(mf.Nodes), len(order))
+	}
+	pos := map[string]int{}
+	for i, id := range order {
+		pos[id.String()] = i
+	}
+	for _, l := range mf.Links {
+		if pos[mf.Nodes[l[0]]] >= pos[mf.Nodes[l[1]]] {
+			t.Errorf("expected %s to come before %s", mf.Nodes[l[0]], mf.Nodes[l[1]])
+		}
+	}
+
+	mf.Links = append(mf.Links, [2]int{mf.Links[0][1], mf.Links[0][0]})
+	if _, err := mf.TopologicalOrder(); err == nil {
+		t.Error("expected cycle to error")
+	}
+}
+
+func TestCumulativeSizes(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	order, err := mf.TopologicalOrder()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sums, err := mf.CumulativeSizes(order)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sums) != len(order) {
+		t.Fatalf("expected %d sums, got: %d", len(order), len(sums))
+	}
+	if sums[len(sums)-1] != mf.TotalSize() {
+		t.Errorf("expected final cumulative size to equal total size. %d != %d", sums[len(sums)-1], mf.TotalSize())
+	}
+
+	sums, err = mf.CumulativeSizes([]*cid.Cid{g[0].Cid(), g[0].Cid()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sums[1] != 2*mf.Sizes[0] {
+		t.Errorf("expected duplicate cids to be counted twice, got: %v", sums)
+	}
+
+	if _, err := mf.CumulativeSizes([]*cid.Cid{newNode(kb).Cid()}); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestFetchGraph(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tasks, err := mf.FetchGraph(ChildrenFirst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks) != len(mf.Nodes) {
+		t.Fatalf("expected %d tasks, got: %d", len(mf.Nodes), len(tasks))
+	}
+	for _, n := range g {
+		task := tasks[mf.IndexOf(n.Cid())]
+		if !task.Cid.Equals(n.Cid()) {
+			t.Errorf("task cid mismatch. expected: %s, got: %s", n.Cid().String(), task.Cid.String())
+		}
+		children := n.(*node).links
+		if len(task.DependsOn) != len(children) {
+			t.Errorf("expected %s to depend on %d children, got: %d", n.Cid().String(), len(children), len(task.DependsOn))
+			continue
+		}
+		for i, ch := range children {
+			if task.DependsOn[i] != mf.IndexOf(ch.Cid()) {
+				t.Errorf("expected %s to depend on child %s", n.Cid().String(), ch.Cid().String())
+			}
+		}
+	}
+
+	tasks, err = mf.FetchGraph(ParentsFirst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tasks[0].DependsOn) != 0 {
+		t.Error("expected root to have no dependencies fetching parents first")
+	}
+	leaf := mf.IndexOf(g[len(g)-1].Cid())
+	if deps := tasks[leaf].DependsOn; len(deps) != 1 || deps[0] != mf.IndexOf(g[0].(*node).links[1].Cid()) {
+		t.Errorf("expected leaf to depend on its parent, got: %v", deps)
+	}
+
+	// duplicate links give one dependency
+	root := mf.IndexOf(g[0].Cid())
+	mf.Links = append(mf.Links, [2]int{root, leaf}, [2]int{root, leaf}, [2]int{root, leaf})
+	tasks, err = mf.FetchGraph(ChildrenFirst)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if deps := tasks[root].DependsOn; len(deps) != len(g[0].(*node).links)+1 {
+		t.Errorf("expected duplicate links to be deduplicated, got: %v", deps)
+	}
+}
+
+func TestNodesBySize(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	largest := newNode(512 * kb)
+	root := g[0].(*node)
+	root.links = append(root.links, largest)
+	g = append(g, largest)
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	desc, err := mf.NodesBySize(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(desc) != len(mf.Nodes) {
+		t.Fatalf("expected %d cids, got: %d", len(mf.Nodes), len(desc))
+	}
+	if !desc[0].Equals(largest.Cid()) {
+		t.Errorf("expected largest node first, got: %s", desc[0])
+	}
+
+	asc, err := mf.NodesBySize(false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	idx := mf.index()
+	for i := 1; i < len(asc); i++ {
+		prev, cur := mf.Sizes[idx[asc[i-1].KeyString()]], mf.Sizes[idx[asc[i].KeyString()]]
+		if prev > cur || (prev == cur && asc[i-1].String() > asc[i].String()) {
+			t.Errorf("cids out of order at %d", i)
+		}
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	// root -> a -> b -> c is the deepest branch, root -> big is the heaviest
+	root, a, b, c, big := newNode(kb), newNode(kb), newNode(kb), newNode(kb), newNode(mb)
+	root.links = []*node{big, a}
+	a.links = []*node{b, newNode(kb)}
+	b.links = []*node{c}
+
+	ng := TestNodeGetter{[]format.Node{root, a, b, c, big, a.links[1]}}
+	mf, err := NewManifest(context.Background(), ng, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	path, err := mf.CriticalPath()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "CriticalPath", path, root.Cid(), a.Cid(), b.Cid(), c.Cid())
+
+	path, err = mf.CriticalPathBySize()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "CriticalPathBySize", path, root.Cid(), big.Cid())
+}
+
+func TestEstimatedTransferTime(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// sequential fetches take the sum of sizes, parallel ones the critical path
+	if est := mf.EstimatedTransferTime(nil, kb, 1); est != 1546*time.Second {
+		t.Errorf("expected 1546s at parallelism 1, got: %s", est)
+	}
+	if est := mf.EstimatedTransferTime(nil, kb, 100); est != 262*time.Second {
+		t.Errorf("expected critical path bound of 262s at parallelism 100, got: %s", est)
+	}
+	if est := mf.EstimatedTransferTime(nil, kb, 4); est != 386500*time.Millisecond {
+		t.Errorf("expected 386.5s at parallelism 4, got: %s", est)
+	}
+
+	remaining := map[string]bool{}
+	for _, l := range g[0].(*node).links[0].links {
+		remaining[l.Cid().String()] = true
+	}
+	if est := mf.EstimatedTransferTime(remaining, kb, 1); est != 768*time.Second {
+		t.Errorf("expected 768s for 3 remaining leaves, got: %s", est)
+	}
+	if est := mf.EstimatedTransferTime(remaining, kb, 100); est != 256*time.Second {
+		t.Errorf("expected 256s for 3 remaining leaves in parallel, got: %s", est)
+	}
+	if est := mf.EstimatedTransferTime(nil, 0, 1); est != 0 {
+		t.Errorf("expected no estimate without bandwidth, got: %s", est)
+	}
+}
+
+func TestStorageOrder(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{3, 4 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a duplicate entry is still only listed once
+	mf.Nodes = append(mf.Nodes, mf.Nodes[2])
+	mf.Sizes = append(mf.Sizes, mf.Sizes[2])
+
+	order, err := mf.StorageOrder()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(order) != len(mf.Nodes)-1 {
+		t.Fatalf("expected %d cids, got: %d", len(mf.Nodes)-1, len(order))
+	}
+	seen := map[string]bool{}
+	for i, id := range order {
+		if seen[id.KeyString()] {
+			t.Errorf("expected %s to be listed once", id)
+		}
+		seen[id.KeyString()] = true
+		if i > 0 && bytes.Compare(order[i-1].Bytes(), id.Bytes()) >= 0 {
+			t.Errorf("expected cids sorted by bytes at position %d", i)
+		}
+	}
+	for _, str := range mf.Nodes {
+		id, _ := cid.Decode(str)
+		if !seen[id.KeyString()] {
+			t.Errorf("expected %s in storage order", str)
+		}
+	}
+}
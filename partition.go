@@ -0,0 +1,367 @@
+package manifest
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Partition splits the manifest into at most n sub-manifests of roughly equal
+// total size, for dividing fetching among workers. Each part is made of whole
+// subtrees. Nodes with more than one parent are assigned to the subtree of the
+// first parent found walking breadth-first from the roots, so every node
+// appears in exactly one part
+func (m *Manifest) Partition(n int) []*Manifest {
+	if n <= 0 || len(m.Nodes) == 0 {
+		return nil
+	}
+
+	parent, order := m.spanningTree()
+	treeCh := make([][]int, len(m.Nodes))
+	subSize := make([]uint64, len(m.Nodes))
+	for i := len(order) - 1; i >= 0; i-- {
+		idx := order[i]
+		subSize[idx] += m.Sizes[idx]
+		if p := parent[idx]; p >= 0 {
+			treeCh[p] = append(treeCh[p], idx)
+			subSize[p] += subSize[idx]
+		}
+	}
+	for _, ch := range treeCh {
+		// children were collected in reverse
+		for i, j := 0, len(ch)-1; i < j; i, j = i+1, j-1 {
+			ch[i], ch[j] = ch[j], ch[i]
+		}
+	}
+
+	// break the largest subtrees into their root node & child subtrees until
+	// no subtree is more than half a part's share of bytes
+	units := &unitHeap{}
+	for _, idx := range order {
+		if parent[idx] < 0 {
+			units.items = append(units.items, partUnit{idx, subSize[idx], true})
+		}
+	}
+	heap.Init(units)
+	limit := m.TotalSize() / uint64(2*n)
+	var done []partUnit
+	for units.Len() > 0 {
+		u := heap.Pop(units).(partUnit)
+		if !u.tree || u.size <= limit || len(treeCh[u.idx]) == 0 {
+			done = append(done, u)
+			continue
+		}
+		done = append(done, partUnit{u.idx, m.Sizes[u.idx], false})
+		for _, c := range treeCh[u.idx] {
+			heap.Push(units, partUnit{c, subSize[c], true})
+		}
+	}
+
+	// assign largest units first to the smallest part
+	sort.SliceStable(done, func(i, j int) bool { return done[i].size > done[j].size })
+	keep := make([][]bool, n)
+	totals := make([]uint64, n)
+	for _, u := range done {
+		part := 0
+		for i := range totals {
+			if totals[i] < totals[part] {
+				part = i
+			}
+		}
+		if keep[part] == nil {
+			keep[part] = make([]bool, len(m.Nodes))
+		}
+		totals[part] += u.size
+
+		stack := []int{u.idx}
+		for len(stack) > 0 {
+			idx := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			keep[part][idx] = true
+			if u.tree {
+				stack = append(stack, treeCh[idx]...)
+			}
+		}
+	}
+
+	var parts []*Manifest
+	for _, k := range keep {
+		if k != nil {
+			parts = append(parts, m.subManifest(k))
+		}
+	}
+	return parts
+}
+
+// spanningTree walks breadth-first from the roots, assigning each node the
+// first parent it is discovered from. Roots have a parent of -1. spanningTree
+// also returns the order nodes were discovered in. Nodes unreachable from a
+// root are omitted from order & have a parent of -1
+func (m *Manifest) spanningTree() (parent []int, order []int) {
+	parent = make([]int, len(m.Nodes))
+	seen := make([]bool, len(m.Nodes))
+	for i := range parent {
+		parent[i] = -1
+	}
+
+	ch := m.children()
+	for _, r := range m.roots() {
+		seen[r] = true
+		order = append(order, r)
+	}
+	for i := 0; i < len(order); i++ {
+		idx := order[i]
+		for _, c := range ch[idx] {
+			if !seen[c] {
+				seen[c] = true
+				parent[c] = idx
+				order = append(order, c)
+			}
+		}
+	}
+	return parent, order
+}
+
+// SpanningTree returns a copy of the manifest with only the first link into
+// each node discovered walking breadth-first from the roots. Every node stays
+// reachable from a root, with one parent each
+func (m *Manifest) SpanningTree() *Manifest {
+	parent, _ := m.spanningTree()
+	t := m.Copy()
+	t.Links = nil
+	for i, p := range parent {
+		if p >= 0 {
+			t.Links = append(t.Links, [2]int{p, i})
+		}
+	}
+	return t
+}
+
+// MinCut finds a smallest set of links whose removal leaves no path from any
+// of sources to any of sinks, following links from parent to child. Cut links
+// are returned as index pairs, like Links. MinCut errors if a cid isn't in the
+// manifest or is both a source & a sink, since no cut can separate them
+func (m *Manifest) MinCut(sources, sinks []*cid.Cid) ([][2]int, error) {
+	idx := m.index()
+	lookup := func(ids []*cid.Cid) ([]int, error) {
+		idxs := make([]int, len(ids))
+		for i, id := range ids {
+			j, ok := idx[id.KeyString()]
+			if !ok {
+				return nil, fmt.Errorf("cid not in manifest: %s", id.String())
+			}
+			idxs[i] = j
+		}
+		return idxs, nil
+	}
+	src, err := lookup(sources)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := lookup(sinks)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range src {
+		if containsIndex(dst, s) {
+			return nil, fmt.Errorf("cid is both a source & a sink: %s", m.Nodes[s])
+		}
+	}
+
+	// unit capacity flow network over first occurrences of each node, with a
+	// super source & sink joined to the inputs by uncuttable edges
+	keys := m.nodeKeys()
+	n := len(m.Nodes)
+	source, sink := n, n+1
+	f := newFlowGraph(n + 2)
+	linkEdges := make([]int, len(m.Links))
+	for i, l := range m.Links {
+		linkEdges[i] = f.add(idx[keys[l[0]]], idx[keys[l[1]]], 1)
+	}
+	unlimited := len(m.Links) + 1
+	for _, s := range src {
+		f.add(source, s, unlimited)
+	}
+	for _, d := range dst {
+		f.add(d, sink, unlimited)
+	}
+	for f.augment(source, sink) {
+	}
+
+	// the cut is every saturated link leaving the part still reachable from
+	// the source
+	reached := f.reachable(source)
+	var cut [][2]int
+	for i, l := range m.Links {
+		e := f.edges[linkEdges[i]]
+		if reached[idx[keys[l[0]]]] && !reached[e.to] {
+			cut = append(cut, l)
+		}
+	}
+	return cut, nil
+}
+
+// MaxBetweennessNodes is the largest manifest EdgeBetweenness will analyze
+const MaxBetweennessNodes = 100000
+
+// EdgeBetweenness maps each link to the number of shortest paths from a root
+// to a leaf that go through it. Links with the highest counts are bottlenecks
+// cutting off the most of the DAG, eg: to replicate first. Each root is walked
+// breadth-first once, so it takes O(roots * (nodes + links)) time.
+// EdgeBetweenness errors on manifests of more than MaxBetweennessNodes nodes
+func (m *Manifest) EdgeBetweenness() (map[[2]int]int, error) {
+	if len(m.Nodes) > MaxBetweennessNodes {
+		return nil, fmt.Errorf("manifest too large for edge betweenness: %d nodes exceeds limit of %d", len(m.Nodes), MaxBetweennessNodes)
+	}
+	ch := m.children()
+	for i := range ch {
+		ch[i] = appendIndexSet(nil, ch[i])
+	}
+
+	counts := make(map[[2]int]int, len(m.Links))
+	for _, l := range m.Links {
+		counts[l] = 0
+	}
+	dist := make([]int, len(m.Nodes))
+	paths := make([]int, len(m.Nodes))
+	below := make([]int, len(m.Nodes))
+	for _, r := range m.roots() {
+		for i := range dist {
+			dist[i], paths[i], below[i] = -1, 0, 0
+		}
+		// count the shortest paths from r to each node
+		dist[r], paths[r] = 0, 1
+		order := []int{r}
+		for i := 0; i < len(order); i++ {
+			v := order[i]
+			for _, c := range ch[v] {
+				if dist[c] < 0 {
+					dist[c] = dist[v] + 1
+					order = append(order, c)
+				}
+				if dist[c] == dist[v]+1 {
+					paths[c] += paths[v]
+				}
+			}
+		}
+		// walking back up, count the shortest paths from each node to the
+		// leaves below it. A link is on paths into it times paths out of it
+		for i := len(order) - 1; i >= 0; i-- {
+			v := order[i]
+			if len(ch[v]) == 0 {
+				below[v] = 1
+			}
+			for _, c := range ch[v] {
+				if dist[c] == dist[v]+1 {
+					below[v] += below[c]
+					counts[[2]int{v, c}] += paths[v] * below[c]
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// flowGraph is a residual graph for computing maximum flows. Every edge is
+// stored next to its reverse, so edge i's reverse is i^1
+type flowGraph struct {
+	edges []flowEdge
+	adj   [][]int
+}
+
+type flowEdge struct {
+	to, cap int
+}
+
+func newFlowGraph(n int) *flowGraph {
+	return &flowGraph{adj: make([][]int, n)}
+}
+
+// add inserts an edge & its reverse, returning the index of the edge
+func (f *flowGraph) add(from, to, cap int) int {
+	i := len(f.edges)
+	f.edges = append(f.edges, flowEdge{to, cap}, flowEdge{from, 0})
+	f.adj[from] = append(f.adj[from], i)
+	f.adj[to] = append(f.adj[to], i+1)
+	return i
+}
+
+// augment pushes flow along the shortest path with spare capacity from source
+// to sink, returning false if there is no such path
+func (f *flowGraph) augment(source, sink int) bool {
+	via := make([]int, len(f.adj))
+	for i := range via {
+		via[i] = -1
+	}
+	queue := []int{source}
+	for len(queue) > 0 && via[sink] < 0 {
+		v := queue[0]
+		queue = queue[1:]
+		for _, e := range f.adj[v] {
+			to := f.edges[e].to
+			if f.edges[e].cap > 0 && via[to] < 0 && to != source {
+				via[to] = e
+				queue = append(queue, to)
+			}
+		}
+	}
+	if via[sink] < 0 {
+		return false
+	}
+
+	flow := -1
+	for v := sink; v != source; v = f.edges[via[v]^1].to {
+		if c := f.edges[via[v]].cap; flow < 0 || c < flow {
+			flow = c
+		}
+	}
+	for v := sink; v != source; v = f.edges[via[v]^1].to {
+		f.edges[via[v]].cap -= flow
+		f.edges[via[v]^1].cap += flow
+	}
+	return true
+}
+
+// reachable marks the vertices reachable from source along edges with spare
+// capacity
+func (f *flowGraph) reachable(source int) []bool {
+	seen := make([]bool, len(f.adj))
+	seen[source] = true
+	stack := []int{source}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range f.adj[v] {
+			if to := f.edges[e].to; f.edges[e].cap > 0 && !seen[to] {
+				seen[to] = true
+				stack = append(stack, to)
+			}
+		}
+	}
+	return seen
+}
+
+// partUnit is a chunk of a manifest assigned to a partition as a whole, either
+// a single node or a node & its subtree
+type partUnit struct {
+	idx  int
+	size uint64
+	tree bool
+}
+
+// unitHeap orders partition units largest first
+type unitHeap struct {
+	items []partUnit
+}
+
+func (h *unitHeap) Len() int           { return len(h.items) }
+func (h *unitHeap) Less(i, j int) bool { return h.items[i].size > h.items[j].size }
+func (h *unitHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *unitHeap) Push(x interface{}) { h.items = append(h.items, x.(partUnit)) }
+func (h *unitHeap) Pop() interface{} {
+	u := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return u
+}
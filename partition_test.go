@@ -0,0 +1,176 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestPartition(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	n := 2
+	parts := mf.Partition(n)
+	if len(parts) != n {
+		t.Fatalf("expected %d parts, got: %d", n, len(parts))
+	}
+
+	seen := map[string]int{}
+	var min, max uint64
+	for i, p := range parts {
+		verifyManifest(t, p)
+		for _, id := range p.Nodes {
+			seen[id]++
+		}
+		size := p.TotalSize()
+		if i == 0 || size < min {
+			min = size
+		}
+		if size > max {
+			max = size
+		}
+	}
+
+	for _, id := range mf.Nodes {
+		if seen[id] != 1 {
+			t.Errorf("expected %s to appear in exactly 1 part, got: %d", id, seen[id])
+		}
+	}
+	if len(seen) != len(mf.Nodes) {
+		t.Errorf("expected %d nodes across parts, got: %d", len(mf.Nodes), len(seen))
+	}
+	if max-min > mf.TotalSize()/uint64(2*n) {
+		t.Errorf("expected parts to be roughly balanced. min: %d, max: %d", min, max)
+	}
+}
+
+func TestSpanningTree(t *testing.T) {
+	// diamond: root -> a, b -> shared
+	root, a, b, shared := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	root.links = []*node{a, b}
+	a.links = []*node{shared}
+	b.links = []*node{shared}
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, b, shared}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tree := mf.SpanningTree()
+	verifyManifest(t, tree)
+
+	if len(tree.Nodes) != 4 || len(tree.Links) != 3 {
+		t.Errorf("expected 4 nodes & 3 links, got: %d, %d", len(tree.Nodes), len(tree.Links))
+	}
+	parents := 0
+	for _, l := range tree.Links {
+		if l[1] == tree.IndexOf(shared.Cid()) {
+			parents++
+		}
+	}
+	if parents != 1 {
+		t.Errorf("expected shared node to keep 1 incoming link, got: %d", parents)
+	}
+	if ok, _ := tree.Reachable(root.Cid(), shared.Cid()); !ok {
+		t.Error("expected shared node to stay reachable")
+	}
+	if len(mf.Links) != 4 {
+		t.Error("expected original manifest to be unchanged")
+	}
+}
+
+func TestMinCut(t *testing.T) {
+	// two diamonds joined by a single bridge link from a2 to b0
+	a0, a1, a2, a3 := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	b0, b1, b2, b3 := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	a0.links = []*node{a1, a2}
+	a1.links = []*node{a2, a3}
+	a2.links = []*node{a3, b0}
+	b0.links = []*node{b1, b2}
+	b1.links = []*node{b3}
+	b2.links = []*node{b3}
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{a0, a1, a2, a3, b0, b1, b2, b3}}, a0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cut, err := mf.MinCut([]*cid.Cid{a0.Cid()}, []*cid.Cid{b3.Cid()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bridge := [2]int{mf.IndexOf(a2.Cid()), mf.IndexOf(b0.Cid())}
+	if len(cut) != 1 || cut[0] != bridge {
+		t.Errorf("expected the bridge link %v to be cut, got: %v", bridge, cut)
+	}
+
+	// with two sinks below the bridge, the bridge still suffices
+	cut, err = mf.MinCut([]*cid.Cid{a0.Cid(), a1.Cid()}, []*cid.Cid{b1.Cid(), b2.Cid()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(cut) != 1 || cut[0] != bridge {
+		t.Errorf("expected the bridge link %v to be cut, got: %v", bridge, cut)
+	}
+
+	if _, err := mf.MinCut([]*cid.Cid{newNode(kb).Cid()}, []*cid.Cid{b3.Cid()}); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+	if _, err := mf.MinCut([]*cid.Cid{a0.Cid()}, []*cid.Cid{a0.Cid()}); err == nil {
+		t.Error("expected a cid that's both a source & a sink to error")
+	}
+}
+
+func TestEdgeBetweenness(t *testing.T) {
+	// r1, r2 -> merge -> neck -> 3 leaves: every path crosses merge -> neck
+	r1, r2, merge, neck := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	leaves := []*node{newNode(kb), newNode(kb), newNode(kb)}
+	r1.links = []*node{merge}
+	r2.links = []*node{merge}
+	merge.links = []*node{neck}
+	neck.links = leaves
+	ng := TestNodeGetter{[]format.Node{r1, r2, merge, neck, leaves[0], leaves[1], leaves[2]}}
+
+	a, err := NewManifest(context.Background(), ng, r1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := NewManifest(context.Background(), ng, r2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf := Union(a, b)
+
+	counts, err := mf.EdgeBetweenness()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(counts) != len(mf.Links) {
+		t.Errorf("expected a count for each of %d links, got: %d", len(mf.Links), len(counts))
+	}
+	bottleneck := [2]int{mf.IndexOf(merge.Cid()), mf.IndexOf(neck.Cid())}
+	if counts[bottleneck] != 6 {
+		t.Errorf("expected 6 paths through the bottleneck, got: %d", counts[bottleneck])
+	}
+	for l, n := range counts {
+		if l != bottleneck && n >= counts[bottleneck] {
+			t.Errorf("expected bottleneck to have the highest betweenness, %v has %d", l, n)
+		}
+	}
+	if n := counts[[2]int{mf.IndexOf(r1.Cid()), mf.IndexOf(merge.Cid())}]; n != 3 {
+		t.Errorf("expected 3 paths from r1, got: %d", n)
+	}
+	if n := counts[[2]int{mf.IndexOf(neck.Cid()), mf.IndexOf(leaves[0].Cid())}]; n != 2 {
+		t.Errorf("expected 2 paths into each leaf, got: %d", n)
+	}
+}
@@ -0,0 +1,495 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ManifestPatch is a delta between two manifests. Nodes & links are referenced
+// by cid string rather than index position so a patch can be applied no matter
+// how the target manifest ordered its nodes. cids are matched by binary form,
+// so the multibase encoding of a cid string doesn't matter
+type ManifestPatch struct {
+	// AddedNodes & AddedSizes are upserted: nodes already present in the target
+	// manifest have their size overwritten
+	AddedNodes   []string    `json:"addedNodes"`
+	AddedSizes   []uint64    `json:"addedSizes"`
+	RemovedNodes []string    `json:"removedNodes"`
+	AddedLinks   [][2]string `json:"addedLinks"`
+	RemovedLinks [][2]string `json:"removedLinks"`
+}
+
+// MakePatch generates a patch that turns old into new when applied to old
+func MakePatch(old, new *Manifest) (*ManifestPatch, error) {
+	for _, m := range []*Manifest{old, new} {
+		if err := m.checkSizes(); err != nil {
+			return nil, err
+		}
+	}
+	oldLinks, err := old.linkKeys()
+	if err != nil {
+		return nil, err
+	}
+	newLinks, err := new.linkKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ManifestPatch{}
+	oldSizes := old.sizeMap()
+	newSizes := new.sizeMap()
+	// patches reference nodes by their string representation in new, falling
+	// back to old for removed nodes
+	ids := map[string]string{}
+	oldKeys, newKeys := old.nodeKeys(), new.nodeKeys()
+	for i, key := range oldKeys {
+		ids[key] = old.Nodes[i]
+	}
+	for i, key := range newKeys {
+		ids[key] = new.Nodes[i]
+	}
+
+	for i, key := range newKeys {
+		if size, ok := oldSizes[key]; !ok || size != new.Sizes[i] {
+			p.AddedNodes = append(p.AddedNodes, new.Nodes[i])
+			p.AddedSizes = append(p.AddedSizes, new.Sizes[i])
+		}
+	}
+	for i, key := range oldKeys {
+		if _, ok := newSizes[key]; !ok {
+			p.RemovedNodes = append(p.RemovedNodes, old.Nodes[i])
+		}
+	}
+
+	oldSet := pairSet(oldLinks)
+	newSet := pairSet(newLinks)
+	for _, l := range newLinks {
+		if !oldSet[l] {
+			p.AddedLinks = append(p.AddedLinks, [2]string{ids[l[0]], ids[l[1]]})
+			// guard against duplicate edges
+			oldSet[l] = true
+		}
+	}
+	for _, l := range oldLinks {
+		if !newSet[l] {
+			p.RemovedLinks = append(p.RemovedLinks, [2]string{ids[l[0]], ids[l[1]]})
+			newSet[l] = true
+		}
+	}
+
+	return p, nil
+}
+
+// ApplyPatch returns a new manifest with patch p applied to m. m is not modified
+func (m *Manifest) ApplyPatch(p *ManifestPatch) (*Manifest, error) {
+	if len(p.AddedNodes) != len(p.AddedSizes) {
+		return nil, fmt.Errorf("patch nodes/sizes length mismatch. %d != %d", len(p.AddedNodes), len(p.AddedSizes))
+	}
+	if err := m.checkSizes(); err != nil {
+		return nil, err
+	}
+
+	links, err := m.linkKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[string]bool{}
+	for _, id := range p.RemovedNodes {
+		removed[cidKey(id)] = true
+	}
+
+	res := &Manifest{Version: CurrentVersion}
+	idx := map[string]int{}
+	for i, key := range m.nodeKeys() {
+		if removed[key] {
+			continue
+		}
+		idx[key] = len(res.Nodes)
+		res.Nodes = append(res.Nodes, m.Nodes[i])
+		res.Sizes = append(res.Sizes, m.Sizes[i])
+	}
+
+	for i, id := range p.AddedNodes {
+		key := cidKey(id)
+		if j, ok := idx[key]; ok {
+			res.Sizes[j] = p.AddedSizes[i]
+			continue
+		}
+		idx[key] = len(res.Nodes)
+		res.Nodes = append(res.Nodes, id)
+		res.Sizes = append(res.Sizes, p.AddedSizes[i])
+	}
+
+	drop := map[[2]string]bool{}
+	for _, l := range p.RemovedLinks {
+		drop[[2]string{cidKey(l[0]), cidKey(l[1])}] = true
+	}
+	for _, l := range links {
+		if drop[l] || removed[l[0]] || removed[l[1]] {
+			continue
+		}
+		res.Links = append(res.Links, [2]int{idx[l[0]], idx[l[1]]})
+	}
+
+	for _, l := range p.AddedLinks {
+		from, ok := idx[cidKey(l[0])]
+		if !ok {
+			return nil, fmt.Errorf("patch link references unknown node: %s", l[0])
+		}
+		to, ok := idx[cidKey(l[1])]
+		if !ok {
+			return nil, fmt.Errorf("patch link references unknown node: %s", l[1])
+		}
+		res.Links = append(res.Links, [2]int{from, to})
+	}
+
+	return res, nil
+}
+
+// MutationKind is the kind of change a MutationOp makes
+type MutationKind int
+
+const (
+	// MutationAddNode adds a node, or sets its size if it's already present
+	MutationAddNode MutationKind = iota
+	// MutationRemoveNode removes a node no link references
+	MutationRemoveNode
+	// MutationAddEdge adds a link between two present nodes
+	MutationAddEdge
+	// MutationRemoveEdge removes a link
+	MutationRemoveEdge
+)
+
+// String implements the fmt.Stringer interface
+func (k MutationKind) String() string {
+	switch k {
+	case MutationAddNode:
+		return "add node"
+	case MutationRemoveNode:
+		return "remove node"
+	case MutationAddEdge:
+		return "add edge"
+	case MutationRemoveEdge:
+		return "remove edge"
+	}
+	return "unknown"
+}
+
+// MutationOp is a single step of a DiffScript. Node & Size are set for node
+// ops, Edge for edge ops. Like patches, cids are strings matched by binary form
+type MutationOp struct {
+	Kind MutationKind
+	Node string
+	Size uint64
+	Edge [2]string
+}
+
+// DiffScript lists the mutations that turn old into next when applied to old
+// in order, eg: to update a downstream index incrementally. Edges are removed
+// before the nodes they reference & nodes are added before edges referencing
+// them, so every step leaves a valid manifest
+func DiffScript(old, next *Manifest) ([]MutationOp, error) {
+	p, err := MakePatch(old, next)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []MutationOp
+	for _, l := range p.RemovedLinks {
+		ops = append(ops, MutationOp{Kind: MutationRemoveEdge, Edge: l})
+	}
+	for _, id := range p.RemovedNodes {
+		ops = append(ops, MutationOp{Kind: MutationRemoveNode, Node: id})
+	}
+	for i, id := range p.AddedNodes {
+		ops = append(ops, MutationOp{Kind: MutationAddNode, Node: id, Size: p.AddedSizes[i]})
+	}
+	for _, l := range p.AddedLinks {
+		ops = append(ops, MutationOp{Kind: MutationAddEdge, Edge: l})
+	}
+	return ops, nil
+}
+
+// ApplyScript returns a new manifest with ops applied to m in order. m is not
+// modified. ApplyScript errors on an op that would leave an invalid manifest:
+// removing a node a link still references, adding or removing an edge between
+// nodes that aren't present, or removing an edge that isn't there
+func (m *Manifest) ApplyScript(ops []MutationOp) (*Manifest, error) {
+	if err := m.checkSizes(); err != nil {
+		return nil, err
+	}
+	links, err := m.linkKeys()
+	if err != nil {
+		return nil, err
+	}
+	res := &Manifest{Version: CurrentVersion, Nodes: append([]string(nil), m.Nodes...), Sizes: append([]uint64(nil), m.Sizes...)}
+	idx := map[string]int{}
+	for i, key := range m.nodeKeys() {
+		if _, ok := idx[key]; !ok {
+			idx[key] = i
+		}
+	}
+	// count holds how many times each link is present & linked how many links
+	// reference each node, by key
+	count := map[[2]string]int{}
+	linked := map[string]int{}
+	for _, l := range links {
+		count[l]++
+		linked[l[0]]++
+		linked[l[1]]++
+	}
+	removed := make([]bool, len(res.Nodes))
+	node := func(id string) (int, error) {
+		i, ok := idx[cidKey(id)]
+		if !ok || removed[i] {
+			return -1, fmt.Errorf("node not in manifest: %s", id)
+		}
+		return i, nil
+	}
+
+	for i, op := range ops {
+		switch op.Kind {
+		case MutationAddNode:
+			if j, ok := idx[cidKey(op.Node)]; ok {
+				res.Sizes[j] = op.Size
+				removed[j] = false
+				continue
+			}
+			idx[cidKey(op.Node)] = len(res.Nodes)
+			res.Nodes = append(res.Nodes, op.Node)
+			res.Sizes = append(res.Sizes, op.Size)
+			removed = append(removed, false)
+		case MutationRemoveNode:
+			j, err := node(op.Node)
+			if err != nil {
+				return nil, fmt.Errorf("op %d: %s", i, err.Error())
+			}
+			if linked[cidKey(op.Node)] > 0 {
+				return nil, fmt.Errorf("op %d: node still linked: %s", i, op.Node)
+			}
+			removed[j] = true
+		case MutationAddEdge, MutationRemoveEdge:
+			for _, id := range op.Edge {
+				if _, err := node(id); err != nil {
+					return nil, fmt.Errorf("op %d: %s", i, err.Error())
+				}
+			}
+			l := [2]string{cidKey(op.Edge[0]), cidKey(op.Edge[1])}
+			if op.Kind == MutationAddEdge {
+				links = append(links, l)
+				count[l]++
+				linked[l[0]]++
+				linked[l[1]]++
+				continue
+			}
+			if count[l] == 0 {
+				return nil, fmt.Errorf("op %d: edge not in manifest: %s -> %s", i, op.Edge[0], op.Edge[1])
+			}
+			count[l]--
+			linked[l[0]]--
+			linked[l[1]]--
+		default:
+			return nil, fmt.Errorf("op %d: unknown mutation kind %d", i, op.Kind)
+		}
+	}
+
+	// removed edges are still listed in links, so each is kept only as many
+	// times as it's counted
+	for _, l := range links {
+		if count[l] > 0 {
+			count[l]--
+			res.Links = append(res.Links, [2]int{idx[l[0]], idx[l[1]]})
+		}
+	}
+	keep := make([]bool, len(res.Nodes))
+	for i := range keep {
+		keep[i] = !removed[i]
+	}
+	return res.subManifest(keep), nil
+}
+
+// ThreeWayDiff compares the nodes of two manifests a & b against a common
+// ancestor base. bothAdded & bothRemoved hold changes a & b agree on, aOnly &
+// bOnly hold nodes only one side added or removed, which are the ones that can
+// conflict when merging
+func ThreeWayDiff(base, a, b *Manifest) (bothAdded, aOnly, bOnly, bothRemoved []*cid.Cid, err error) {
+	inBase, inA, inB := base.index(), a.index(), b.index()
+
+	seen := map[string]bool{}
+	for _, m := range []*Manifest{base, a, b} {
+		for i, key := range m.nodeKeys() {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			_, wasBase := inBase[key]
+			_, isA := inA[key]
+			_, isB := inB[key]
+			if isA == wasBase && isB == wasBase {
+				// unchanged
+				continue
+			}
+
+			id, err := cid.Decode(m.Nodes[i])
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+			}
+			switch {
+			case isA == isB && isA:
+				bothAdded = append(bothAdded, id)
+			case isA == isB:
+				bothRemoved = append(bothRemoved, id)
+			case isA != wasBase:
+				aOnly = append(aOnly, id)
+			default:
+				bOnly = append(bOnly, id)
+			}
+		}
+	}
+	return bothAdded, aOnly, bOnly, bothRemoved, nil
+}
+
+func pairSet(pairs [][2]string) map[[2]string]bool {
+	set := make(map[[2]string]bool, len(pairs))
+	for _, p := range pairs {
+		set[p] = true
+	}
+	return set
+}
+
+// DivergenceKind categorizes the first difference between two manifests
+type DivergenceKind int
+
+const (
+	// DivergenceMissing means a node in a is missing from b
+	DivergenceMissing DivergenceKind = iota
+	// DivergenceExtra means b has a node that isn't in a
+	DivergenceExtra
+	// DivergenceSize means a node has a different size in b
+	DivergenceSize
+	// DivergenceLinks means a node links to a different set of nodes in b
+	DivergenceLinks
+	// DivergenceInvalid means a or b can't be compared, because its sizes
+	// aren't aligned with its nodes or a link is out of range
+	DivergenceInvalid
+)
+
+// String implements the fmt.Stringer interface
+func (k DivergenceKind) String() string {
+	switch k {
+	case DivergenceMissing:
+		return "missing"
+	case DivergenceExtra:
+		return "extra"
+	case DivergenceSize:
+		return "size"
+	case DivergenceLinks:
+		return "links"
+	case DivergenceInvalid:
+		return "invalid"
+	}
+	return "unknown"
+}
+
+// Divergence describes the first node that differs between two manifests
+type Divergence struct {
+	Cid  *cid.Cid
+	Kind DivergenceKind
+	// Expected & Actual hold the sizes in a & b of a size divergence
+	Expected, Actual uint64
+}
+
+// FirstDivergence compares manifest b against the expected manifest a one node
+// at a time in canonical order, reporting the first node that differs. Nodes
+// are compared by presence, then size, then links. FirstDivergence returns nil
+// if a & b are Equal. Malformed manifests are reported as DivergenceInvalid
+// before any node is compared, with the cid of the node linking out of range
+func FirstDivergence(a, b *Manifest) *Divergence {
+	for _, m := range []*Manifest{a, b} {
+		if d := invalidDivergence(m); d != nil {
+			return d
+		}
+	}
+	type entry struct {
+		id         string
+		aIdx, bIdx int
+	}
+	entries := map[string]*entry{}
+	aKeys, bKeys := a.nodeKeys(), b.nodeKeys()
+	for i, key := range aKeys {
+		if _, ok := entries[key]; !ok {
+			entries[key] = &entry{id: a.Nodes[i], aIdx: i, bIdx: -1}
+		}
+	}
+	for i, key := range bKeys {
+		if e, ok := entries[key]; !ok {
+			entries[key] = &entry{id: b.Nodes[i], aIdx: -1, bIdx: i}
+		} else if e.bIdx < 0 {
+			e.bIdx = i
+		}
+	}
+	sorted := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].id < sorted[j].id })
+
+	aChildren, bChildren := childKeys(a, aKeys), childKeys(b, bKeys)
+	for _, e := range sorted {
+		// an invalid cid string is still reported, just without a cid
+		id, _ := cid.Decode(e.id)
+		switch {
+		case e.bIdx < 0:
+			return &Divergence{Cid: id, Kind: DivergenceMissing}
+		case e.aIdx < 0:
+			return &Divergence{Cid: id, Kind: DivergenceExtra}
+		case a.Sizes[e.aIdx] != b.Sizes[e.bIdx]:
+			return &Divergence{Cid: id, Kind: DivergenceSize, Expected: a.Sizes[e.aIdx], Actual: b.Sizes[e.bIdx]}
+		}
+
+		ac, bc := aChildren[aKeys[e.aIdx]], bChildren[bKeys[e.bIdx]]
+		same := len(ac) == len(bc)
+		for key := range ac {
+			same = same && bc[key]
+		}
+		if !same {
+			return &Divergence{Cid: id, Kind: DivergenceLinks}
+		}
+	}
+	return nil
+}
+
+// invalidDivergence reports the first reason m can't be compared, nil if it
+// can
+func invalidDivergence(m *Manifest) *Divergence {
+	if m.checkSizes() != nil {
+		return &Divergence{Kind: DivergenceInvalid}
+	}
+	for _, l := range m.Links {
+		if l[0] < 0 || l[0] >= len(m.Nodes) {
+			return &Divergence{Kind: DivergenceInvalid}
+		}
+		if l[1] < 0 || l[1] >= len(m.Nodes) {
+			id, _ := cid.Decode(m.Nodes[l[0]])
+			return &Divergence{Cid: id, Kind: DivergenceInvalid}
+		}
+	}
+	return nil
+}
+
+// childKeys maps each node key to the set of keys it links to
+func childKeys(m *Manifest, keys []string) map[string]map[string]bool {
+	ch := map[string]map[string]bool{}
+	for _, l := range m.Links {
+		from := keys[l[0]]
+		if ch[from] == nil {
+			ch[from] = map[string]bool{}
+		}
+		ch[from][keys[l[1]]] = true
+	}
+	return ch
+}
@@ -0,0 +1,254 @@
+package manifest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestPatchRoundTrip(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{10, 256 * kb},
+	})
+
+	ng := TestNodeGetter{g}
+	old, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// drop one subtree, add a new leaf & change the size of another
+	root := g[0].(*node)
+	added := newNode(10 * kb)
+	root.links = append(root.links[1:], added)
+	root.links[0].size = 7 * kb
+	g = append(g, added)
+
+	ng = TestNodeGetter{g}
+	new, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p, err := MakePatch(old, new)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(p.AddedNodes) != 2 {
+		t.Errorf("expected 2 added nodes, got: %d", len(p.AddedNodes))
+	}
+	if len(p.RemovedNodes) != 11 {
+		t.Errorf("expected 11 removed nodes, got: %d", len(p.RemovedNodes))
+	}
+
+	got, err := old.ApplyPatch(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(new) {
+		t.Error("expected patched manifest to equal new manifest")
+	}
+	if old.Equal(new) {
+		t.Error("expected old manifest to differ from new manifest")
+	}
+
+	bad := old.Copy()
+	bad.Sizes = bad.Sizes[1:]
+	if _, err := MakePatch(bad, new); err == nil {
+		t.Error("expected misaligned old sizes to error")
+	}
+	if _, err := MakePatch(old, bad); err == nil {
+		t.Error("expected misaligned new sizes to error")
+	}
+	if _, err := bad.ApplyPatch(p); err == nil {
+		t.Error("expected applying to misaligned sizes to error")
+	}
+	if _, err := bad.ApplyScript(nil); err == nil {
+		t.Error("expected scripting misaligned sizes to error")
+	}
+}
+
+func TestDiffScript(t *testing.T) {
+	g := NewGraph([]layer{
+		{3, 4 * kb},
+		{10, 256 * kb},
+	})
+	old, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// drop one subtree, add a new leaf & change the size of another
+	root := g[0].(*node)
+	added := newNode(10 * kb)
+	root.links = append(root.links[1:], added)
+	root.links[0].size = 7 * kb
+	g = append(g, added)
+	next, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ops, err := DiffScript(old, next)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	phase := map[MutationKind]int{MutationRemoveEdge: 0, MutationRemoveNode: 1, MutationAddNode: 2, MutationAddEdge: 3}
+	counts := map[MutationKind]int{}
+	for i, op := range ops {
+		counts[op.Kind]++
+		if i > 0 && phase[op.Kind] < phase[ops[i-1].Kind] {
+			t.Errorf("op %d: expected %s before %s", i, op.Kind, ops[i-1].Kind)
+		}
+	}
+	expect := map[MutationKind]int{MutationRemoveEdge: 11, MutationRemoveNode: 11, MutationAddNode: 2, MutationAddEdge: 1}
+	if !reflect.DeepEqual(counts, expect) {
+		t.Errorf("expected ops %v, got: %v", expect, counts)
+	}
+
+	got, err := old.ApplyScript(ops)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(next) {
+		t.Error("expected applying the script to old to reproduce next")
+	}
+	if len(got.Links) != len(next.Links) {
+		t.Errorf("expected %d links, got: %d", len(next.Links), len(got.Links))
+	}
+
+	// removing a node that's still linked breaks the manifest
+	bad := []MutationOp{{Kind: MutationRemoveNode, Node: old.Nodes[1]}}
+	if _, err := old.ApplyScript(bad); err == nil {
+		t.Error("expected removing a linked node to error")
+	}
+	bad = []MutationOp{{Kind: MutationAddEdge, Edge: [2]string{old.Nodes[0], added.Cid().String()}}}
+	if _, err := old.ApplyScript(bad); err == nil {
+		t.Error("expected an edge to an absent node to error")
+	}
+	bad = []MutationOp{{Kind: MutationRemoveEdge, Edge: [2]string{old.Nodes[1], old.Nodes[0]}}}
+	if _, err := old.ApplyScript(bad); err == nil {
+		t.Error("expected removing an absent edge to error")
+	}
+}
+
+func TestThreeWayDiff(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{2, 256 * kb},
+	})
+	root := g[0].(*node)
+	base, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a & b each add a distinct subtree, and both add a shared leaf
+	shared := newNode(kb)
+	subA, leafA := newNode(kb), newNode(2*kb)
+	subA.links = []*node{leafA}
+	subB := newNode(3 * kb)
+
+	build := func(extra ...*node) (*Manifest, *node) {
+		r := newNode(root.size)
+		r.links = append(append([]*node{}, root.links...), extra...)
+		nodes := append([]format.Node{r}, g[1:]...)
+		for _, n := range extra {
+			nodes = append(nodes, n)
+			for _, l := range n.links {
+				nodes = append(nodes, l)
+			}
+		}
+		mf, err := NewManifest(context.Background(), TestNodeGetter{nodes}, r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return mf, r
+	}
+	a, rootA := build(subA, shared)
+	b, rootB := build(subB, shared)
+
+	bothAdded, aOnly, bOnly, bothRemoved, err := ThreeWayDiff(base, a, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the roots of a & b differ from base & each other
+	expectCids(t, "bothAdded", bothAdded, shared.Cid())
+	expectCids(t, "aOnly", aOnly, rootA.Cid(), subA.Cid(), leafA.Cid())
+	expectCids(t, "bOnly", bOnly, rootB.Cid(), subB.Cid())
+	expectCids(t, "bothRemoved", bothRemoved, root.Cid())
+}
+
+func expectCids(t *testing.T, name string, got []*cid.Cid, expect ...*cid.Cid) {
+	t.Helper()
+	if len(got) != len(expect) {
+		t.Errorf("%s: expected %d cids, got: %d", name, len(expect), len(got))
+		return
+	}
+	for i, id := range expect {
+		if !got[i].Equals(id) {
+			t.Errorf("%s: cid %d mismatch. expected: %s, got: %s", name, i, id, got[i])
+		}
+	}
+}
+
+func TestFirstDivergence(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	a, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b := a.Copy()
+	b.Canonicalize()
+	if d := FirstDivergence(a, b); d != nil {
+		t.Fatalf("expected equal manifests to have no divergence, got: %+v", d)
+	}
+
+	changed := g[3]
+	b.Sizes[b.IndexOf(changed.Cid())] = 7
+	d := FirstDivergence(a, b)
+	if d == nil {
+		t.Fatal("expected size change to diverge")
+	}
+	if d.Kind != DivergenceSize || !d.Cid.Equals(changed.Cid()) || d.Expected != 256*kb || d.Actual != 7 {
+		t.Errorf("unexpected divergence: %s %s %d %d", d.Kind, d.Cid, d.Expected, d.Actual)
+	}
+
+	b = a.Copy()
+	b.Nodes = append(b.Nodes, newNode(kb).Cid().String())
+	b.Sizes = append(b.Sizes, kb)
+	if d := FirstDivergence(a, b); d == nil || d.Kind != DivergenceExtra {
+		t.Errorf("expected extra node divergence, got: %+v", d)
+	}
+	if d := FirstDivergence(b, a); d == nil || d.Kind != DivergenceMissing {
+		t.Errorf("expected missing node divergence, got: %+v", d)
+	}
+
+	b = a.Copy()
+	b.Links = b.Links[1:]
+	if d := FirstDivergence(a, b); d == nil || d.Kind != DivergenceLinks {
+		t.Errorf("expected link divergence, got: %+v", d)
+	}
+
+	b = a.Copy()
+	b.Sizes = b.Sizes[1:]
+	if d := FirstDivergence(a, b); d == nil || d.Kind != DivergenceInvalid {
+		t.Errorf("expected misaligned sizes to be invalid, got: %+v", d)
+	}
+	b = a.Copy()
+	b.Links = append(b.Links, [2]int{0, len(b.Nodes)})
+	if d := FirstDivergence(b, a); d == nil || d.Kind != DivergenceInvalid || !d.Cid.Equals(g[0].Cid()) {
+		t.Errorf("expected link out of range to be invalid, got: %+v", d)
+	}
+}
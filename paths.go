@@ -0,0 +1,90 @@
+package manifest
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// NewManifestFromPaths generates a manifest of only the nodes encountered while
+// resolving each path from root. Paths are resolved with node.ResolveLink, one
+// link at a time. Nodes & links shared by more than one path are only added once
+func NewManifestFromPaths(ctx context.Context, ng format.NodeGetter, root *cid.Cid, paths [][]string) (*Manifest, error) {
+	rootNode, err := ng.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &mstate{
+		ctx:  ctx,
+		ng:   ng,
+		cids: map[string]int{},
+		m:    &Manifest{Version: CurrentVersion},
+	}
+	rootIdx, _ := ms.insert(rootNode, ms.classify(rootNode))
+	links := map[[2]int]bool{}
+
+	for _, path := range paths {
+		node, from := rootNode, rootIdx
+		for len(path) > 0 {
+			link, rest, err := node.ResolveLink(path)
+			if err != nil {
+				return nil, err
+			}
+			child, err := link.GetNode(ctx, ng)
+			if err != nil {
+				return nil, err
+			}
+
+			to, _ := ms.insert(child, ms.classify(child))
+			if l := [2]int{from, to}; !links[l] {
+				links[l] = true
+				ms.m.Links = append(ms.m.Links, l)
+			}
+			node, from, path = child, to, rest
+		}
+	}
+
+	return ms.m, nil
+}
+
+// NewManifestPathWithSiblings generates a manifest of the nodes along path from
+// root, plus the direct children of every node along the way except the last.
+// Children that aren't on the path are recorded as leaves using the size of the
+// link that points to them, without being fetched
+func NewManifestPathWithSiblings(ctx context.Context, ng format.NodeGetter, root *cid.Cid, path []string) (*Manifest, error) {
+	node, err := ng.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &mstate{
+		ctx:  ctx,
+		ng:   ng,
+		cids: map[string]int{},
+		m:    &Manifest{Version: CurrentVersion},
+	}
+	from, _ := ms.insert(node, ms.classify(node))
+
+	for len(path) > 0 {
+		link, rest, err := node.ResolveLink(path)
+		if err != nil {
+			return nil, err
+		}
+		child, err := link.GetNode(ctx, ng)
+		if err != nil {
+			return nil, err
+		}
+
+		// insert the path node first so it's recorded with its real size
+		to, _ := ms.insert(child, ms.classify(child))
+		for _, l := range node.Links() {
+			idx, _ := ms.record(l.Cid, l.Size)
+			ms.m.Links = append(ms.m.Links, [2]int{from, idx})
+		}
+		node, from, path = child, to, rest
+	}
+
+	return ms.m, nil
+}
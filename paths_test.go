@@ -0,0 +1,84 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewManifestFromPaths(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	root := g[0].(*node)
+
+	mf, err := NewManifestFromPaths(context.Background(), TestNodeGetter{g}, root.Cid(), [][]string{
+		{"1", "0", "2"},
+		{"1", "0", "3"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	// root, shared prefix of 1/0, and two leaves
+	if len(mf.Nodes) != 5 {
+		t.Errorf("expected 5 nodes, got: %d", len(mf.Nodes))
+	}
+	if len(mf.Links) != 4 {
+		t.Errorf("expected 4 links, got: %d", len(mf.Links))
+	}
+
+	mid := root.links[1].links[0]
+	for _, n := range []*node{root, root.links[1], mid, mid.links[2], mid.links[3]} {
+		if mf.IndexOf(n.Cid()) < 0 {
+			t.Errorf("expected manifest to contain %s", n.Cid().String())
+		}
+	}
+
+	if _, err := NewManifestFromPaths(context.Background(), TestNodeGetter{g}, root.Cid(), [][]string{{"nope"}}); err == nil {
+		t.Error("expected unresolvable path to error")
+	}
+}
+
+func TestNewManifestPathWithSiblings(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	root := g[0].(*node)
+
+	mf, err := NewManifestPathWithSiblings(context.Background(), TestNodeGetter{g}, root.Cid(), []string{"1", "2"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	// root, 2 children of root & 3 children of root/1
+	if len(mf.Nodes) != 6 {
+		t.Errorf("expected 6 nodes, got: %d", len(mf.Nodes))
+	}
+	if len(mf.Links) != 5 {
+		t.Errorf("expected 5 links, got: %d", len(mf.Links))
+	}
+
+	dir := root.links[1]
+	ch := mf.children()
+	for _, level := range []*node{root, dir} {
+		for _, sib := range level.links {
+			idx := mf.IndexOf(sib.Cid())
+			if idx < 0 {
+				t.Errorf("expected manifest to contain sibling %s", sib.Cid().String())
+				continue
+			}
+			if sib != dir && len(ch[idx]) != 0 {
+				t.Errorf("expected sibling %s to be a leaf", sib.Cid().String())
+			}
+		}
+	}
+	if len(ch[mf.IndexOf(dir.Cid())]) != 3 {
+		t.Error("expected path directory to list its children")
+	}
+}
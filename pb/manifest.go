@@ -0,0 +1,175 @@
+// Package pb holds the protobuf form of a manifest, as described by
+// manifest.proto. It's hand written to keep the manifest package free of a
+// protobuf runtime, but encodes the same wire format generated code does
+package pb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Manifest is a flat manifest of a DAG. Links reference nodes by their index
+// position in NodeCids, Sizes is aligned with NodeCids
+type Manifest struct {
+	NodeCids [][]byte `protobuf:"bytes,1,rep,name=node_cids,json=nodeCids,proto3"`
+	Sizes    []uint64 `protobuf:"varint,2,rep,packed,name=sizes,proto3"`
+	Links    []*Link  `protobuf:"bytes,3,rep,name=links,proto3"`
+}
+
+// Link is a link between two nodes of a manifest, by index position
+type Link struct {
+	From uint64 `protobuf:"varint,1,opt,name=from,proto3"`
+	To   uint64 `protobuf:"varint,2,opt,name=to,proto3"`
+}
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Marshal encodes the manifest in protobuf wire format
+func (m *Manifest) Marshal() ([]byte, error) {
+	var buf []byte
+	for _, id := range m.NodeCids {
+		buf = appendBytes(buf, 1, id)
+	}
+	if len(m.Sizes) > 0 {
+		var packed []byte
+		for _, s := range m.Sizes {
+			packed = appendUvarint(packed, s)
+		}
+		buf = appendBytes(buf, 2, packed)
+	}
+	for _, l := range m.Links {
+		data, err := l.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendBytes(buf, 3, data)
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes a manifest from protobuf wire format, replacing m.
+// Unknown fields are skipped
+func (m *Manifest) Unmarshal(data []byte) error {
+	*m = Manifest{}
+	return readFields(data, func(field uint64, wire uint64, value []byte, v uint64) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			m.NodeCids = append(m.NodeCids, append([]byte(nil), value...))
+		case field == 2 && wire == wireVarint:
+			m.Sizes = append(m.Sizes, v)
+		case field == 2 && wire == wireBytes:
+			// packed sizes
+			for len(value) > 0 {
+				s, n := binary.Uvarint(value)
+				if n <= 0 {
+					return fmt.Errorf("invalid packed size")
+				}
+				m.Sizes = append(m.Sizes, s)
+				value = value[n:]
+			}
+		case field == 3 && wire == wireBytes:
+			l := &Link{}
+			if err := l.Unmarshal(value); err != nil {
+				return err
+			}
+			m.Links = append(m.Links, l)
+		}
+		return nil
+	})
+}
+
+// Marshal encodes the link in protobuf wire format
+func (l *Link) Marshal() ([]byte, error) {
+	var buf []byte
+	// proto3 leaves out zero values
+	if l.From != 0 {
+		buf = appendVarint(buf, 1, l.From)
+	}
+	if l.To != 0 {
+		buf = appendVarint(buf, 2, l.To)
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes a link from protobuf wire format, replacing l
+func (l *Link) Unmarshal(data []byte) error {
+	*l = Link{}
+	return readFields(data, func(field uint64, wire uint64, value []byte, v uint64) error {
+		if wire != wireVarint {
+			return nil
+		}
+		switch field {
+		case 1:
+			l.From = v
+		case 2:
+			l.To = v
+		}
+		return nil
+	})
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendBytes(buf []byte, field uint64, value []byte) []byte {
+	buf = appendUvarint(buf, field<<3|wireBytes)
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendVarint(buf []byte, field uint64, v uint64) []byte {
+	buf = appendUvarint(buf, field<<3|wireVarint)
+	return appendUvarint(buf, v)
+}
+
+// readFields calls f with each field of a protobuf message. Length-delimited
+// fields are passed as value, varints as v. Fixed width fields are skipped
+func readFields(data []byte, f func(field, wire uint64, value []byte, v uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf field key")
+		}
+		data = data[n:]
+
+		var value []byte
+		var v uint64
+		size := 0
+		switch key & 7 {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			size = n
+		case 1:
+			size = 8
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return fmt.Errorf("invalid protobuf field length")
+			}
+			value = data[n : n+int(l)]
+			size = n + int(l)
+		case 5:
+			size = 4
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if size > len(data) {
+			return fmt.Errorf("truncated protobuf field")
+		}
+		if key&7 == wireVarint || key&7 == wireBytes {
+			if err := f(key>>3, key&7, value, v); err != nil {
+				return err
+			}
+		}
+		data = data[size:]
+	}
+	return nil
+}
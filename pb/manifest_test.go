@@ -0,0 +1,38 @@
+package pb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	m := &Manifest{
+		NodeCids: [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		Sizes:    []uint64{1, 300, 0},
+		Links:    []*Link{{From: 0, To: 1}, {From: 0, To: 2}, {From: 1, To: 2}},
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := &Manifest{}
+	if err := got.Unmarshal(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("expected %v, got: %v", m, got)
+	}
+
+	// sizes written unpacked by older encoders
+	unpacked := appendVarint(appendVarint(nil, 2, 7), 2, 8)
+	if err := got.Unmarshal(unpacked); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(got.Sizes, []uint64{7, 8}) {
+		t.Errorf("expected unpacked sizes [7 8], got: %v", got.Sizes)
+	}
+
+	if err := got.Unmarshal(data[:len(data)-1]); err == nil {
+		t.Error("expected truncated message to error")
+	}
+}
@@ -0,0 +1,55 @@
+package manifest
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	manifestpb "github.com/jonnycrunch/go-ipld-manifest/pb"
+)
+
+// ToProto converts the manifest to its protobuf form. Only nodes, sizes &
+// links are carried over
+func (m *Manifest) ToProto() (*manifestpb.Manifest, error) {
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &manifestpb.Manifest{
+		NodeCids: make([][]byte, len(ids)),
+		Sizes:    append([]uint64(nil), m.Sizes...),
+		Links:    make([]*manifestpb.Link, len(m.Links)),
+	}
+	for i, id := range ids {
+		pm.NodeCids[i] = id.Bytes()
+	}
+	for i, l := range m.Links {
+		pm.Links[i] = &manifestpb.Link{From: uint64(l[0]), To: uint64(l[1])}
+	}
+	return pm, nil
+}
+
+// FromProto decodes a manifest from its protobuf form, checking every cid
+// parses & every link is in range
+func FromProto(pm *manifestpb.Manifest) (*Manifest, error) {
+	if len(pm.Sizes) != len(pm.NodeCids) {
+		return nil, fmt.Errorf("nodes/sizes length mismatch. %d != %d", len(pm.NodeCids), len(pm.Sizes))
+	}
+
+	m := &Manifest{Version: CurrentVersion, Sizes: append([]uint64(nil), pm.Sizes...)}
+	for i, raw := range pm.NodeCids {
+		id, err := cid.Cast(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+		m.Nodes = append(m.Nodes, id.String())
+	}
+	n := uint64(len(m.Nodes))
+	for _, l := range pm.Links {
+		if l == nil || l.From >= n || l.To >= n {
+			return nil, fmt.Errorf("link out of range: %v", l)
+		}
+		m.Links = append(m.Links, [2]int{int(l.From), int(l.To)})
+	}
+	return m, nil
+}
@@ -0,0 +1,56 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	manifestpb "github.com/jonnycrunch/go-ipld-manifest/pb"
+)
+
+func TestProto(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pm, err := mf.ToProto()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := pm.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded := &manifestpb.Manifest{}
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := FromProto(decoded)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(mf) {
+		t.Error("expected decoded manifest to equal the original")
+	}
+
+	decoded.Links = append(decoded.Links, &manifestpb.Link{From: 0, To: uint64(len(mf.Nodes))})
+	if _, err := FromProto(decoded); err == nil {
+		t.Error("expected out of range link to error")
+	}
+	decoded.Links = decoded.Links[:len(decoded.Links)-1]
+	decoded.Sizes = decoded.Sizes[1:]
+	if _, err := FromProto(decoded); err == nil {
+		t.Error("expected nodes/sizes mismatch to error")
+	}
+	decoded.Sizes = append(decoded.Sizes, 0)
+	decoded.NodeCids[1] = []byte("not a cid")
+	if _, err := FromProto(decoded); err == nil {
+		t.Error("expected invalid cid to error")
+	}
+}
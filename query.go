@@ -0,0 +1,460 @@
+package manifest
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Reachable checks if to can be reached by following links forward from from
+func (m *Manifest) Reachable(from, to *cid.Cid) (bool, error) {
+	start := m.IndexOf(from)
+	if start < 0 {
+		return false, fmt.Errorf("cid not in manifest: %s", from.String())
+	}
+	end := m.IndexOf(to)
+	if end < 0 {
+		return false, fmt.Errorf("cid not in manifest: %s", to.String())
+	}
+
+	ch := m.children()
+	visited := make([]bool, len(m.Nodes))
+	visited[start] = true
+	queue := []int{start}
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		if idx == end {
+			return true, nil
+		}
+		for _, c := range ch[idx] {
+			if !visited[c] {
+				visited[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+	return false, nil
+}
+
+// MaxReachabilityNodes is the largest manifest ReachabilityClosure will build
+// a closure for
+const MaxReachabilityNodes = 50000
+
+// Reachability is the precomputed transitive closure of a manifest's links,
+// answering reachability queries in constant time
+type Reachability struct {
+	words int
+	// bits holds a row of words bits per node, with bit j of row i set if node
+	// j can be reached from node i
+	bits []uint64
+}
+
+// ReachabilityClosure precomputes which nodes reach which, for answering many
+// reachability queries on an unchanging manifest. The closure takes N²/64
+// words of memory for N nodes, so ReachabilityClosure errors on manifests of
+// more than MaxReachabilityNodes nodes, as well as on cycles
+func (m *Manifest) ReachabilityClosure() (*Reachability, error) {
+	if len(m.Nodes) > MaxReachabilityNodes {
+		return nil, fmt.Errorf("manifest too large for reachability closure: %d nodes exceeds limit of %d", len(m.Nodes), MaxReachabilityNodes)
+	}
+	order, err := m.topoIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	words := (len(m.Nodes) + 63) / 64
+	r := &Reachability{words: words, bits: make([]uint64, words*len(m.Nodes))}
+	ch := m.children()
+	// children come after parents, so fill rows from the end
+	for i := len(order) - 1; i >= 0; i-- {
+		idx := order[i]
+		row := r.row(idx)
+		row[idx/64] |= 1 << uint(idx%64)
+		for _, c := range ch[idx] {
+			for w, bits := range r.row(c) {
+				row[w] |= bits
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *Reachability) row(idx int) []uint64 {
+	return r.bits[idx*r.words : (idx+1)*r.words]
+}
+
+// Reaches checks if the node at index position to can be reached by following
+// links forward from the node at from. Like Reachable every node reaches
+// itself. Out of range index positions reach nothing
+func (r *Reachability) Reaches(from, to int) bool {
+	n := 0
+	if r.words > 0 {
+		n = len(r.bits) / r.words
+	}
+	if from < 0 || from >= n || to < 0 || to >= n {
+		return false
+	}
+	return r.row(from)[to/64]&(1<<uint(to%64)) != 0
+}
+
+// IsBoundary checks if a cid was recorded as a boundary node
+func (m *Manifest) IsBoundary(id *cid.Cid) bool {
+	return containsIndex(m.Boundaries, m.IndexOf(id))
+}
+
+// IsExternal checks if a cid was recorded as a reference to content in another
+// network
+func (m *Manifest) IsExternal(id *cid.Cid) bool {
+	return containsIndex(m.External, m.IndexOf(id))
+}
+
+// IsMissing checks if a cid was recorded as a placeholder for a node that
+// couldn't be fetched
+func (m *Manifest) IsMissing(id *cid.Cid) bool {
+	return containsIndex(m.Missing, m.IndexOf(id))
+}
+
+// LeafChildCount is the number of links from a node to leaves the SkipLeaves
+// option left out of the manifest. LeafChildCount is 0 for cids not in the
+// manifest & manifests built without SkipLeaves
+func (m *Manifest) LeafChildCount(id *cid.Cid) int {
+	idx := m.IndexOf(id)
+	if idx < 0 || idx >= len(m.LeafCounts) {
+		return 0
+	}
+	return m.LeafCounts[idx]
+}
+
+// PathTo finds a shortest path of links from a root to id. The returned path
+// starts with the root & ends with id
+func (m *Manifest) PathTo(id *cid.Cid) ([]*cid.Cid, error) {
+	idx := m.IndexOf(id)
+	if idx < 0 {
+		return nil, fmt.Errorf("cid not in manifest: %s", id.String())
+	}
+
+	parent, order := m.spanningTree()
+	reached := false
+	for _, i := range order {
+		if i == idx {
+			reached = true
+			break
+		}
+	}
+	if !reached {
+		return nil, fmt.Errorf("cid not reachable from a root: %s", id.String())
+	}
+
+	var path []int
+	for ; idx >= 0; idx = parent[idx] {
+		path = append([]int{idx}, path...)
+	}
+	return m.cidsAt(path)
+}
+
+// InclusionPath is the chain of cids proving leaf is part of the DAG under a
+// root, starting with the root & ending with leaf. A verifier can check the
+// proof by fetching each block in turn & confirming it links to the next cid.
+// It's the shortest such chain, the same path PathTo finds
+func (m *Manifest) InclusionPath(leaf *cid.Cid) ([]*cid.Cid, error) {
+	return m.PathTo(leaf)
+}
+
+// OrderedChildren lists the cids id links to, in the order the node listed its
+// links when the manifest was generated. Canonicalizing a manifest sorts links,
+// which loses this order
+func (m *Manifest) OrderedChildren(id *cid.Cid) ([]*cid.Cid, error) {
+	idx := m.IndexOf(id)
+	if idx < 0 {
+		return nil, fmt.Errorf("cid not in manifest: %s", id.String())
+	}
+	var children []int
+	for _, l := range m.Links {
+		if l[0] == idx {
+			children = append(children, l[1])
+		}
+	}
+	return m.cidsAt(children)
+}
+
+// ExplainResult describes why a cid is in a manifest
+type ExplainResult struct {
+	Cid *cid.Cid
+	// Parents lists every node that links to Cid
+	Parents []*cid.Cid
+	// RefCount is the number of links to Cid
+	RefCount int
+	// Depth is the shortest distance from a root to Cid
+	Depth int
+	// Path is an example path from a root to Cid
+	Path []*cid.Cid
+}
+
+// Explain collects the parents, reference count, depth & an example root path
+// of a cid into one result, for diagnostic & audit purposes
+func (m *Manifest) Explain(id *cid.Cid) (ExplainResult, error) {
+	res := ExplainResult{Cid: id}
+	idx := m.IndexOf(id)
+	if idx < 0 {
+		return res, fmt.Errorf("cid not in manifest: %s", id.String())
+	}
+
+	var parents []int
+	seen := map[int]bool{}
+	for _, l := range m.Links {
+		if l[1] == idx {
+			res.RefCount++
+			if !seen[l[0]] {
+				seen[l[0]] = true
+				parents = append(parents, l[0])
+			}
+		}
+	}
+
+	var err error
+	if res.Parents, err = m.cidsAt(parents); err != nil {
+		return res, err
+	}
+	if res.Path, err = m.PathTo(id); err != nil {
+		return res, err
+	}
+	res.Depth = len(res.Path) - 1
+	return res, nil
+}
+
+// LowestCommonAncestor finds the deepest node that both a & b can be reached
+// from, counting each node as its own ancestor. Depth is the shortest distance
+// from a root, ties go to the node with the lowest index position.
+// LowestCommonAncestor errors if either cid isn't in the manifest or they
+// have no common ancestor
+func (m *Manifest) LowestCommonAncestor(a, b *cid.Cid) (*cid.Cid, error) {
+	ia := m.IndexOf(a)
+	if ia < 0 {
+		return nil, fmt.Errorf("cid not in manifest: %s", a.String())
+	}
+	ib := m.IndexOf(b)
+	if ib < 0 {
+		return nil, fmt.Errorf("cid not in manifest: %s", b.String())
+	}
+
+	parents := make([][]int, len(m.Nodes))
+	for _, l := range m.Links {
+		parents[l[1]] = append(parents[l[1]], l[0])
+	}
+	ancestors := func(start int) []bool {
+		seen := make([]bool, len(m.Nodes))
+		seen[start] = true
+		stack := []int{start}
+		for len(stack) > 0 {
+			idx := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, p := range parents[idx] {
+				if !seen[p] {
+					seen[p] = true
+					stack = append(stack, p)
+				}
+			}
+		}
+		return seen
+	}
+
+	ofA, ofB := ancestors(ia), ancestors(ib)
+	depths := m.depths()
+	best := -1
+	for i := range m.Nodes {
+		if ofA[i] && ofB[i] && (best < 0 || depths[i] > depths[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no common ancestor of %s & %s", a.String(), b.String())
+	}
+	return cid.Decode(m.Nodes[best])
+}
+
+// Dominators maps the cid string of every node reachable from root to its
+// immediate dominator: the closest node that every path from root to it goes
+// through. A node's dominator is a single point whose loss cuts it off from
+// root. root itself isn't in the map
+func (m *Manifest) Dominators(root *cid.Cid) (map[string]*cid.Cid, error) {
+	idx := m.index()
+	start, ok := idx[root.KeyString()]
+	if !ok {
+		return nil, fmt.Errorf("cid not in manifest: %s", root.String())
+	}
+
+	succ, pred := m.firstOccurrenceLinks()
+
+	// number nodes in depth-first postorder
+	post := make([]int, len(m.Nodes))
+	for i := range post {
+		post[i] = -1
+	}
+	var order []int
+	visited := make([]bool, len(m.Nodes))
+	var dfs func(int)
+	dfs = func(i int) {
+		visited[i] = true
+		for _, c := range succ[i] {
+			if !visited[c] {
+				dfs(c)
+			}
+		}
+		post[i] = len(order)
+		order = append(order, i)
+	}
+	dfs(start)
+
+	// iterate to a fixed point over reverse postorder, see Cooper, Harvey &
+	// Kennedy's "A Simple, Fast Dominance Algorithm"
+	idom := make([]int, len(m.Nodes))
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[start] = start
+	intersect := func(a, b int) int {
+		for a != b {
+			for post[a] < post[b] {
+				a = idom[a]
+			}
+			for post[b] < post[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 2; i >= 0; i-- {
+			n := order[i]
+			dom := -1
+			for _, p := range pred[n] {
+				if idom[p] < 0 {
+					continue
+				}
+				if dom < 0 {
+					dom = p
+				} else {
+					dom = intersect(p, dom)
+				}
+			}
+			if idom[n] != dom {
+				idom[n] = dom
+				changed = true
+			}
+		}
+	}
+
+	doms := make(map[string]*cid.Cid, len(order)-1)
+	for _, n := range order[:len(order)-1] {
+		id, err := cid.Decode(m.Nodes[idom[n]])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", idom[n], err.Error())
+		}
+		doms[m.Nodes[n]] = id
+	}
+	return doms, nil
+}
+
+// firstOccurrenceLinks lists the successors & predecessors of each node by
+// index position, with links moved onto the first occurrence of the nodes
+// they join so duplicates act as one. Later occurrences have none
+func (m *Manifest) firstOccurrenceLinks() (succ, pred [][]int) {
+	idx := m.index()
+	keys := m.nodeKeys()
+	succ = make([][]int, len(m.Nodes))
+	pred = make([][]int, len(m.Nodes))
+	for _, l := range m.Links {
+		from, to := idx[keys[l[0]]], idx[keys[l[1]]]
+		succ[from] = append(succ[from], to)
+		pred[to] = append(pred[to], from)
+	}
+	return succ, pred
+}
+
+// BlocksFreedByDeleting lists the nodes that would become unreferenced if the
+// subtree under root were deleted: root & every node reachable from it that
+// can't be reached from one of the manifest's roots without passing through
+// root. Nodes shared with the rest of the DAG aren't freed. Nodes are listed
+// in manifest order
+func (m *Manifest) BlocksFreedByDeleting(root *cid.Cid) ([]*cid.Cid, error) {
+	idx := m.index()
+	start, ok := idx[root.KeyString()]
+	if !ok {
+		return nil, fmt.Errorf("cid not in manifest: %s", root.String())
+	}
+
+	keys := m.nodeKeys()
+	succ, _ := m.firstOccurrenceLinks()
+	walk := func(seen []bool, from []int) {
+		stack := from
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, c := range succ[i] {
+				if !seen[c] {
+					seen[c] = true
+					stack = append(stack, c)
+				}
+			}
+		}
+	}
+
+	// nodes still referenced once root is gone
+	kept := make([]bool, len(m.Nodes))
+	kept[start] = true
+	var from []int
+	for _, r := range m.roots() {
+		if r = idx[keys[r]]; !kept[r] {
+			kept[r] = true
+			from = append(from, r)
+		}
+	}
+	walk(kept, from)
+	kept[start] = false
+
+	sub := make([]bool, len(m.Nodes))
+	sub[start] = true
+	walk(sub, []int{start})
+
+	var freed []int
+	for i := range m.Nodes {
+		if sub[i] && !kept[i] {
+			freed = append(freed, i)
+		}
+	}
+	return m.cidsAt(freed)
+}
+
+// Neighborhood builds a manifest of the nodes within hops links of center,
+// following links in either direction, so it holds ancestors as well as
+// descendants. Links between those nodes are kept
+func (m *Manifest) Neighborhood(center *cid.Cid, hops int) (*Manifest, error) {
+	start := m.IndexOf(center)
+	if start < 0 {
+		return nil, fmt.Errorf("cid not in manifest: %s", center.String())
+	}
+
+	adj := make([][]int, len(m.Nodes))
+	for _, l := range m.Links {
+		adj[l[0]] = append(adj[l[0]], l[1])
+		adj[l[1]] = append(adj[l[1]], l[0])
+	}
+	keep := make([]bool, len(m.Nodes))
+	keep[start] = true
+	level := []int{start}
+	for hop := 0; hop < hops && len(level) > 0; hop++ {
+		var next []int
+		for _, idx := range level {
+			for _, n := range adj[idx] {
+				if !keep[n] {
+					keep[n] = true
+					next = append(next, n)
+				}
+			}
+		}
+		level = next
+	}
+	return m.subManifest(keep), nil
+}
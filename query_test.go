@@ -0,0 +1,385 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestReachable(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root, leaf := g[0].Cid(), g[len(g)-1].Cid()
+	ok, err := mf.Reachable(root, leaf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !ok {
+		t.Error("expected leaf to be reachable from root")
+	}
+
+	ok, err = mf.Reachable(leaf, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok {
+		t.Error("expected root to be unreachable from leaf")
+	}
+
+	if _, err := mf.Reachable(root, newNode(kb).Cid()); err == nil {
+		t.Error("expected error for cid not in manifest")
+	}
+}
+
+func TestPathTo(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root := g[0].(*node)
+	expect := []*node{root, root.links[1], root.links[1].links[2], root.links[1].links[2].links[3]}
+	path, err := mf.PathTo(expect[3].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(path) != len(expect) {
+		t.Fatalf("expected path of length %d, got: %d", len(expect), len(path))
+	}
+	for i, n := range expect {
+		if !path[i].Equals(n.Cid()) {
+			t.Errorf("path mismatch at %d. expected: %s, got: %s", i, n.Cid().String(), path[i].String())
+		}
+	}
+}
+
+func TestInclusionPath(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root := g[0].(*node)
+	leaf := root.links[0].links[1].links[2]
+	path, err := mf.InclusionPath(leaf.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "inclusion path", path, root.Cid(), root.links[0].Cid(), root.links[0].links[1].Cid(), leaf.Cid())
+
+	// check the proof against fetched blocks
+	for i := 0; i < len(path)-1; i++ {
+		node, err := ng.Get(context.Background(), path[i])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		linked := false
+		for _, l := range node.Links() {
+			linked = linked || l.Cid.Equals(path[i+1])
+		}
+		if !linked {
+			t.Errorf("expected %s to link to %s", path[i], path[i+1])
+		}
+	}
+
+	if _, err := mf.InclusionPath(newNode(kb).Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{1, 256 * kb},
+	})
+	a, b, leaf := g[1], g[2], g[3]
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := mf.Explain(leaf.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.Parents) != 2 || !res.Parents[0].Equals(a.Cid()) || !res.Parents[1].Equals(b.Cid()) {
+		t.Errorf("expected parents %s & %s, got: %v", a.Cid().String(), b.Cid().String(), res.Parents)
+	}
+	if res.RefCount != 2 {
+		t.Errorf("expected refcount of 2, got: %d", res.RefCount)
+	}
+	if res.Depth != 2 {
+		t.Errorf("expected depth of 2, got: %d", res.Depth)
+	}
+	if len(res.Path) != 3 || !res.Path[0].Equals(g[0].Cid()) || !res.Path[2].Equals(leaf.Cid()) {
+		t.Errorf("expected path from root to leaf, got: %v", res.Path)
+	}
+
+	if _, err := mf.Explain(newNode(kb).Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestOrderedChildren(t *testing.T) {
+	leaves := []*node{newNode(kb), newNode(kb), newNode(kb), newNode(kb)}
+	dir := newNode(4 * kb)
+	// link order differs from both creation & cid order, with a nested subtree
+	// walked between links
+	sub := newNode(kb)
+	sub.links = []*node{leaves[0]}
+	dir.links = []*node{leaves[2], sub, leaves[3], leaves[1], leaves[0]}
+
+	ng := TestNodeGetter{[]format.Node{dir, sub, leaves[0], leaves[1], leaves[2], leaves[3]}}
+	mf, err := NewManifest(context.Background(), ng, dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, err := mf.OrderedChildren(dir.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "OrderedChildren", got, leaves[2].Cid(), sub.Cid(), leaves[3].Cid(), leaves[1].Cid(), leaves[0].Cid())
+
+	if _, err := mf.OrderedChildren(newNode(kb).Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestLowestCommonAncestor(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root := g[0].(*node)
+	mid := root.links[1].links[2]
+	lca, err := mf.LowestCommonAncestor(mid.links[0].Cid(), mid.links[3].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !lca.Equals(mid.Cid()) {
+		t.Errorf("expected lca to be the shared mid-node, got: %s", lca)
+	}
+
+	lca, err = mf.LowestCommonAncestor(mid.links[0].Cid(), root.links[0].links[0].links[0].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !lca.Equals(root.Cid()) {
+		t.Errorf("expected leaves under different subtrees to meet at the root, got: %s", lca)
+	}
+
+	if lca, err := mf.LowestCommonAncestor(mid.Cid(), mid.links[1].Cid()); err != nil || !lca.Equals(mid.Cid()) {
+		t.Errorf("expected a node to be its own ancestor, got: %v, %v", lca, err)
+	}
+	if _, err := mf.LowestCommonAncestor(newNode(kb).Cid(), mid.Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+
+	// two separate roots share no ancestor
+	other := newNode(kb)
+	mf.Nodes = append(mf.Nodes, other.Cid().String())
+	mf.Sizes = append(mf.Sizes, kb)
+	if _, err := mf.LowestCommonAncestor(other.Cid(), mid.Cid()); err == nil {
+		t.Error("expected no common ancestor to error")
+	}
+}
+
+func TestDominators(t *testing.T) {
+	// root -> a, b -> c -> d, e -> f: every path below c goes through it
+	root, a, b, c := newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	d, e, f := newNode(kb), newNode(kb), newNode(kb)
+	root.links = []*node{a, b}
+	a.links = []*node{c}
+	b.links = []*node{c}
+	c.links = []*node{d, e}
+	d.links = []*node{f}
+	e.links = []*node{f}
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, b, c, d, e, f}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	doms, err := mf.Dominators(root.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := map[*node]*node{a: root, b: root, c: root, d: c, e: c, f: c}
+	if len(doms) != len(expect) {
+		t.Errorf("expected %d dominators, got: %d", len(expect), len(doms))
+	}
+	for n, dom := range expect {
+		if got := doms[n.Cid().String()]; got == nil || !got.Equals(dom.Cid()) {
+			t.Errorf("expected %s to be dominated by %s, got: %v", n.Cid(), dom.Cid(), got)
+		}
+	}
+
+	// from c only its subtree is reachable
+	doms, err = mf.Dominators(c.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(doms) != 3 || !doms[f.Cid().String()].Equals(c.Cid()) {
+		t.Errorf("expected c's subtree of 3 nodes to be dominated by c, got: %v", doms)
+	}
+
+	if _, err := mf.Dominators(newNode(kb).Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestBlocksFreedByDeleting(t *testing.T) {
+	// diamond: root -> a, b -> shared, with a -> only
+	root, a, b, shared, only := newNode(kb), newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	root.links = []*node{a, b}
+	a.links = []*node{shared, only}
+	b.links = []*node{shared}
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, b, shared, only}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	freed, err := mf.BlocksFreedByDeleting(a.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := map[string]bool{}
+	for _, id := range freed {
+		got[id.String()] = true
+	}
+	if len(freed) != 2 || !got[a.Cid().String()] || !got[only.Cid().String()] {
+		t.Errorf("expected a & its exclusive child to be freed, got: %v", freed)
+	}
+	if got[shared.Cid().String()] {
+		t.Error("expected shared node not to be freed")
+	}
+
+	freed, err = mf.BlocksFreedByDeleting(root.Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(freed) != len(mf.Nodes) {
+		t.Errorf("expected deleting the root to free every node, got: %d", len(freed))
+	}
+
+	if _, err := mf.BlocksFreedByDeleting(newNode(kb).Cid()); err == nil {
+		t.Error("expected cid not in manifest to error")
+	}
+}
+
+func TestReachabilityClosure(t *testing.T) {
+	// more than 64 nodes, so rows span several words
+	g := NewSharedGraph([]layer{
+		{3, 4 * kb},
+		{5, 5 * kb},
+		{70, 256 * kb},
+	})
+	// plus a subtree reachable only from the root
+	g = append(g, NewGraph([]layer{{2, kb}})...)
+	g[0].(*node).links = append(g[0].(*node).links, g[len(g)-3].(*node))
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r, err := mf.ReachabilityClosure()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, err := mf.CIDs()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range ids {
+		for j := range ids {
+			expect, err := mf.Reachable(ids[i], ids[j])
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if got := r.Reaches(i, j); got != expect {
+				t.Fatalf("expected Reaches(%d, %d) to be %t", i, j, expect)
+			}
+		}
+	}
+	if r.Reaches(0, len(ids)) || r.Reaches(-1, 0) {
+		t.Error("expected out of range indexes not to be reachable")
+	}
+
+	mf.Links = append(mf.Links, [2]int{mf.Links[0][1], mf.Links[0][0]})
+	if _, err := mf.ReachabilityClosure(); err == nil {
+		t.Error("expected a cycle to error")
+	}
+}
+
+func TestNeighborhood(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+		{2, 512 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mid := g[0].(*node).links[1]
+	nb, err := mf.Neighborhood(mid.Cid(), 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, nb)
+	expect := []*node{g[0].(*node), mid}
+	expect = append(expect, mid.links...)
+	if len(nb.Nodes) != len(expect) {
+		t.Errorf("expected %d nodes, got: %d", len(expect), len(nb.Nodes))
+	}
+	for _, n := range expect {
+		if nb.IndexOf(n.Cid()) < 0 {
+			t.Errorf("expected %s in neighborhood", n.Cid().String())
+		}
+	}
+	if len(nb.Links) != len(expect)-1 {
+		t.Errorf("expected %d links, got: %d", len(expect)-1, len(nb.Links))
+	}
+
+	if nb, _ := mf.Neighborhood(mid.Cid(), 0); len(nb.Nodes) != 1 {
+		t.Errorf("expected only the center at 0 hops, got %d nodes", len(nb.Nodes))
+	}
+	if nb, _ := mf.Neighborhood(mid.Cid(), 10); !nb.Equal(mf) {
+		t.Error("expected the whole manifest within 10 hops")
+	}
+	if _, err := mf.Neighborhood(newNode(kb).Cid(), 1); err == nil {
+		t.Error("expected absent center to error")
+	}
+}
@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// RemapCIDs rewrites every node cid in the manifest through f. Nodes that f
+// maps to the same cid are merged into a single node that has the links of
+// all merged nodes, keeping the size of the first. Links between merged nodes
+// would become self-loops, so they're dropped & counted in DroppedLinks. If f
+// returns an error the remap is aborted & the manifest is left unchanged
+func (m *Manifest) RemapCIDs(f func(*cid.Cid) (*cid.Cid, error)) error {
+	if m.frozen {
+		return ErrFrozen
+	}
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if ids[i], err = f(id); err != nil {
+			return err
+		}
+	}
+
+	res := &Manifest{
+		Version:         m.Version,
+		DroppedLinks:    m.DroppedLinks,
+		DroppedPerLevel: m.DroppedPerLevel,
+		CreatedAt:       m.CreatedAt,
+	}
+	remap := make([]int, len(ids))
+	idx := map[string]int{}
+	for i, id := range ids {
+		j, ok := idx[id.KeyString()]
+		if !ok {
+			j = len(res.Nodes)
+			idx[id.KeyString()] = j
+			res.Nodes = append(res.Nodes, id.String())
+			res.Sizes = append(res.Sizes, m.Sizes[i])
+			if m.Blocks != nil {
+				res.Blocks = append(res.Blocks, m.Blocks[i])
+			}
+			if m.StoredSizes != nil {
+				res.StoredSizes = append(res.StoredSizes, m.StoredSizes[i])
+			}
+			if m.VisitOrder != nil {
+				res.VisitOrder = append(res.VisitOrder, m.VisitOrder[i])
+			}
+			if m.FetchDurations != nil {
+				res.FetchDurations = append(res.FetchDurations, m.FetchDurations[i])
+			}
+			if m.LeafCounts != nil {
+				res.LeafCounts = append(res.LeafCounts, m.LeafCounts[i])
+			}
+			if m.DroppedLinkCounts != nil {
+				res.DroppedLinkCounts = append(res.DroppedLinkCounts, m.DroppedLinkCounts[i])
+			}
+		}
+		remap[i] = j
+	}
+
+	links := map[[2]int]bool{}
+	for _, l := range m.Links {
+		rl := [2]int{remap[l[0]], remap[l[1]]}
+		if rl[0] == rl[1] {
+			res.DroppedLinks++
+			continue
+		}
+		if !links[rl] {
+			links[rl] = true
+			res.Links = append(res.Links, rl)
+		}
+	}
+	weak := map[[2]int]bool{}
+	for _, l := range m.WeakLinks {
+		rl := [2]int{remap[l[0]], remap[l[1]]}
+		if rl[0] == rl[1] {
+			res.DroppedLinks++
+			continue
+		}
+		if !weak[rl] {
+			weak[rl] = true
+			res.WeakLinks = append(res.WeakLinks, rl)
+		}
+	}
+	resSets := res.indexSets()
+	for i, set := range m.indexSets() {
+		*resSets[i] = appendIndexSet(nil, remapIndexes(*set, remap))
+	}
+
+	m.replace(res)
+	return nil
+}
+
+// allIndexes lists index positions 0 through n-1
+func allIndexes(n int) []int {
+	idxs := make([]int, n)
+	for i := range idxs {
+		idxs[i] = i
+	}
+	return idxs
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestRemapCIDs(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	orig := mf.Copy()
+
+	toV0 := func(c *cid.Cid) (*cid.Cid, error) { return cid.NewCidV0(c.Hash()), nil }
+	toV1 := func(c *cid.Cid) (*cid.Cid, error) { return cid.NewCidV1(cid.Raw, c.Hash()), nil }
+
+	if err := mf.RemapCIDs(toV0); err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if mf.Equal(orig) {
+		t.Error("expected v0 manifest to differ from original")
+	}
+	if len(mf.Links) != len(orig.Links) {
+		t.Errorf("expected %d links, got: %d", len(orig.Links), len(mf.Links))
+	}
+
+	if err := mf.RemapCIDs(toV1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !mf.Equal(orig) {
+		t.Error("expected v1 remapped manifest to equal original")
+	}
+
+	before := mf.Copy()
+	calls := 0
+	err = mf.RemapCIDs(func(c *cid.Cid) (*cid.Cid, error) {
+		if calls++; calls == 5 {
+			return nil, fmt.Errorf("nope")
+		}
+		return cid.NewCidV0(c.Hash()), nil
+	})
+	if err == nil {
+		t.Error("expected remap error to be returned")
+	}
+	if !mf.Equal(before) {
+		t.Error("expected failed remap to leave manifest unchanged")
+	}
+}
+
+func TestRemapCIDsMerge(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	a, b := root.links[0], root.links[1]
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// merge b into a
+	err = mf.RemapCIDs(func(c *cid.Cid) (*cid.Cid, error) {
+		if c.Equals(b.Cid()) {
+			return a.Cid(), nil
+		}
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	if len(mf.Nodes) != len(g)-1 {
+		t.Errorf("expected %d nodes, got: %d", len(g)-1, len(mf.Nodes))
+	}
+	idx := mf.IndexOf(a.Cid())
+	if children := mf.children()[idx]; len(children) != 6 {
+		t.Errorf("expected merged node to have 6 children, got: %d", len(children))
+	}
+}
+
+func TestRemapCIDsSelfLoop(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+	})
+	root := g[0].(*node)
+	a := root.links[0]
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.WeakLinks = [][2]int{{mf.IndexOf(root.Cid()), mf.IndexOf(a.Cid())}}
+
+	// merge a into root
+	err = mf.RemapCIDs(func(c *cid.Cid) (*cid.Cid, error) {
+		if c.Equals(a.Cid()) {
+			return root.Cid(), nil
+		}
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+
+	for _, l := range append(mf.Links, mf.WeakLinks...) {
+		if l[0] == l[1] {
+			t.Errorf("expected no self-loops, got: %v", l)
+		}
+	}
+	if len(mf.Links) != 1 || len(mf.WeakLinks) != 0 {
+		t.Errorf("expected 1 link & no weak links, got: %d & %d", len(mf.Links), len(mf.WeakLinks))
+	}
+	if mf.DroppedLinks != 2 {
+		t.Errorf("expected 2 dropped links, got: %d", mf.DroppedLinks)
+	}
+}
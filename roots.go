@@ -0,0 +1,194 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// AddRoot marks a node in the manifest as a root
+func (m *Manifest) AddRoot(id *cid.Cid) error {
+	if m.frozen {
+		return ErrFrozen
+	}
+	idx := m.IndexOf(id)
+	if idx < 0 {
+		return fmt.Errorf("cid not in manifest: %s", id.String())
+	}
+	m.MarkedRoots = appendIndexSet(m.MarkedRoots, []int{idx})
+	return nil
+}
+
+// AssertRoot checks that expected is in the manifest & that no other node
+// links to it
+func (m *Manifest) AssertRoot(expected *cid.Cid) error {
+	idx := m.IndexOf(expected)
+	if idx < 0 {
+		return fmt.Errorf("cid not in manifest: %s", expected.String())
+	}
+	parents := 0
+	for _, l := range m.Links {
+		if l[1] == idx {
+			parents++
+		}
+	}
+	if parents > 0 {
+		return fmt.Errorf("cid is not a root: %s is linked to by %d nodes", expected.String(), parents)
+	}
+	return nil
+}
+
+// Roots lists all roots of the manifest: nodes marked as roots & nodes that no
+// other node links to
+func (m *Manifest) Roots() ([]*cid.Cid, error) {
+	return m.cidsAt(m.sortedRoots())
+}
+
+// MinimalRoots lists the smallest set of roots every node can be reached from,
+// dropping roots that can be reached from another root. Of roots that reach
+// each other through a cycle only the first, in Roots order, is kept
+func (m *Manifest) MinimalRoots() ([]*cid.Cid, error) {
+	roots := m.sortedRoots()
+
+	// a root is subsumed by any other root that reaches it by following at
+	// least one link, unless it reaches that root back, in which case the
+	// first of the two in Roots order subsumes the other
+	ch := m.children()
+	pos := make(map[int]int, len(roots))
+	for i, r := range roots {
+		pos[r] = i
+	}
+	reaches := make([]map[int]bool, len(roots))
+	for i, r := range roots {
+		reaches[i] = map[int]bool{}
+		seen := make([]bool, len(m.Nodes))
+		queue := append([]int(nil), ch[r]...)
+		for len(queue) > 0 {
+			idx := queue[0]
+			queue = queue[1:]
+			if seen[idx] {
+				continue
+			}
+			seen[idx] = true
+			if j, ok := pos[idx]; ok && j != i {
+				reaches[i][j] = true
+			}
+			queue = append(queue, ch[idx]...)
+		}
+	}
+	kept := make([]bool, len(m.Nodes))
+	for i, r := range roots {
+		kept[r] = true
+		for j := range roots {
+			if reaches[j][i] && (!reaches[i][j] || j < i) {
+				kept[r] = false
+				break
+			}
+		}
+	}
+
+	var minimal []int
+	for _, r := range roots {
+		if kept[r] {
+			minimal = append(minimal, r)
+		}
+	}
+	return m.cidsAt(minimal)
+}
+
+// Leaves lists all nodes that don't link to any other node, in index order
+func (m *Manifest) Leaves() ([]*cid.Cid, error) {
+	return m.cidsAt(m.leaves())
+}
+
+// RefCounts maps each node's cid string to the number of links pointing to it.
+// Roots have a count of 0. Links to any copy of a duplicate node are counted
+// under its first cid string
+func (m *Manifest) RefCounts() map[string]int {
+	counts := m.refCounts()
+	res := make(map[string]int, len(counts))
+	for key, i := range m.index() {
+		res[m.Nodes[i]] = counts[key]
+	}
+	return res
+}
+
+// sortedRoots returns the index positions of all roots, ordered by cid string
+// so roots come out the same no matter how the manifest ordered its nodes.
+// Every method that returns roots should use this order
+func (m *Manifest) sortedRoots() []int {
+	idxs := appendIndexSet(m.roots(), m.MarkedRoots)
+	sort.Slice(idxs, func(i, j int) bool {
+		a, b := idxs[i], idxs[j]
+		if m.Nodes[a] != m.Nodes[b] {
+			return m.Nodes[a] < m.Nodes[b]
+		}
+		return a < b
+	})
+	return idxs
+}
+
+// SharedRootKey is the RootExclusivity bucket for nodes reachable from more
+// than one root
+const SharedRootKey = "shared"
+
+// RootExclusivity maps each root cid string to the nodes reachable only from
+// that root, including the root itself. Nodes reachable from more than one
+// root are listed under SharedRootKey. The exclusive nodes of a root are what
+// dropping that root would free
+func (m *Manifest) RootExclusivity() (map[string][]*cid.Cid, error) {
+	roots := m.sortedRoots()
+	ch := m.children()
+
+	// owner is the index into roots of the only root that reaches a node, -1 if
+	// none has yet & -2 if more than one does
+	owner := make([]int, len(m.Nodes))
+	for i := range owner {
+		owner[i] = -1
+	}
+	for r, root := range roots {
+		seen := map[int]bool{}
+		queue := []int{root}
+		for len(queue) > 0 {
+			idx := queue[0]
+			queue = queue[1:]
+			if seen[idx] {
+				continue
+			}
+			seen[idx] = true
+			if owner[idx] == -1 {
+				owner[idx] = r
+			} else {
+				owner[idx] = -2
+			}
+			queue = append(queue, ch[idx]...)
+		}
+	}
+
+	buckets := make([][]int, len(roots))
+	var shared []int
+	for idx, o := range owner {
+		switch {
+		case o >= 0:
+			buckets[o] = append(buckets[o], idx)
+		case o == -2:
+			shared = append(shared, idx)
+		}
+	}
+
+	res := map[string][]*cid.Cid{}
+	for r, root := range roots {
+		ids, err := m.cidsAt(buckets[r])
+		if err != nil {
+			return nil, err
+		}
+		res[m.Nodes[root]] = ids
+	}
+	ids, err := m.cidsAt(shared)
+	if err != nil {
+		return nil, err
+	}
+	res[SharedRootKey] = ids
+	return res, nil
+}
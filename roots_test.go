@@ -0,0 +1,248 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multibase"
+)
+
+func TestMinimalRoots(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	a := g[0].(*node)
+	b := a.links[1]
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mf.AddRoot(b.Cid()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := mf.AddRoot(newNode(kb).Cid()); err == nil {
+		t.Error("expected marking a cid not in the manifest as a root to error")
+	}
+
+	roots, err := mf.Roots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(roots) != 2 {
+		t.Errorf("expected 2 roots, got: %d", len(roots))
+	}
+
+	minimal, err := mf.MinimalRoots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(minimal) != 1 || !minimal[0].Equals(a.Cid()) {
+		t.Errorf("expected minimal roots to be only %s, got: %v", a.Cid().String(), minimal)
+	}
+}
+
+func TestMinimalRootsCycle(t *testing.T) {
+	ids := []string{newNode(kb).Cid().String(), newNode(kb).Cid().String(), newNode(kb).Cid().String()}
+	sort.Strings(ids)
+	// the last two nodes link to each other
+	mf := &Manifest{Nodes: ids, Sizes: []uint64{kb, kb, kb}, Links: [][2]int{{1, 2}, {2, 1}}, MarkedRoots: []int{2, 1}}
+
+	minimal, err := mf.MinimalRoots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(minimal) != 2 || minimal[0].String() != ids[0] || minimal[1].String() != ids[1] {
+		t.Errorf("expected one root kept from the cycle, got: %v", minimal)
+	}
+
+	// a root linking into the cycle subsumes it
+	mf.Links = append(mf.Links, [2]int{0, 2})
+	minimal, err = mf.MinimalRoots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(minimal) != 1 || minimal[0].String() != ids[0] {
+		t.Errorf("expected only %s, got: %v", ids[0], minimal)
+	}
+
+	// a later root reaching an earlier one back through the cycle subsumes it
+	mf.Links = [][2]int{{0, 1}, {1, 0}, {2, 1}}
+	mf.MarkedRoots = []int{0}
+	mf.Invalidate()
+	minimal, err = mf.MinimalRoots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(minimal) != 1 || minimal[0].String() != ids[2] {
+		t.Errorf("expected only %s, got: %v", ids[2], minimal)
+	}
+}
+
+func TestRootExclusivity(t *testing.T) {
+	shared := newNode(4 * kb)
+	shared.links = []*node{newNode(256 * kb), newNode(256 * kb)}
+	onlyA, onlyB := newNode(kb), newNode(2*kb)
+	a, b := newNode(kb), newNode(kb)
+	a.links = []*node{shared, onlyA}
+	b.links = []*node{onlyB, shared}
+
+	ng := TestNodeGetter{[]format.Node{a, b, shared, shared.links[0], shared.links[1], onlyA, onlyB}}
+	mfA, err := NewManifest(context.Background(), ng, a)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mfB, err := NewManifest(context.Background(), ng, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf := Union(mfA, mfB)
+
+	ex, err := mf.RootExclusivity()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[string][]*node{
+		a.Cid().String(): {a, onlyA},
+		b.Cid().String(): {b, onlyB},
+		SharedRootKey:    {shared, shared.links[0], shared.links[1]},
+	}
+	if len(ex) != len(expect) {
+		t.Errorf("expected %d buckets, got: %d", len(expect), len(ex))
+	}
+	for key, nodes := range expect {
+		got := ex[key]
+		if len(got) != len(nodes) {
+			t.Errorf("%s: expected %d cids, got: %d", key, len(nodes), len(got))
+			continue
+		}
+		for _, n := range nodes {
+			found := false
+			for _, id := range got {
+				found = found || id.Equals(n.Cid())
+			}
+			if !found {
+				t.Errorf("%s: expected bucket to contain %s", key, n.Cid().String())
+			}
+		}
+	}
+}
+
+func TestRootsSorted(t *testing.T) {
+	var mfs []*Manifest
+	for i := 0; i < 4; i++ {
+		g := NewGraph([]layer{
+			{2, 4 * kb},
+		})
+		mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mfs = append(mfs, mf)
+	}
+
+	a := Union(mfs...)
+	b := Union(mfs[3], mfs[1], mfs[0], mfs[2])
+	rootsA, err := a.Roots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootsB, err := b.Roots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rootsA) != 4 || len(rootsA) != len(rootsB) {
+		t.Fatalf("expected 4 roots, got: %d, %d", len(rootsA), len(rootsB))
+	}
+	for i := range rootsA {
+		if !rootsA[i].Equals(rootsB[i]) {
+			t.Errorf("root %d mismatch: %s != %s", i, rootsA[i], rootsB[i])
+		}
+		if i > 0 && rootsA[i-1].String() > rootsA[i].String() {
+			t.Errorf("expected roots to be sorted by cid string")
+		}
+	}
+
+	minA, err := a.MinimalRoots()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range minA {
+		if !minA[i].Equals(rootsA[i]) {
+			t.Errorf("expected minimal roots in the same order as roots")
+		}
+	}
+}
+
+func TestAssertRoot(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := mf.AssertRoot(root.Cid()); err != nil {
+		t.Errorf("expected root to pass, got: %s", err.Error())
+	}
+
+	absent := newNode(kb).Cid()
+	expect := "cid not in manifest: " + absent.String()
+	if err := mf.AssertRoot(absent); err == nil || err.Error() != expect {
+		t.Errorf("error mismatch. expected: %q, got: %v", expect, err)
+	}
+
+	child := root.links[1].Cid()
+	expect = "cid is not a root: " + child.String() + " is linked to by 1 nodes"
+	if err := mf.AssertRoot(child); err == nil || err.Error() != expect {
+		t.Errorf("error mismatch. expected: %q, got: %v", expect, err)
+	}
+}
+
+func TestLeavesAndRefCounts(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	leaves, err := mf.Leaves()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "leaves", leaves, g[3].Cid(), g[4].Cid(), g[5].Cid())
+
+	counts := mf.RefCounts()
+	if len(counts) != 6 || counts[g[0].Cid().String()] != 0 || counts[g[1].Cid().String()] != 1 || counts[g[4].Cid().String()] != 2 {
+		t.Errorf("unexpected ref counts: %v", counts)
+	}
+	counts[g[0].Cid().String()] = 10
+	if mf.RefCounts()[g[0].Cid().String()] != 0 {
+		t.Error("expected modifying returned ref counts not to change the manifest's")
+	}
+
+	// links to either encoding of one cid count under the first
+	leaf := newNode(kb)
+	b32, err := leaf.Cid().StringOfBase(multibase.Base32)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b58 := leaf.Cid().String()
+	mf = &Manifest{
+		Nodes: []string{newNode(kb).Cid().String(), b58, b32},
+		Sizes: []uint64{kb, kb, kb},
+		Links: [][2]int{{0, 1}, {0, 2}},
+	}
+	if counts := mf.RefCounts(); len(counts) != 2 || counts[b58] != 2 {
+		t.Errorf("expected both links counted under %s, got: %v", b58, counts)
+	}
+}
@@ -0,0 +1,267 @@
+package manifest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// FanoutHistogram maps out-degree to the number of nodes with that many
+// children. Leaves are counted under 0
+func (m *Manifest) FanoutHistogram() map[int]int {
+	hist := map[int]int{}
+	for _, ch := range m.children() {
+		hist[len(ch)]++
+	}
+	return hist
+}
+
+// CodecHistogram maps each cid codec to the number of nodes encoded with it
+func (m *Manifest) CodecHistogram() (map[uint64]int, error) {
+	groups, err := m.codecGroups()
+	if err != nil {
+		return nil, err
+	}
+	hist := make(map[uint64]int, len(groups))
+	for codec, idxs := range groups {
+		hist[codec] = len(idxs)
+	}
+	return hist, nil
+}
+
+// CodecByteTotals maps each cid codec to the total size of the nodes encoded
+// with it, eg: to tell dag-pb structure apart from raw leaf data. Totals
+// saturate to math.MaxUint64 on overflow
+func (m *Manifest) CodecByteTotals() (map[uint64]uint64, error) {
+	groups, err := m.codecGroups()
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[uint64]uint64, len(groups))
+	for codec, idxs := range groups {
+		sizes := make([]uint64, len(idxs))
+		for i, idx := range idxs {
+			sizes[i] = m.Sizes[idx]
+		}
+		totals[codec], _ = sumSizes(sizes)
+	}
+	return totals, nil
+}
+
+// LeafShape is the size & cid codec of a leaf node. Leaves with the same shape
+// are likely chunks cut the same way
+type LeafShape struct {
+	Size  uint64
+	Codec uint64
+}
+
+// LeafShapeHistogram maps each leaf shape to the number of leaves with it,
+// revealing how uniformly content was chunked. Only nodes that don't link to
+// any other node are counted
+func (m *Manifest) LeafShapeHistogram() (map[LeafShape]int, error) {
+	hist := map[LeafShape]int{}
+	for _, i := range m.leaves() {
+		id, err := cid.Decode(m.Nodes[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+		hist[LeafShape{Size: m.Sizes[i], Codec: id.Type()}]++
+	}
+	return hist, nil
+}
+
+// codecGroups maps each cid codec to the index positions of nodes using it
+func (m *Manifest) codecGroups() (map[uint64][]int, error) {
+	groups := map[uint64][]int{}
+	for i, str := range m.Nodes {
+		id, err := cid.Decode(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+		groups[id.Type()] = append(groups[id.Type()], i)
+	}
+	return groups, nil
+}
+
+// Stats summarizes the shape of a manifest
+type Stats struct {
+	Nodes     int
+	Links     int
+	TotalSize uint64
+	// MaxDepth is the greatest distance from a root to any node
+	MaxDepth int
+	Roots    int
+	Leaves   int
+}
+
+// Stats calculates summary statistics for the manifest
+func (m *Manifest) Stats() Stats {
+	s := Stats{
+		Nodes:     len(m.Nodes),
+		Links:     len(m.Links),
+		TotalSize: m.TotalSize(),
+		Roots:     len(m.sortedRoots()),
+	}
+	for _, d := range m.depths() {
+		if d > s.MaxDepth {
+			s.MaxDepth = d
+		}
+	}
+	for _, ch := range m.children() {
+		if len(ch) == 0 {
+			s.Leaves++
+		}
+	}
+	return s
+}
+
+// Metrics exports manifest stats as a flat map of metric name to value, for
+// translating into any metrics registry
+func (m *Manifest) Metrics() map[string]float64 {
+	s := m.Stats()
+	return map[string]float64{
+		"manifest_nodes":       float64(s.Nodes),
+		"manifest_edges":       float64(s.Links),
+		"manifest_total_bytes": float64(s.TotalSize),
+		"manifest_max_depth":   float64(s.MaxDepth),
+		"manifest_roots":       float64(s.Roots),
+		"manifest_leaves":      float64(s.Leaves),
+	}
+}
+
+// DepthStat is the number & total size of nodes at one depth
+type DepthStat struct {
+	Depth     int
+	NodeCount int
+	ByteTotal uint64
+}
+
+// DepthProfile counts the nodes & bytes at each depth from the roots, eg: for
+// sizing cache tiers. Depths are the shortest distance from a root, nodes that
+// can't be reached from a root aren't counted. Byte totals saturate to
+// math.MaxUint64 on overflow
+func (m *Manifest) DepthProfile() []DepthStat {
+	var sizes [][]uint64
+	for i, d := range m.depths() {
+		if d < 0 {
+			continue
+		}
+		for len(sizes) <= d {
+			sizes = append(sizes, nil)
+		}
+		sizes[d] = append(sizes[d], m.Sizes[i])
+	}
+	profile := make([]DepthStat, len(sizes))
+	for d, s := range sizes {
+		total, _ := sumSizes(s)
+		profile[d] = DepthStat{Depth: d, NodeCount: len(s), ByteTotal: total}
+	}
+	return profile
+}
+
+// ShapeSignature summarizes the structure of the manifest as a fixed length
+// vector, so structurally similar manifests can be found by nearest neighbour
+// search. Content is ignored, two DAGs of the same shape & node sizes have the
+// same signature. Every dimension is between 0 & 1:
+//
+//	0      node count, as log2(nodes+1) / 32
+//	1      mean children of nodes with children, as f / (f+1)
+//	2      max depth, as d / (d+1)
+//	3      fraction of nodes that are leaves
+//	4-7    fraction of nodes in each quarter of the depth range, shallowest first
+//	8-11   fraction of nodes with children that have 1, 2-4, 5-16 & more than 16
+//	12-15  fraction of nodes under 1KiB, under 16KiB, under 256KiB & larger
+//
+// Nodes that can't be reached from a root are left out of the depth quarters
+func (m *Manifest) ShapeSignature() [16]float64 {
+	var sig [16]float64
+	n := len(m.Nodes)
+	if n == 0 {
+		return sig
+	}
+	total := float64(n)
+	sig[0] = math.Min(math.Log2(total+1)/32, 1)
+
+	depths := m.depths()
+	maxDepth := 0
+	for _, d := range depths {
+		if d > maxDepth {
+			maxDepth = d
+		}
+	}
+	sig[2] = float64(maxDepth) / float64(maxDepth+1)
+	for _, d := range depths {
+		if d < 0 {
+			continue
+		}
+		q := 0
+		if maxDepth > 0 {
+			q = d * 4 / (maxDepth + 1)
+		}
+		sig[4+q] += 1 / total
+	}
+
+	parents, links := 0, 0
+	for _, ch := range m.children() {
+		f := len(ch)
+		if f == 0 {
+			sig[3] += 1 / total
+			continue
+		}
+		parents++
+		links += f
+		switch {
+		case f == 1:
+			sig[8]++
+		case f <= 4:
+			sig[9]++
+		case f <= 16:
+			sig[10]++
+		default:
+			sig[11]++
+		}
+	}
+	if parents > 0 {
+		mean := float64(links) / float64(parents)
+		sig[1] = mean / (mean + 1)
+		for i := 8; i < 12; i++ {
+			sig[i] /= float64(parents)
+		}
+	}
+
+	for _, size := range m.Sizes {
+		switch {
+		case size < 1<<10:
+			sig[12] += 1 / total
+		case size < 16<<10:
+			sig[13] += 1 / total
+		case size < 256<<10:
+			sig[14] += 1 / total
+		default:
+			sig[15] += 1 / total
+		}
+	}
+	return sig
+}
+
+// SlowestNodes lists the cids of the n nodes that took longest to fetch,
+// slowest first. It needs a manifest generated with the RecordTimings option,
+// otherwise there are no timings to rank & SlowestNodes returns none
+func (m *Manifest) SlowestNodes(n int) ([]*cid.Cid, error) {
+	if len(m.FetchDurations) != len(m.Nodes) {
+		return nil, nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	idxs := allIndexes(len(m.Nodes))
+	sort.SliceStable(idxs, func(i, j int) bool {
+		return m.FetchDurations[idxs[i]] > m.FetchDurations[idxs[j]]
+	})
+	if n < len(idxs) {
+		idxs = idxs[:n]
+	}
+	return m.cidsAt(idxs)
+}
@@ -0,0 +1,240 @@
+package manifest
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestFanoutHistogram(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := map[int]int{2: 1, 3: 2, 4: 6, 0: 24}
+	if got := mf.FanoutHistogram(); !reflect.DeepEqual(expect, got) {
+		t.Errorf("histogram mismatch. expected: %v, got: %v", expect, got)
+	}
+}
+
+func TestCodecByteTotals(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// recode the intermediate nodes as dag-pb, leaving raw leaves
+	for i, ch := range mf.children() {
+		if len(ch) == 0 {
+			continue
+		}
+		id, err := cid.Decode(mf.Nodes[i])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mf.Nodes[i] = cid.NewCidV1(cid.DagProtobuf, id.Hash()).String()
+	}
+
+	hist, err := mf.CodecHistogram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect := map[uint64]int{cid.DagProtobuf: 3, cid.Raw: 6}; !reflect.DeepEqual(expect, hist) {
+		t.Errorf("histogram mismatch. expected: %v, got: %v", expect, hist)
+	}
+
+	totals, err := mf.CodecByteTotals()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[uint64]uint64{cid.DagProtobuf: 2*kb + 2*4*kb, cid.Raw: 6 * 256 * kb}
+	if !reflect.DeepEqual(expect, totals) {
+		t.Errorf("byte totals mismatch. expected: %v, got: %v", expect, totals)
+	}
+}
+
+func TestLeafShapeHistogram(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hist, err := mf.LeafShapeHistogram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[LeafShape]int{{Size: 256 * kb, Codec: cid.Raw}: 6}
+	if !reflect.DeepEqual(expect, hist) {
+		t.Errorf("histogram mismatch. expected: %v, got: %v", expect, hist)
+	}
+
+	// a differently sized leaf gets its own bucket
+	mf.Sizes[len(mf.Sizes)-1] = kb
+	hist, err = mf.LeafShapeHistogram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(hist) != 2 || hist[LeafShape{Size: 256 * kb, Codec: cid.Raw}] != 5 {
+		t.Errorf("expected 2 buckets, got: %v", hist)
+	}
+}
+
+func TestStats(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := Stats{
+		Nodes:     33,
+		Links:     32,
+		TotalSize: 2*kb + 2*4*kb + 6*5*kb + 24*256*kb,
+		MaxDepth:  3,
+		Roots:     1,
+		Leaves:    24,
+	}
+	if got := mf.Stats(); got != expect {
+		t.Errorf("stats mismatch. expected: %+v, got: %+v", expect, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := map[string]float64{
+		"manifest_nodes":       33,
+		"manifest_edges":       32,
+		"manifest_total_bytes": 2*kb + 2*4*kb + 6*5*kb + 24*256*kb,
+		"manifest_max_depth":   3,
+		"manifest_roots":       1,
+		"manifest_leaves":      24,
+	}
+	if got := mf.Metrics(); !reflect.DeepEqual(expect, got) {
+		t.Errorf("metrics mismatch. expected: %v, got: %v", expect, got)
+	}
+}
+
+func TestDepthProfile(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []DepthStat{
+		{Depth: 0, NodeCount: 1, ByteTotal: 2 * kb},
+		{Depth: 1, NodeCount: 2, ByteTotal: 2 * 4 * kb},
+		{Depth: 2, NodeCount: 6, ByteTotal: 6 * 5 * kb},
+		{Depth: 3, NodeCount: 24, ByteTotal: 24 * 256 * kb},
+	}
+	if got := mf.DepthProfile(); !reflect.DeepEqual(expect, got) {
+		t.Errorf("profile mismatch. expected: %+v, got: %+v", expect, got)
+	}
+}
+
+func TestShapeSignature(t *testing.T) {
+	shape := []layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	}
+	// NewGraph makes new content every call
+	var sigs [][16]float64
+	for _, g := range [][]format.Node{NewGraph(shape), NewGraph(shape), NewGraph([]layer{{30, 4 * kb}})} {
+		mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sigs = append(sigs, mf.ShapeSignature())
+	}
+	distance := func(a, b [16]float64) float64 {
+		d := 0.0
+		for i := range a {
+			d += (a[i] - b[i]) * (a[i] - b[i])
+		}
+		return math.Sqrt(d)
+	}
+
+	for i, v := range sigs[0] {
+		if v < 0 || v > 1 {
+			t.Errorf("expected dimension %d between 0 & 1, got: %f", i, v)
+		}
+	}
+	if d := distance(sigs[0], sigs[1]); d > 1e-9 {
+		t.Errorf("expected same shaped manifests to have close signatures, distance: %f", d)
+	}
+	if d := distance(sigs[0], sigs[2]); d < 0.5 {
+		t.Errorf("expected differently shaped manifests to differ, distance: %f", d)
+	}
+}
+
+func TestSlowestNodes(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	slowest := g[0].(*node).links[0].links[2].Cid()
+	slower := g[0].(*node).links[1].Cid()
+	ng := delayingNodeGetter{TestNodeGetter{g}, map[string]time.Duration{
+		slowest.String(): 30 * time.Millisecond,
+		slower.String():  15 * time.Millisecond,
+	}}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{RecordTimings: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, err := mf.SlowestNodes(2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "SlowestNodes", ids, slowest, slower)
+
+	if ids, _ := mf.SlowestNodes(100); len(ids) != len(mf.Nodes) {
+		t.Errorf("expected every node when n exceeds the node count, got: %d", len(ids))
+	}
+	mf.FetchDurations = nil
+	if ids, _ := mf.SlowestNodes(2); len(ids) != 0 {
+		t.Errorf("expected no nodes without timings, got: %d", len(ids))
+	}
+}
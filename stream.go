@@ -0,0 +1,180 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// NodeRecord describes a single node of a DAG
+type NodeRecord struct {
+	Cid      *cid.Cid
+	Size     uint64
+	Children []*cid.Cid
+}
+
+// StreamManifest walks the DAG under root, emitting a record for each node
+// the first time it's reached instead of building a manifest. Only the set of
+// visited cids is held in memory. Both channels are closed when the walk ends,
+// the error channel receives at most one error if fetching a node fails. Drain
+// records before reading the error, or cancel ctx to stop the walk early
+func StreamManifest(ctx context.Context, ng format.NodeGetter, root *cid.Cid) (<-chan NodeRecord, <-chan error) {
+	records := make(chan NodeRecord)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(records)
+
+		seen := map[string]bool{root.KeyString(): true}
+		stack := []*cid.Cid{root}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			node, err := ng.Get(ctx, id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// like the builder, size errors are recorded as 0
+			size, _ := node.Size()
+
+			rec := NodeRecord{Cid: node.Cid(), Size: size}
+			links := node.Links()
+			for _, l := range links {
+				rec.Children = append(rec.Children, l.Cid)
+			}
+			// push in reverse so links are visited in order
+			for i := len(links) - 1; i >= 0; i-- {
+				if key := links[i].Cid.KeyString(); !seen[key] {
+					seen[key] = true
+					stack = append(stack, links[i].Cid)
+				}
+			}
+
+			select {
+			case records <- rec:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return records, errs
+}
+
+// LogEvent is a "node added" event in a log replayed by ReplayLog
+type LogEvent struct {
+	Cid      string   `json:"cid"`
+	Size     uint64   `json:"size"`
+	Children []string `json:"children,omitempty"`
+}
+
+// ReplayLog rebuilds a manifest from a log of newline-delimited JSON
+// LogEvents. Nodes are added in the order they're logged & children may be
+// logged after their parents. Repeated events for a node are ignored after the
+// first. ReplayLog errors if a child is never logged
+func ReplayLog(r io.Reader) (*Manifest, error) {
+	m := &Manifest{Version: CurrentVersion}
+	idx := map[string]int{}
+	var children [][]string
+
+	dec := json.NewDecoder(r)
+	for {
+		var ev LogEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading log event %d: %s", len(children), err.Error())
+		}
+		id, err := cid.Decode(ev.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cid %q in log: %s", ev.Cid, err.Error())
+		}
+		if _, ok := idx[id.KeyString()]; ok {
+			continue
+		}
+		idx[id.KeyString()] = len(m.Nodes)
+		m.Nodes = append(m.Nodes, ev.Cid)
+		m.Sizes = append(m.Sizes, ev.Size)
+		children = append(children, ev.Children)
+	}
+
+	// children can be forward references, resolve them once every node is in
+	for i, ch := range children {
+		for _, str := range ch {
+			j, ok := idx[cidKey(str)]
+			if !ok {
+				return nil, fmt.Errorf("child %s of %s never appears in log", str, m.Nodes[i])
+			}
+			m.Links = append(m.Links, [2]int{i, j})
+		}
+	}
+	return m, nil
+}
+
+// Page lists up to limit node records starting at offset, with nodes in
+// canonical order. hasMore is true if there are nodes after the page. An
+// offset past the last node gives an empty page
+func (m *Manifest) Page(offset, limit int) (page []NodeRecord, hasMore bool, err error) {
+	if offset < 0 {
+		offset = 0
+	}
+	order := m.canonicalOrder()
+	if offset >= len(order) || limit <= 0 {
+		return nil, offset < len(order), nil
+	}
+	end := offset + limit
+	if end > len(order) || end < offset {
+		end = len(order)
+	}
+
+	ch := m.children()
+	for _, idx := range order[offset:end] {
+		id, err := cid.Decode(m.Nodes[idx])
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid cid at index %d: %s", idx, err.Error())
+		}
+		children := appendIndexSet(nil, ch[idx])
+		sort.Slice(children, func(i, j int) bool { return m.Nodes[children[i]] < m.Nodes[children[j]] })
+		ids, err := m.cidsAt(children)
+		if err != nil {
+			return nil, false, err
+		}
+		page = append(page, NodeRecord{Cid: id, Size: m.Sizes[idx], Children: ids})
+	}
+	return page, end < len(order), nil
+}
+
+// Fold reduces the manifest's nodes to a single value in one pass, calling fn
+// with the value so far & each node in manifest order, starting from init.
+// Nodes are decoded one at a time, nothing is allocated per manifest. Fold
+// errors with the index position of the first node that isn't a valid cid
+func (m *Manifest) Fold(init interface{}, fn func(acc interface{}, idx int, id *cid.Cid, size uint64) interface{}) (interface{}, error) {
+	acc := init
+	for i, str := range m.Nodes {
+		id, err := cid.Decode(str)
+		if err != nil {
+			return acc, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+		acc = fn(acc, i, id, m.Sizes[i])
+	}
+	return acc, nil
+}
+
+// FoldSize reduces node sizes to a single value like Fold, without decoding
+// cids
+func (m *Manifest) FoldSize(init uint64, fn func(acc, size uint64) uint64) uint64 {
+	acc := init
+	for _, size := range m.Sizes {
+		acc = fn(acc, size)
+	}
+	return acc
+}
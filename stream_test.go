@@ -0,0 +1,241 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestStreamManifest(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	records, errs := StreamManifest(context.Background(), ng, g[0].Cid())
+	got := &Manifest{}
+	idx := map[string]int{}
+	var children [][]string
+	for rec := range records {
+		if _, ok := idx[rec.Cid.KeyString()]; ok {
+			t.Errorf("node emitted more than once: %s", rec.Cid.String())
+		}
+		idx[rec.Cid.KeyString()] = len(got.Nodes)
+		got.Nodes = append(got.Nodes, rec.Cid.String())
+		got.Sizes = append(got.Sizes, rec.Size)
+		var ch []string
+		for _, c := range rec.Children {
+			ch = append(ch, c.KeyString())
+		}
+		children = append(children, ch)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for i, ch := range children {
+		for _, key := range ch {
+			got.Links = append(got.Links, [2]int{i, idx[key]})
+		}
+	}
+	if !got.Equal(mf) {
+		t.Error("expected streamed records to reconstruct the manifest")
+	}
+
+	_, errs = StreamManifest(context.Background(), TestNodeGetter{g[1:]}, g[0].Cid())
+	if err := <-errs; err == nil {
+		t.Error("expected missing root to error")
+	}
+}
+
+func TestReplayLog(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// log leaves first so parents refer back & the root refers forward to
+	// nodes logged after it
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	order := append([]int{0}, allIndexes(len(g))[1:]...)
+	for i, j := 1, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	for _, i := range order {
+		ev := LogEvent{Cid: g[i].Cid().String()}
+		ev.Size, _ = g[i].Size()
+		for _, l := range g[i].Links() {
+			ev.Children = append(ev.Children, l.Cid.String())
+		}
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// replayed events are ignored
+	enc.Encode(LogEvent{Cid: g[1].Cid().String(), Size: 1})
+
+	got, err := ReplayLog(buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, got)
+	if !got.Equal(mf) {
+		t.Error("expected replayed log to reconstruct the manifest")
+	}
+
+	missing := newNode(kb)
+	log := `{"cid":"` + g[0].Cid().String() + `","size":1,"children":["` + missing.Cid().String() + `"]}`
+	if _, err := ReplayLog(strings.NewReader(log)); err == nil {
+		t.Error("expected a child that's never logged to error")
+	}
+}
+
+// sizeErrNode is a node that fails to report its size
+type sizeErrNode struct {
+	*node
+}
+
+func (n sizeErrNode) Size() (uint64, error) { return 0, fmt.Errorf("no size") }
+
+func TestStreamManifestSizeError(t *testing.T) {
+	g := NewGraph([]layer{{2, 4 * kb}})
+	g[1] = sizeErrNode{g[1].(*node)}
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	records, errs := StreamManifest(context.Background(), ng, g[0].Cid())
+	sizes := map[string]uint64{}
+	for rec := range records {
+		sizes[rec.Cid.String()] = rec.Size
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected size errors to be ignored, got: %s", err.Error())
+	}
+	if len(sizes) != len(g) {
+		t.Errorf("expected %d records, got: %d", len(g), len(sizes))
+	}
+	for i, id := range mf.Nodes {
+		if sizes[id] != mf.Sizes[i] {
+			t.Errorf("expected streamed size of %s to match the builder's %d, got: %d", id, mf.Sizes[i], sizes[id])
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	canon := mf.Copy()
+	canon.Canonicalize()
+
+	var got []NodeRecord
+	pages := 0
+	for offset, more := 0, true; more; offset += 10 {
+		var page []NodeRecord
+		if page, more, err = mf.Page(offset, 10); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(page) > 10 {
+			t.Errorf("page %d has %d records", pages, len(page))
+		}
+		got = append(got, page...)
+		pages++
+	}
+	if pages != 4 || len(got) != len(mf.Nodes) {
+		t.Fatalf("expected 4 pages covering %d nodes, got: %d pages, %d records", len(mf.Nodes), pages, len(got))
+	}
+	ch := canon.children()
+	for i, rec := range got {
+		if rec.Cid.String() != canon.Nodes[i] || rec.Size != canon.Sizes[i] || len(rec.Children) != len(ch[i]) {
+			t.Errorf("record %d doesn't match canonical node: %+v", i, rec)
+			continue
+		}
+		for j, c := range rec.Children {
+			if c.String() != canon.Nodes[ch[i][j]] {
+				t.Errorf("record %d child %d mismatch", i, j)
+			}
+		}
+	}
+
+	if page, more, err := mf.Page(len(mf.Nodes), 10); err != nil || len(page) != 0 || more {
+		t.Errorf("expected empty last page, got: %d records, more: %t, err: %v", len(page), more, err)
+	}
+	if page, more, _ := mf.Page(len(mf.Nodes)-3, 3); len(page) != 3 || more {
+		t.Errorf("expected exact final page without more, got: %d records, more: %t", len(page), more)
+	}
+
+	// the canonical order is only sorted once for an unchanged manifest
+	if order := mf.canonicalOrder(); &order[0] != &mf.cache.canonical[0] {
+		t.Error("expected canonical order to be cached")
+	}
+	mf.Canonicalize()
+	if mf.cache.canonical != nil {
+		t.Error("expected cached order to be dropped once the manifest changes")
+	}
+	if page, _, _ := mf.Page(0, 1); len(page) != 1 || page[0].Cid.String() != canon.Nodes[0] {
+		t.Error("expected page of the changed manifest to be in canonical order")
+	}
+}
+
+func TestFold(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	next := 0
+	total, err := mf.Fold(uint64(0), func(acc interface{}, idx int, id *cid.Cid, size uint64) interface{} {
+		if idx != next || id.String() != mf.Nodes[idx] {
+			t.Errorf("expected node %d, got: %d %s", next, idx, id)
+		}
+		next++
+		return acc.(uint64) + size
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total.(uint64) != mf.TotalSize() {
+		t.Errorf("expected fold to total %d, got: %d", mf.TotalSize(), total)
+	}
+
+	sum := func(acc, size uint64) uint64 { return acc + size }
+	if got := mf.FoldSize(0, sum); got != mf.TotalSize() {
+		t.Errorf("expected size fold to total %d, got: %d", mf.TotalSize(), got)
+	}
+
+	mf.Nodes[3] = "not a cid"
+	if _, err := mf.Fold(0, func(acc interface{}, _ int, _ *cid.Cid, _ uint64) interface{} { return acc }); err == nil {
+		t.Error("expected invalid cid to error")
+	}
+}
@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// NewManifestTopologyOnly generates a manifest of the DAG under root without
+// asking any node for its size, leaving every size 0. Use it when Size is
+// expensive & sizes can be filled in later with ResolveSizes
+func NewManifestTopologyOnly(ctx context.Context, ng format.NodeGetter, root *cid.Cid) (*Manifest, error) {
+	node, err := ng.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	ms := newMstate(ctx, ng, Options{})
+	ms.skipSizes = true
+	ms.stored = nil
+	return ms.build(node)
+}
+
+// ResolveSizes fills in the size of every node in the manifest using sizer.
+// If sizer errors the manifest is left unchanged
+func (m *Manifest) ResolveSizes(ctx context.Context, sizer func(*cid.Cid) (uint64, error)) error {
+	if m.frozen {
+		return ErrFrozen
+	}
+	ids, err := m.cidsAt(allIndexes(len(m.Nodes)))
+	if err != nil {
+		return err
+	}
+	sizes := make([]uint64, len(ids))
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if sizes[i], err = sizer(id); err != nil {
+			return err
+		}
+	}
+	m.Sizes = sizes
+	return nil
+}
+
+// CollapseChains merges runs of nodes that each have exactly one child into
+// the first node of the run, for a simplified view of the topology. A child is
+// only merged into its parent if it has no other parents. The merged node
+// takes the summed size of the run & the links of its last node. The returned
+// map counts how many nodes each merged node absorbed, by cid string.
+// Embedded blocks are dropped, since merged nodes don't match any one block
+func (m *Manifest) CollapseChains() (*Manifest, map[string]int) {
+	ch := m.children()
+	single := make([]int, len(m.Nodes))
+	parents := make([]map[int]bool, len(m.Nodes))
+	for i, c := range ch {
+		single[i] = onlyChild(c)
+		for _, j := range c {
+			if parents[j] == nil {
+				parents[j] = map[int]bool{}
+			}
+			parents[j][i] = true
+		}
+	}
+	// a node is absorbable if its only parent has it as an only child
+	absorbable := func(i int) bool {
+		for p := range parents[i] {
+			return len(parents[i]) == 1 && single[p] == i
+		}
+		return false
+	}
+
+	res := m.Copy()
+	res.Blocks = nil
+	absorbed := map[string]int{}
+	var drop []int
+	for head := range m.Nodes {
+		if absorbable(head) {
+			continue
+		}
+		for cur := single[head]; cur >= 0 && cur != head && absorbable(cur); cur = single[cur] {
+			res.Sizes[head], _ = sumSizes([]uint64{res.Sizes[head], m.Sizes[cur]})
+			if len(res.StoredSizes) > 0 {
+				res.StoredSizes[head], _ = sumSizes([]uint64{res.StoredSizes[head], m.StoredSizes[cur]})
+			}
+			if len(res.FetchDurations) > 0 {
+				res.FetchDurations[head] += m.FetchDurations[cur]
+			}
+			if len(res.LeafCounts) > 0 {
+				res.LeafCounts[head] += m.LeafCounts[cur]
+			}
+			if len(res.DroppedLinkCounts) > 0 {
+				res.DroppedLinkCounts[head] += m.DroppedLinkCounts[cur]
+			}
+			absorbed[m.Nodes[head]]++
+			drop = append(drop, cur)
+		}
+	}
+	if len(drop) == 0 {
+		return res, absorbed
+	}
+	return res.bypass(drop), absorbed
+}
+
+// onlyChild returns the child a node links to if it links to exactly one
+// node, otherwise -1
+func onlyChild(children []int) int {
+	if len(children) == 0 {
+		return -1
+	}
+	for _, c := range children[1:] {
+		if c != children[0] {
+			return -1
+		}
+	}
+	return children[0]
+}
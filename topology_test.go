@@ -0,0 +1,104 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestNewManifestTopologyOnly(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+	expect, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mf, err := NewManifestTopologyOnly(context.Background(), ng, g[0].Cid())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if mf.TotalSize() != 0 {
+		t.Errorf("expected all sizes to be 0, got total: %d", mf.TotalSize())
+	}
+	if !mf.SameTopology(expect) {
+		t.Error("expected topology to match a full manifest")
+	}
+
+	sizer := func(id *cid.Cid) (uint64, error) {
+		n, err := ng.Get(context.Background(), id)
+		if err != nil {
+			return 0, err
+		}
+		return n.Size()
+	}
+	if err := mf.ResolveSizes(context.Background(), sizer); err != nil {
+		t.Fatal(err.Error())
+	}
+	if mf.TotalSize() != expect.TotalSize() || !mf.Equal(expect) {
+		t.Errorf("expected resolved sizes to total %d, got: %d", expect.TotalSize(), mf.TotalSize())
+	}
+
+	if err := mf.ResolveSizes(context.Background(), func(*cid.Cid) (uint64, error) {
+		return 0, context.Canceled
+	}); err == nil {
+		t.Error("expected sizer error to be returned")
+	}
+	if !mf.Equal(expect) {
+		t.Error("expected failed resolve to leave sizes unchanged")
+	}
+}
+
+func TestCollapseChains(t *testing.T) {
+	// root -> a -> b -> c -> d, with d branching to two leaves & root also
+	// linking to a leaf
+	root, a, b, c, d := newNode(2*kb), newNode(kb), newNode(kb), newNode(kb), newNode(kb)
+	x, y, z := newNode(10*kb), newNode(10*kb), newNode(10*kb)
+	root.links = []*node{a, z}
+	a.links = []*node{b}
+	b.links = []*node{c}
+	c.links = []*node{d}
+	d.links = []*node{x, y}
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{[]format.Node{root, a, b, c, d, x, y, z}}, root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	got, absorbed := mf.CollapseChains()
+	verifyManifest(t, got)
+	if len(got.Nodes) != 5 {
+		t.Errorf("expected chain to collapse to 1 node, leaving 5, got: %d", len(got.Nodes))
+	}
+	if len(absorbed) != 1 || absorbed[a.Cid().String()] != 3 {
+		t.Errorf("expected a to absorb 3 nodes, got: %v", absorbed)
+	}
+	idx := got.IndexOf(a.Cid())
+	if idx < 0 || got.Sizes[idx] != 4*kb {
+		t.Fatal("expected collapsed node to take the size of the whole chain")
+	}
+	expectCids(t, "collapsed children", childCids(t, got, a.Cid()), x.Cid(), y.Cid())
+	if got.TotalSize() != mf.TotalSize() {
+		t.Errorf("expected total size to be unchanged, got: %d", got.TotalSize())
+	}
+	if !got.Contains(root.Cid()) || got.Contains(b.Cid()) || got.Contains(d.Cid()) {
+		t.Error("expected only the chain's later nodes to be dropped")
+	}
+}
+
+func childCids(t *testing.T, m *Manifest, id *cid.Cid) []*cid.Cid {
+	t.Helper()
+	ids, err := m.cidsAt(m.children()[m.IndexOf(id)])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sort.Slice(ids, func(i, j int) bool { return m.IndexOf(ids[i]) < m.IndexOf(ids[j]) })
+	return ids
+}
@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"container/heap"
+	"math/bits"
+)
+
+// TrimStrategy selects the order nodes are dropped in when trimming a manifest
+type TrimStrategy int
+
+const (
+	// TrimDeepestFirst drops the leaves furthest from a root first
+	TrimDeepestFirst TrimStrategy = iota
+	// TrimLargestFirst drops the largest leaves first
+	TrimLargestFirst
+)
+
+// TrimToBudget returns a canonical copy of the manifest with nodes dropped until
+// the total size is at or under maxBytes. Only leaves are dropped. Once all of
+// a node's children are gone it becomes a leaf itself, so whole subtrees are
+// removed together and no orphaned nodes remain
+func (m *Manifest) TrimToBudget(maxBytes uint64, strategy TrimStrategy) *Manifest {
+	keep := make([]bool, len(m.Nodes))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	parents := make([][]int, len(m.Nodes))
+	outDeg := make([]int, len(m.Nodes))
+	for _, l := range m.Links {
+		parents[l[1]] = append(parents[l[1]], l[0])
+		outDeg[l[0]]++
+	}
+
+	th := &trimHeap{m: m, depth: m.depths(), strategy: strategy}
+	for i, d := range outDeg {
+		if d == 0 {
+			th.idxs = append(th.idxs, i)
+		}
+	}
+	heap.Init(th)
+
+	// total can exceed math.MaxUint64, so keep the overflow in hi
+	var hi, total uint64
+	for _, s := range m.Sizes {
+		var carry uint64
+		total, carry = bits.Add64(total, s, 0)
+		hi += carry
+	}
+	for (hi > 0 || total > maxBytes) && th.Len() > 0 {
+		idx := heap.Pop(th).(int)
+		keep[idx] = false
+		var borrow uint64
+		total, borrow = bits.Sub64(total, m.Sizes[idx], 0)
+		hi -= borrow
+		for _, p := range parents[idx] {
+			outDeg[p]--
+			if outDeg[p] == 0 {
+				heap.Push(th, p)
+			}
+		}
+	}
+
+	trimmed := m.subManifest(keep)
+	trimmed.Canonicalize()
+	return trimmed
+}
+
+// trimHeap is a priority queue of leaf indexes, ordered by trim strategy
+type trimHeap struct {
+	m        *Manifest
+	depth    []int
+	strategy TrimStrategy
+	idxs     []int
+}
+
+func (th *trimHeap) Len() int      { return len(th.idxs) }
+func (th *trimHeap) Swap(i, j int) { th.idxs[i], th.idxs[j] = th.idxs[j], th.idxs[i] }
+func (th *trimHeap) Less(i, j int) bool {
+	a, b := th.idxs[i], th.idxs[j]
+	deeper := th.depth[a] > th.depth[b]
+	larger := th.m.Sizes[a] > th.m.Sizes[b]
+
+	if th.strategy == TrimLargestFirst {
+		if th.m.Sizes[a] != th.m.Sizes[b] {
+			return larger
+		}
+		if th.depth[a] != th.depth[b] {
+			return deeper
+		}
+	} else {
+		if th.depth[a] != th.depth[b] {
+			return deeper
+		}
+		if th.m.Sizes[a] != th.m.Sizes[b] {
+			return larger
+		}
+	}
+	return th.m.Nodes[a] < th.m.Nodes[b]
+}
+func (th *trimHeap) Push(x interface{}) { th.idxs = append(th.idxs, x.(int)) }
+func (th *trimHeap) Pop() interface{} {
+	idx := th.idxs[len(th.idxs)-1]
+	th.idxs = th.idxs[:len(th.idxs)-1]
+	return idx
+}
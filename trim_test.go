@@ -0,0 +1,62 @@
+package manifest
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestTrimToBudget(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{20, 5 * kb},
+		{10, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	budget := mf.TotalSize() / 2
+	for _, strategy := range []TrimStrategy{TrimDeepestFirst, TrimLargestFirst} {
+		trimmed := mf.TrimToBudget(budget, strategy)
+		verifyManifest(t, trimmed)
+
+		if trimmed.TotalSize() > budget {
+			t.Errorf("strategy %d: trimmed size %d exceeds budget %d", strategy, trimmed.TotalSize(), budget)
+		}
+		if !trimmed.IsCanonical() {
+			t.Errorf("strategy %d: expected trimmed manifest to be canonical", strategy)
+		}
+		if roots := trimmed.roots(); len(roots) != 1 || trimmed.Nodes[roots[0]] != g[0].Cid().String() {
+			t.Errorf("strategy %d: expected trimmed manifest to have only the original root, got %d roots", strategy, len(roots))
+		}
+	}
+
+	if trimmed := mf.TrimToBudget(mf.TotalSize(), TrimDeepestFirst); !trimmed.Equal(mf) {
+		t.Error("expected manifest within budget to be unchanged")
+	}
+}
+
+func TestTrimToBudgetOverflow(t *testing.T) {
+	g := NewGraph([]layer{{2, 4 * kb}})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := range mf.Sizes {
+		if mf.Nodes[i] != g[0].Cid().String() {
+			mf.Sizes[i] = math.MaxUint64 - 1
+		}
+	}
+
+	// a saturated total would stop after dropping one leaf
+	trimmed := mf.TrimToBudget(math.MaxUint64-1, TrimDeepestFirst)
+	if total, ok := trimmed.TotalSizeChecked(); !ok || total > math.MaxUint64-1 {
+		t.Errorf("expected trimmed manifest within budget, got %d nodes", len(trimmed.Nodes))
+	}
+	if len(trimmed.Nodes) != 1 {
+		t.Errorf("expected only the root to remain, got %d nodes", len(trimmed.Nodes))
+	}
+}
@@ -0,0 +1,532 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// MismatchKind categorizes differences between a manifest & a DAG
+type MismatchKind int
+
+const (
+	// MismatchSize means a node's size differs from the manifest
+	MismatchSize MismatchKind = iota
+	// MismatchLinks means a node links to a different set of nodes than the
+	// manifest records
+	MismatchLinks
+)
+
+// Mismatch describes a node that differs from the manifest that describes it
+type Mismatch struct {
+	Cid  *cid.Cid
+	Kind MismatchKind
+	// Expected & Actual hold the manifest & node sizes of a size mismatch
+	Expected, Actual uint64
+}
+
+// Error implements the error interface
+func (m Mismatch) Error() string {
+	if m.Kind == MismatchSize {
+		return fmt.Sprintf("size mismatch for %s. manifest: %d, node: %d", m.Cid.String(), m.Expected, m.Actual)
+	}
+	return fmt.Sprintf("link mismatch for %s", m.Cid.String())
+}
+
+// VerifyError collects all mismatches found while verifying a manifest
+type VerifyError struct {
+	Mismatches []Mismatch
+}
+
+// Error implements the error interface
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%d mismatches found, first: %s", len(e.Mismatches), e.Mismatches[0].Error())
+}
+
+// CountMismatchError is returned when a manifest doesn't have the node count
+// or total size claimed for it
+type CountMismatchError struct {
+	ExpectedNodes, ActualNodes int
+	ExpectedBytes, ActualBytes uint64
+}
+
+// Error implements the error interface
+func (e CountMismatchError) Error() string {
+	var diffs []string
+	if e.ExpectedNodes != e.ActualNodes {
+		diffs = append(diffs, fmt.Sprintf("nodes. expected: %d, got: %d", e.ExpectedNodes, e.ActualNodes))
+	}
+	if e.ExpectedBytes != e.ActualBytes {
+		diffs = append(diffs, fmt.Sprintf("bytes. expected: %d, got: %d", e.ExpectedBytes, e.ActualBytes))
+	}
+	return "count mismatch for " + strings.Join(diffs, " & ")
+}
+
+// AssertCounts checks the manifest has expectedNodes nodes totalling
+// expectedBytes, eg: to check a producer's claims before trusting the manifest.
+// AssertCounts returns a CountMismatchError if either differs
+func (m *Manifest) AssertCounts(expectedNodes int, expectedBytes uint64) error {
+	e := CountMismatchError{
+		ExpectedNodes: expectedNodes,
+		ActualNodes:   len(m.Nodes),
+		ExpectedBytes: expectedBytes,
+		ActualBytes:   m.TotalSize(),
+	}
+	if e.ExpectedNodes != e.ActualNodes || e.ExpectedBytes != e.ActualBytes {
+		return e
+	}
+	return nil
+}
+
+// CheckReferentialIntegrity lists the distinct cids links point to that the
+// manifest has no node for, in index order. Links refer to nodes by index, so
+// these are the placeholders recorded for nodes that couldn't be fetched.
+// Boundary & external nodes are meant to be left out & aren't listed. An
+// empty list means the manifest covers every node it links to
+func (m *Manifest) CheckReferentialIntegrity() ([]*cid.Cid, error) {
+	exempt := map[int]bool{}
+	for _, set := range [][]int{m.Boundaries, m.External} {
+		for _, i := range set {
+			exempt[i] = true
+		}
+	}
+	absent := map[int]bool{}
+	for _, i := range m.Missing {
+		absent[i] = !exempt[i]
+	}
+
+	linked := map[int]bool{}
+	for _, l := range m.Links {
+		if absent[l[1]] {
+			linked[l[1]] = true
+		}
+	}
+	var idxs []int
+	seen := map[string]bool{}
+	for i, key := range m.nodeKeys() {
+		if linked[i] && !seen[key] {
+			seen[key] = true
+			idxs = append(idxs, i)
+		}
+	}
+	return m.cidsAt(idxs)
+}
+
+// Sizer is an optional interface a NodeGetter can implement to report the size
+// of a node without loading the whole block
+type Sizer interface {
+	Size(ctx context.Context, id *cid.Cid) (uint64, error)
+}
+
+// verifyChecks selects what verification compares
+type verifyChecks struct {
+	sizes, links bool
+}
+
+var checkAll = verifyChecks{sizes: true, links: true}
+
+// Verify fetches every node in the manifest from ng, checking sizes & links
+// match the manifest. Verify returns the first Mismatch found
+func Verify(ctx context.Context, ng format.NodeGetter, m *Manifest) error {
+	mismatches, err := verifyNodes(ctx, ng, m, checkAll, nil, true)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return mismatches[0]
+	}
+	return nil
+}
+
+// VerifySizes checks only that node sizes match the manifest, returning all
+// mismatches as a *VerifyError. If ng implements Sizer, sizes are read with it
+// instead of fetching whole nodes
+func VerifySizes(ctx context.Context, ng format.NodeGetter, m *Manifest) error {
+	mismatches, err := verifyNodes(ctx, ng, m, verifyChecks{sizes: true}, nil, false)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return &VerifyError{mismatches}
+	}
+	return nil
+}
+
+// VerifyStructure checks only that node links match the manifest, returning
+// all mismatches as a *VerifyError. It's the counterpart to VerifySizes, for
+// when sizes are trusted but the topology needs confirming
+func VerifyStructure(ctx context.Context, ng format.NodeGetter, m *Manifest) error {
+	mismatches, err := verifyNodes(ctx, ng, m, verifyChecks{links: true}, nil, false)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return &VerifyError{mismatches}
+	}
+	return nil
+}
+
+// VerifyWithProgress checks every node in the manifest like Verify, calling
+// progress after each node is checked with the number of nodes done & the
+// total number of nodes. Rather than stopping at the first mismatch, all
+// mismatches are returned as a *VerifyError
+func VerifyWithProgress(ctx context.Context, ng format.NodeGetter, m *Manifest, progress func(done, total int)) error {
+	mismatches, err := verifyNodes(ctx, ng, m, checkAll, progress, false)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return &VerifyError{mismatches}
+	}
+	return nil
+}
+
+// VerifyAndCorrect checks every node in the manifest like Verify, overwriting
+// mismatched sizes in m with the sizes of the nodes from ng & returning how
+// many were corrected. Link mismatches aren't corrected, they're returned as a
+// *VerifyError after sizes are fixed
+func VerifyAndCorrect(ctx context.Context, ng format.NodeGetter, m *Manifest) (corrected int, err error) {
+	if m.frozen {
+		return 0, ErrFrozen
+	}
+	mismatches, err := verifyNodes(ctx, ng, m, checkAll, nil, false)
+	actual := map[string]uint64{}
+	var structural []Mismatch
+	for _, mm := range mismatches {
+		if mm.Kind == MismatchSize {
+			actual[mm.Cid.KeyString()] = mm.Actual
+		} else {
+			structural = append(structural, mm)
+		}
+	}
+	// corrections found before a fetch error are still applied
+	for i, key := range m.nodeKeys() {
+		if size, ok := actual[key]; ok && m.Sizes[i] != size {
+			m.Sizes[i] = size
+			corrected++
+		}
+	}
+	if err != nil {
+		return corrected, err
+	}
+	if len(structural) > 0 {
+		return corrected, &VerifyError{structural}
+	}
+	return corrected, nil
+}
+
+// VerifySample checks a random fraction of the nodes in the manifest like
+// Verify, for cheaply spot checking large manifests. The same seed always
+// selects the same nodes. VerifySample returns how many nodes were checked &
+// all mismatches found as a *VerifyError
+func VerifySample(ctx context.Context, ng format.NodeGetter, m *Manifest, fraction float64, seed int64) (checked int, err error) {
+	idxs := sampleIndexes(len(m.Nodes), fraction, seed)
+	mismatches, err := verifyIndexes(ctx, ng, m, idxs, checkAll, nil, false)
+	if err != nil {
+		return len(idxs), err
+	}
+	if len(mismatches) > 0 {
+		return len(idxs), &VerifyError{mismatches}
+	}
+	return len(idxs), nil
+}
+
+// sampleIndexes picks a fraction of the index positions up to n, rounded to
+// the nearest whole node, in ascending order
+func sampleIndexes(n int, fraction float64, seed int64) []int {
+	if fraction > 1 {
+		fraction = 1
+	}
+	k := int(math.Round(float64(n) * fraction))
+	if k <= 0 {
+		return nil
+	}
+	idxs := rand.New(rand.NewSource(seed)).Perm(n)[:k]
+	sort.Ints(idxs)
+	return idxs
+}
+
+// verifyNodes compares each manifest node with the node fetched from ng.
+// Errors fetching nodes abort verification
+func verifyNodes(ctx context.Context, ng format.NodeGetter, m *Manifest, checks verifyChecks, progress func(done, total int), stopEarly bool) ([]Mismatch, error) {
+	return verifyIndexes(ctx, ng, m, allIndexes(len(m.Nodes)), checks, progress, stopEarly)
+}
+
+// verifyIndexes compares the manifest nodes at idxs with the nodes fetched
+// from ng
+func verifyIndexes(ctx context.Context, ng format.NodeGetter, m *Manifest, idxs []int, checks verifyChecks, progress func(done, total int), stopEarly bool) ([]Mismatch, error) {
+	sizer, _ := ng.(Sizer)
+	keys := m.nodeKeys()
+	children := m.linkedTo()
+	boundary := map[int]bool{}
+	for _, b := range m.Boundaries {
+		boundary[b] = true
+	}
+	missing := map[int]bool{}
+	for _, set := range [][]int{m.Missing, m.External} {
+		for _, i := range set {
+			missing[i] = true
+		}
+	}
+
+	var mismatches []Mismatch
+	for done, i := range idxs {
+		str := m.Nodes[i]
+		// placeholders & external nodes have nothing to verify
+		if missing[i] {
+			if progress != nil {
+				progress(done+1, len(idxs))
+			}
+			continue
+		}
+
+		id, err := cid.Decode(str)
+		if err != nil {
+			return mismatches, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+		}
+
+		var node format.Node
+		if checks.links || sizer == nil {
+			if node, err = ng.Get(ctx, id); err != nil {
+				return mismatches, err
+			}
+		}
+
+		if checks.sizes {
+			var size uint64
+			if node != nil {
+				size, _ = node.Size()
+			} else if size, err = sizer.Size(ctx, id); err != nil {
+				return mismatches, err
+			}
+			if size != m.Sizes[i] {
+				mismatches = append(mismatches, Mismatch{Cid: id, Kind: MismatchSize, Expected: m.Sizes[i], Actual: size})
+			}
+		}
+		// boundary nodes are never expanded, so have no recorded links
+		if checks.links && !boundary[i] && !sameLinks(node.Links(), children[i], keys) {
+			mismatches = append(mismatches, Mismatch{Cid: id, Kind: MismatchLinks})
+		}
+
+		if progress != nil {
+			progress(done+1, len(idxs))
+		}
+		if stopEarly && len(mismatches) > 0 {
+			break
+		}
+	}
+	return mismatches, nil
+}
+
+// linkedTo lists the index positions each node links to, through links or
+// weak links, in link order. Live nodes list both kinds in their links
+func (m *Manifest) linkedTo() [][]int {
+	res := make([][]int, len(m.Nodes))
+	for _, links := range [][][2]int{m.Links, m.WeakLinks} {
+		for _, l := range links {
+			res[l[0]] = append(res[l[0]], l[1])
+		}
+	}
+	return res
+}
+
+// sameLinks checks if a set of links points to the same cids as a list of
+// child indexes
+func sameLinks(links []*format.Link, children []int, keys []string) bool {
+	got := map[string]bool{}
+	for _, l := range links {
+		got[l.Cid.KeyString()] = true
+	}
+	expect := map[string]bool{}
+	for _, c := range children {
+		expect[keys[c]] = true
+	}
+	if len(got) != len(expect) {
+		return false
+	}
+	for k := range got {
+		if !expect[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// DriftReport describes how a live DAG has drifted from the manifest that
+// recorded it
+type DriftReport struct {
+	// Added lists nodes reachable in the live DAG that the manifest doesn't
+	// have, in the order they were found
+	Added []*cid.Cid
+	// Removed lists manifest nodes no longer reachable from the roots
+	Removed []*cid.Cid
+	// Mismatches lists nodes in both whose size or links have changed
+	Mismatches []Mismatch
+}
+
+// Drifted reports whether the live DAG differs from the manifest at all
+func (r DriftReport) Drifted() bool {
+	return len(r.Added) > 0 || len(r.Removed) > 0 || len(r.Mismatches) > 0
+}
+
+// QuickFreshnessCheck is a cheap staleness probe to run before a full
+// DriftCheck. It fetches only the manifest's roots with ng, or its marked
+// roots if every node has a parent, checking they still resolve & still link
+// to the same children. Changes deeper in the DAG aren't noticed. Links left
+// out by SkipLeaves or MaxFanoutPerNode are allowed for, up to the root's
+// LeafCounts & DroppedLinkCounts entries. Roots linking past nodes a
+// NodeFilter left out aren't fresh. Roots ng reports as format.ErrNotFound
+// aren't fresh, other errors fetching roots abort the check
+func QuickFreshnessCheck(ctx context.Context, ng format.NodeGetter, m *Manifest) (fresh bool, err error) {
+	roots := m.roots()
+	if len(roots) == 0 {
+		roots = m.MarkedRoots
+	}
+	if len(roots) == 0 {
+		return false, fmt.Errorf("manifest has no roots to check")
+	}
+	keys := m.nodeKeys()
+	skip := map[int]bool{}
+	for _, set := range [][]int{m.Boundaries, m.Missing, m.External} {
+		for _, i := range set {
+			skip[i] = true
+		}
+	}
+	expect := make([]map[string]bool, len(m.Nodes))
+	for _, links := range [][][2]int{m.Links, m.WeakLinks} {
+		for _, l := range links {
+			if expect[l[0]] == nil {
+				expect[l[0]] = map[string]bool{}
+			}
+			expect[l[0]][keys[l[1]]] = true
+		}
+	}
+
+	for _, r := range roots {
+		if skip[r] {
+			continue
+		}
+		id, err := cid.Decode(m.Nodes[r])
+		if err != nil {
+			return false, fmt.Errorf("invalid cid at index %d: %s", r, err.Error())
+		}
+		node, err := ng.Get(ctx, id)
+		if err == format.ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		slack := 0
+		if m.DroppedLinkCounts != nil {
+			slack += m.DroppedLinkCounts[r]
+		}
+		if m.LeafCounts != nil {
+			slack += m.LeafCounts[r]
+		}
+		if !freshLinks(node, expect[r], slack) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// freshLinks checks that node links to every expected cid key, & to at most
+// slack others
+func freshLinks(node format.Node, expect map[string]bool, slack int) bool {
+	found := 0
+	seen := map[string]bool{}
+	for _, l := range node.Links() {
+		key := l.Cid.KeyString()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if expect[key] {
+			found++
+			continue
+		}
+		if slack--; slack < 0 {
+			return false
+		}
+	}
+	return found == len(expect)
+}
+
+// DriftCheck re-walks the DAG from the manifest's roots with ng, comparing
+// each live node against the manifest. New nodes are walked too, so whole
+// subtrees added since the manifest was made are reported. Boundary, missing
+// & external nodes aren't fetched. Errors fetching nodes abort the check
+func DriftCheck(ctx context.Context, ng format.NodeGetter, m *Manifest) (DriftReport, error) {
+	var report DriftReport
+	keys := m.nodeKeys()
+	idx := m.index()
+	children := m.linkedTo()
+	skip := map[int]bool{}
+	for _, set := range [][]int{m.Boundaries, m.Missing, m.External} {
+		for _, i := range set {
+			skip[i] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	var queue []*cid.Cid
+	for _, r := range m.roots() {
+		id, err := cid.Decode(m.Nodes[r])
+		if err != nil {
+			return report, fmt.Errorf("invalid cid at index %d: %s", r, err.Error())
+		}
+		if !seen[keys[r]] {
+			seen[keys[r]] = true
+			queue = append(queue, id)
+		}
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		i, known := idx[id.KeyString()]
+		if known && skip[i] {
+			continue
+		}
+
+		node, err := ng.Get(ctx, id)
+		if err != nil {
+			return report, err
+		}
+		if !known {
+			report.Added = append(report.Added, id)
+		} else {
+			if size, _ := node.Size(); size != m.Sizes[i] {
+				report.Mismatches = append(report.Mismatches, Mismatch{Cid: id, Kind: MismatchSize, Expected: m.Sizes[i], Actual: size})
+			}
+			if !sameLinks(node.Links(), children[i], keys) {
+				report.Mismatches = append(report.Mismatches, Mismatch{Cid: id, Kind: MismatchLinks})
+			}
+		}
+
+		for _, l := range node.Links() {
+			if key := l.Cid.KeyString(); !seen[key] {
+				seen[key] = true
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+
+	for i, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			id, err := cid.Decode(m.Nodes[i])
+			if err != nil {
+				return report, fmt.Errorf("invalid cid at index %d: %s", i, err.Error())
+			}
+			report.Removed = append(report.Removed, id)
+		}
+	}
+	return report, nil
+}
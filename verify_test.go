@@ -0,0 +1,515 @@
+package manifest
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+func TestVerify(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := Verify(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected manifest to verify, got: %s", err.Error())
+	}
+
+	mf.Sizes[3]++
+	err = Verify(context.Background(), ng, mf)
+	if mm, ok := err.(Mismatch); !ok || mm.Kind != MismatchSize || mm.Cid.String() != mf.Nodes[3] {
+		t.Errorf("expected size mismatch for node 3, got: %v", err)
+	}
+
+	mf.Sizes[3]--
+	mf.Links = mf.Links[1:]
+	err = Verify(context.Background(), ng, mf)
+	if mm, ok := err.(Mismatch); !ok || mm.Kind != MismatchLinks {
+		t.Errorf("expected link mismatch, got: %v", err)
+	}
+}
+
+func TestVerifyWithProgress(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tampered := []int{2, 10, 30}
+	for _, i := range tampered {
+		mf.Sizes[i] += kb
+	}
+
+	calls, last := 0, 0
+	err = VerifyWithProgress(context.Background(), ng, mf, func(done, total int) {
+		calls++
+		last = done
+		if total != len(mf.Nodes) {
+			t.Errorf("expected total of %d, got: %d", len(mf.Nodes), total)
+		}
+	})
+	if calls != len(mf.Nodes) || last != len(mf.Nodes) {
+		t.Errorf("expected %d progress calls, got: %d", len(mf.Nodes), calls)
+	}
+
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected *VerifyError, got: %v", err)
+	}
+	if len(verr.Mismatches) != len(tampered) {
+		t.Fatalf("expected %d mismatches, got: %d", len(tampered), len(verr.Mismatches))
+	}
+	for i, mm := range verr.Mismatches {
+		if mm.Cid.String() != mf.Nodes[tampered[i]] || mm.Expected != mm.Actual+kb {
+			t.Errorf("unexpected mismatch: %s", mm.Error())
+		}
+	}
+}
+
+// sizerNodeGetter reports sizes without loading nodes, counting node loads
+type sizerNodeGetter struct {
+	TestNodeGetter
+	loads int
+}
+
+func (ng *sizerNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	ng.loads++
+	return ng.TestNodeGetter.Get(ctx, id)
+}
+
+func (ng *sizerNodeGetter) Size(ctx context.Context, id *cid.Cid) (uint64, error) {
+	node, err := ng.TestNodeGetter.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return node.Size()
+}
+
+func TestVerifySizes(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// size-only verification ignores links
+	mf.Links = mf.Links[1:]
+
+	ng := &sizerNodeGetter{TestNodeGetter: TestNodeGetter{g}}
+	if err := VerifySizes(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected sizes to verify, got: %s", err.Error())
+	}
+	if ng.loads != 0 {
+		t.Errorf("expected sizer to avoid loading nodes, got %d loads", ng.loads)
+	}
+
+	mf.Sizes[5]++
+	err = VerifySizes(context.Background(), ng, mf)
+	if verr, ok := err.(*VerifyError); !ok || len(verr.Mismatches) != 1 || verr.Mismatches[0].Kind != MismatchSize {
+		t.Errorf("expected a single size mismatch, got: %v", err)
+	}
+
+	// fall back to fetching nodes without a sizer
+	if err := VerifySizes(context.Background(), TestNodeGetter{g}, mf); err == nil {
+		t.Error("expected size mismatch without sizer")
+	}
+}
+
+func TestVerifyAndCorrect(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := append([]uint64(nil), mf.Sizes...)
+	for _, i := range []int{0, 4, 17, 32} {
+		mf.Sizes[i] += kb
+	}
+
+	corrected, err := VerifyAndCorrect(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if corrected != 4 {
+		t.Errorf("expected 4 corrections, got: %d", corrected)
+	}
+	if !reflect.DeepEqual(expect, mf.Sizes) {
+		t.Error("expected tampered sizes to be corrected")
+	}
+	if err := Verify(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected corrected manifest to verify, got: %s", err.Error())
+	}
+
+	mf.Sizes[2]++
+	mf.Links = mf.Links[1:]
+	corrected, err = VerifyAndCorrect(context.Background(), ng, mf)
+	if verr, ok := err.(*VerifyError); !ok || len(verr.Mismatches) != 1 || verr.Mismatches[0].Kind != MismatchLinks {
+		t.Errorf("expected link mismatch to be reported, got: %v", err)
+	}
+	if corrected != 1 || mf.Sizes[2] != expect[2] {
+		t.Error("expected size to be corrected alongside link mismatch")
+	}
+}
+
+func TestVerifySample(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 5 * kb},
+		{4, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	checked, err := VerifySample(context.Background(), ng, mf, 0.5, 7)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if checked < 16 || checked > 17 {
+		t.Errorf("expected about half of %d nodes checked, got: %d", len(mf.Nodes), checked)
+	}
+
+	sample := sampleIndexes(len(mf.Nodes), 0.5, 7)
+	if !reflect.DeepEqual(sample, sampleIndexes(len(mf.Nodes), 0.5, 7)) {
+		t.Error("expected the same seed to select the same nodes")
+	}
+	mf.Sizes[sample[3]]++
+	checked, err = VerifySample(context.Background(), ng, mf, 0.5, 7)
+	verr, ok := err.(*VerifyError)
+	if !ok || len(verr.Mismatches) != 1 || verr.Mismatches[0].Cid.String() != mf.Nodes[sample[3]] {
+		t.Errorf("expected mismatch in sampled node to be caught, got: %v", err)
+	}
+	if checked != len(sample) {
+		t.Errorf("expected %d nodes checked, got: %d", len(sample), checked)
+	}
+}
+
+func TestVerifyStructure(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// structure-only verification ignores sizes
+	mf.Sizes[2]++
+	if err := VerifyStructure(context.Background(), ng, mf); err != nil {
+		t.Errorf("expected structure to verify, got: %s", err.Error())
+	}
+
+	// link an existing leaf from a second parent in the live DAG
+	parent := g[0].(*node).links[0]
+	parent.links = append(parent.links, g[0].(*node).links[1].links[0])
+	err = VerifyStructure(context.Background(), ng, mf)
+	verr, ok := err.(*VerifyError)
+	if !ok || len(verr.Mismatches) != 1 || verr.Mismatches[0].Kind != MismatchLinks || !verr.Mismatches[0].Cid.Equals(parent.Cid()) {
+		t.Errorf("expected a single link mismatch for the parent, got: %v", err)
+	}
+}
+
+// notFoundNodeGetter reports every cid it can't find as format.ErrNotFound
+type notFoundNodeGetter struct {
+	TestNodeGetter
+}
+
+func (ng notFoundNodeGetter) Get(ctx context.Context, id *cid.Cid) (format.Node, error) {
+	if node, err := ng.TestNodeGetter.Get(ctx, id); err == nil {
+		return node, nil
+	}
+	return nil, format.ErrNotFound
+}
+
+func TestQuickFreshnessCheck(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := notFoundNodeGetter{TestNodeGetter{g}}
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	fresh, err := QuickFreshnessCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !fresh {
+		t.Error("expected unchanged manifest to be fresh")
+	}
+
+	// changes below the root's children aren't probed
+	mid := g[0].(*node).links[0]
+	mid.links = mid.links[1:]
+	if fresh, _ := QuickFreshnessCheck(context.Background(), ng, mf); !fresh {
+		t.Error("expected changes below the root's children to go unnoticed")
+	}
+
+	root := g[0].(*node)
+	root.links = append(root.links, newNode(kb))
+	fresh, err = QuickFreshnessCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fresh {
+		t.Error("expected a changed root to not be fresh")
+	}
+
+	ng.Nodes = ng.Nodes[1:]
+	fresh, err = QuickFreshnessCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fresh {
+		t.Error("expected a root that no longer resolves to not be fresh")
+	}
+	if _, err := QuickFreshnessCheck(context.Background(), TestNodeGetter{}, mf); err == nil {
+		t.Error("expected other fetch errors to abort")
+	}
+}
+
+func TestQuickFreshnessCheckOmitted(t *testing.T) {
+	fresh := func(ng format.NodeGetter, mf *Manifest) bool {
+		ok, err := QuickFreshnessCheck(context.Background(), ng, mf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return ok
+	}
+
+	// skipped leaves & capped fanout leave the root's links out
+	g := NewGraph([]layer{{5, 4 * kb}})
+	ng := TestNodeGetter{g}
+	for _, opts := range []Options{{SkipLeaves: true}, {MaxFanoutPerNode: 3}} {
+		mf, err := NewManifestWithOpts(context.Background(), ng, g[0], opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !fresh(ng, mf) {
+			t.Errorf("expected links left out by %+v to be fresh", opts)
+		}
+	}
+	mf, err := NewManifestWithOpts(context.Background(), ng, g[0], Options{SkipLeaves: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	root := g[0].(*node)
+	root.links = append(root.links, newNode(kb))
+	if fresh(ng, mf) {
+		t.Error("expected a leaf added past the skipped ones to not be fresh")
+	}
+
+	// weak links from the root
+	a, b := newNode(4*kb), newNode(4*kb)
+	root = newNode(2 * kb)
+	root.links = []*node{a, b}
+	a.links = []*node{b}
+	ng = TestNodeGetter{[]format.Node{root, a, b}}
+	weak := func(from format.Node, l *format.Link) LinkKind {
+		if from.Cid().Equals(root.Cid()) && l.Cid.Equals(b.Cid()) {
+			return LinkWeak
+		}
+		return LinkStructural
+	}
+	mf, err = NewManifestWithOpts(context.Background(), ng, root, Options{LinkClassifier: weak})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.WeakLinks) != 1 || !fresh(ng, mf) {
+		t.Error("expected weak links from the root to be fresh")
+	}
+
+	// one root's dropped links don't excuse another losing a link
+	g = NewGraph([]layer{{5, 4 * kb}})
+	ng = TestNodeGetter{g}
+	mf, err = NewManifestWithOpts(context.Background(), ng, g[0], Options{MaxFanoutPerNode: 3})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	other := newNode(2 * kb)
+	kid, lost := newNode(kb), newNode(kb)
+	other.links = []*node{kid, lost}
+	n := len(mf.Nodes)
+	mf.Nodes = append(mf.Nodes, other.Cid().String(), kid.Cid().String())
+	mf.Sizes = append(mf.Sizes, 2*kb, kb)
+	mf.DroppedLinkCounts = append(mf.DroppedLinkCounts, 0, 0)
+	mf.Links = append(mf.Links, [2]int{n, n + 1})
+	mf.Invalidate()
+	ng = TestNodeGetter{append(g, other, kid, lost)}
+	if mf.DroppedLinks != 2 || fresh(ng, mf) {
+		t.Error("expected a root to only be allowed its own dropped links")
+	}
+
+	g = NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng = TestNodeGetter{g}
+	// every node has a parent, so only marked roots can be checked
+	mf, err = NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mf.Links = append(mf.Links, [2]int{mf.IndexOf(g[1].Cid()), mf.IndexOf(g[0].Cid())})
+	if _, err := QuickFreshnessCheck(context.Background(), ng, mf); err == nil {
+		t.Error("expected a manifest without roots to error")
+	}
+	if err := mf.AddRoot(g[0].Cid()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !fresh(ng, mf) {
+		t.Error("expected marked roots to be checked")
+	}
+}
+
+func TestDriftCheck(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+	mf, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := DriftCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Drifted() {
+		t.Errorf("expected no drift, got: %+v", report)
+	}
+
+	// add a child to the live DAG
+	parent := g[1].(*node)
+	extra := newNode(kb)
+	parent.links = append(parent.links, extra)
+	ng.Nodes = append(ng.Nodes, extra)
+
+	report, err = DriftCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "added", report.Added, extra.Cid())
+	if len(report.Removed) != 0 {
+		t.Errorf("expected no removed nodes, got: %v", report.Removed)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Kind != MismatchLinks || !report.Mismatches[0].Cid.Equals(parent.Cid()) {
+		t.Errorf("expected a link mismatch for the parent, got: %v", report.Mismatches)
+	}
+
+	// drop it again along with an original child
+	dropped := parent.links[0]
+	parent.links = parent.links[1 : len(parent.links)-1]
+	report, err = DriftCheck(context.Background(), ng, mf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCids(t, "removed", report.Removed, dropped.Cid())
+	if len(report.Added) != 0 {
+		t.Errorf("expected no added nodes, got: %v", report.Added)
+	}
+}
+
+func TestAssertCounts(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nodes, bytes := len(mf.Nodes), mf.TotalSize()
+	if err := mf.AssertCounts(nodes, bytes); err != nil {
+		t.Errorf("expected counts to match, got: %s", err.Error())
+	}
+
+	err = mf.AssertCounts(nodes+1, bytes)
+	if cerr, ok := err.(CountMismatchError); !ok || cerr.ExpectedNodes != nodes+1 || cerr.ActualNodes != nodes {
+		t.Errorf("expected node count mismatch, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "nodes") || strings.Contains(err.Error(), "bytes") {
+		t.Errorf("expected error to only describe nodes, got: %s", err.Error())
+	}
+
+	err = mf.AssertCounts(nodes, bytes-kb)
+	if cerr, ok := err.(CountMismatchError); !ok || cerr.ExpectedBytes != bytes-kb || cerr.ActualBytes != bytes {
+		t.Errorf("expected byte count mismatch, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "bytes") || strings.Contains(err.Error(), "nodes") {
+		t.Errorf("expected error to only describe bytes, got: %s", err.Error())
+	}
+}
+
+func TestCheckReferentialIntegrity(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+	root := g[0].(*node)
+	// neither is in the node getter
+	gone, deal := newNode(kb), newNode(kb)
+	root.links = append(root.links, gone, deal)
+	ng := TestNodeGetter{g}
+
+	mf, err := NewManifestWithOpts(context.Background(), ng, root, Options{
+		RecordMissingEdges: true,
+		ExternalRefs:       map[string]bool{deal.Cid().String(): true},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	absent, err := mf.CheckReferentialIntegrity()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(absent) != 1 || !absent[0].Equals(gone.Cid()) {
+		t.Errorf("expected only the unfetched node to be reported, got: %v", absent)
+	}
+
+	complete, err := NewManifestWithOpts(context.Background(), ng, root, Options{
+		Boundaries:   map[string]bool{gone.Cid().String(): true},
+		ExternalRefs: map[string]bool{deal.Cid().String(): true},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if absent, err := complete.CheckReferentialIntegrity(); err != nil || len(absent) != 0 {
+		t.Errorf("expected boundary & external references to be exempt, got: %v, %v", absent, err)
+	}
+}
@@ -0,0 +1,60 @@
+package manifest
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// NewManifestVersions generates a manifest of the newest keep versions of a
+// versioned dataset, where each version's root links to the previous version's
+// root with a link named versionLink. All content of the kept versions is
+// included but the chain is cut after keep versions, so older versions only
+// appear where newer ones share their content. A keep of 0 or less follows the
+// whole chain
+func NewManifestVersions(ctx context.Context, ng format.NodeGetter, head *cid.Cid, versionLink string, keep int) (*Manifest, error) {
+	node, err := ng.Get(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the oldest kept version, whose link to the previous version is cut
+	oldest := node
+	for hops := 1; keep <= 0 || hops < keep; hops++ {
+		prev := versionOf(oldest, versionLink)
+		if prev == nil {
+			break
+		}
+		if oldest, err = ng.Get(ctx, prev.Cid); err != nil {
+			return nil, err
+		}
+	}
+	cut := oldest.Cid().KeyString()
+
+	opts := Options{LinkExtractor: func(n format.Node) []*format.Link {
+		links := n.Links()
+		if n.Cid().KeyString() != cut {
+			return links
+		}
+		kept := make([]*format.Link, 0, len(links))
+		for _, l := range links {
+			if l.Name != versionLink {
+				kept = append(kept, l)
+			}
+		}
+		return kept
+	}}
+	return newManifest(ctx, ng, node, opts)
+}
+
+// versionOf returns the link to the previous version of a node, nil if it's
+// the first version
+func versionOf(n format.Node, versionLink string) *format.Link {
+	for _, l := range n.Links() {
+		if l.Name == versionLink {
+			return l
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipld-format"
+)
+
+// versionNode is a version root linking to its content & the previous version
+type versionNode struct {
+	*node
+	prev *versionNode
+}
+
+func (n versionNode) Links() []*format.Link {
+	links := n.node.Links()
+	if n.prev != nil {
+		links = append(links, &format.Link{Name: "prev", Size: n.prev.size, Cid: n.prev.Cid()})
+	}
+	return links
+}
+
+func TestNewManifestVersions(t *testing.T) {
+	var nodes []format.Node
+	var versions []*versionNode
+	var content []*node
+	var prev *versionNode
+	for i := 0; i < 5; i++ {
+		c := newNode(256 * kb)
+		v := &versionNode{node: newNode(kb), prev: prev}
+		v.links = []*node{c}
+		nodes = append(nodes, v, c)
+		versions = append(versions, v)
+		content = append(content, c)
+		prev = v
+	}
+	ng := TestNodeGetter{nodes}
+	head := versions[4]
+
+	mf, err := NewManifestVersions(context.Background(), ng, head.Cid(), "prev", 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	verifyManifest(t, mf)
+	if len(mf.Nodes) != 4 || len(mf.Links) != 3 {
+		t.Errorf("expected 4 nodes & 3 links, got: %d, %d", len(mf.Nodes), len(mf.Links))
+	}
+	for i := range versions {
+		kept := i >= 3
+		if mf.Contains(versions[i].Cid()) != kept || mf.Contains(content[i].Cid()) != kept {
+			t.Errorf("expected version %d kept: %t", i, kept)
+		}
+	}
+
+	mf, err = NewManifestVersions(context.Background(), ng, head.Cid(), "prev", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Nodes) != 10 {
+		t.Errorf("expected every version without a limit, got %d nodes", len(mf.Nodes))
+	}
+	mf, err = NewManifestVersions(context.Background(), ng, head.Cid(), "prev", 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mf.Nodes) != 10 {
+		t.Errorf("expected a keep longer than the chain to include every version, got %d nodes", len(mf.Nodes))
+	}
+}
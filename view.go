@@ -0,0 +1,39 @@
+package manifest
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// ManifestView is a read-only view of a manifest. Slices returned by a view
+// are copies, modifying them doesn't affect the underlying manifest
+type ManifestView interface {
+	Nodes() []string
+	Links() [][2]int
+	Sizes() []uint64
+	Len() int
+	TotalSize() uint64
+	Stats() Stats
+	Contains(id *cid.Cid) bool
+	IndexOf(id *cid.Cid) int
+	// Copy returns a mutable deep copy of the underlying manifest
+	Copy() *Manifest
+}
+
+// View returns a read-only view of the manifest
+func (m *Manifest) View() ManifestView {
+	return manifestView{m}
+}
+
+type manifestView struct {
+	m *Manifest
+}
+
+func (v manifestView) Nodes() []string           { return append([]string(nil), v.m.Nodes...) }
+func (v manifestView) Links() [][2]int           { return append([][2]int(nil), v.m.Links...) }
+func (v manifestView) Sizes() []uint64           { return append([]uint64(nil), v.m.Sizes...) }
+func (v manifestView) Len() int                  { return len(v.m.Nodes) }
+func (v manifestView) TotalSize() uint64         { return v.m.TotalSize() }
+func (v manifestView) Stats() Stats              { return v.m.Stats() }
+func (v manifestView) Contains(id *cid.Cid) bool { return v.m.Contains(id) }
+func (v manifestView) IndexOf(id *cid.Cid) int   { return v.m.IndexOf(id) }
+func (v manifestView) Copy() *Manifest           { return v.m.Copy() }
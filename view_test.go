@@ -0,0 +1,39 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestView(t *testing.T) {
+	g := NewGraph([]layer{
+		{2, 4 * kb},
+		{3, 256 * kb},
+	})
+
+	mf, err := NewManifest(context.Background(), TestNodeGetter{g}, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	orig := mf.Copy()
+	v := mf.View()
+
+	nodes, links, sizes := v.Nodes(), v.Links(), v.Sizes()
+	nodes[0] = "mutated"
+	links[0] = [2]int{-1, -1}
+	sizes[0] = 0
+	v.Copy().Nodes[1] = "mutated"
+
+	if !mf.Equal(orig) {
+		t.Error("expected mutating view slices to leave manifest unchanged")
+	}
+	if !v.Contains(g[0].Cid()) {
+		t.Error("expected view to contain root")
+	}
+	if v.Len() != len(g) {
+		t.Errorf("expected view length %d, got: %d", len(g), v.Len())
+	}
+	if v.TotalSize() != mf.TotalSize() {
+		t.Errorf("total size mismatch. %d != %d", v.TotalSize(), mf.TotalSize())
+	}
+}
@@ -0,0 +1,88 @@
+package manifest
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ipld-format"
+)
+
+// Walker generates a manifest one node at a time, for callers that need to
+// interleave manifest generation with other work or checkpoint between steps
+type Walker struct {
+	ms    *mstate
+	stack []walkItem
+}
+
+// walkItem is a cid waiting to be visited, along with the index of the parent
+// that links to it, -1 for the root
+type walkItem struct {
+	id     *cid.Cid
+	parent int
+}
+
+// NewWalker creates a walker for the DAG under root
+func NewWalker(ng format.NodeGetter, root *cid.Cid) *Walker {
+	return &Walker{
+		ms: &mstate{
+			ng:   ng,
+			cids: map[string]int{},
+			m:    &Manifest{Version: CurrentVersion},
+		},
+		stack: []walkItem{{root, -1}},
+	}
+}
+
+// Step fetches & adds exactly one node to the manifest, returning done once
+// there are no more nodes to visit. If fetching fails the node is kept, so
+// Step can be retried
+func (w *Walker) Step(ctx context.Context) (done bool, err error) {
+	w.drain()
+	if len(w.stack) == 0 {
+		return true, nil
+	}
+
+	item := w.stack[len(w.stack)-1]
+	node, err := w.ms.ng.Get(ctx, item.id)
+	if err != nil {
+		return false, err
+	}
+	w.stack = w.stack[:len(w.stack)-1]
+
+	idx, _ := w.ms.insert(node, w.ms.classify(node))
+	w.link(item.parent, idx)
+
+	// push in reverse so links are visited in order
+	links := node.Links()
+	for i := len(links) - 1; i >= 0; i-- {
+		w.stack = append(w.stack, walkItem{links[i].Cid, idx})
+	}
+
+	w.drain()
+	return len(w.stack) == 0, nil
+}
+
+// Manifest returns the manifest generated so far
+func (w *Walker) Manifest() *Manifest {
+	return w.ms.m
+}
+
+// drain pops cids that are already in the manifest off the stack, recording
+// only their links
+func (w *Walker) drain() {
+	for len(w.stack) > 0 {
+		item := w.stack[len(w.stack)-1]
+		idx, ok := w.ms.cids[item.id.KeyString()]
+		if !ok {
+			return
+		}
+		w.stack = w.stack[:len(w.stack)-1]
+		w.link(item.parent, idx)
+	}
+}
+
+func (w *Walker) link(parent, idx int) {
+	if parent >= 0 {
+		w.ms.m.Links = append(w.ms.m.Links, [2]int{parent, idx})
+	}
+}
@@ -0,0 +1,49 @@
+package manifest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWalker(t *testing.T) {
+	g := NewSharedGraph([]layer{
+		{3, 4 * kb},
+		{5, 5 * kb},
+		{10, 256 * kb},
+	})
+	ng := TestNodeGetter{g}
+
+	expect, err := NewManifest(context.Background(), ng, g[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	w := NewWalker(ng, g[0].Cid())
+	steps := 0
+	for done := false; !done; steps++ {
+		if done, err = w.Step(context.Background()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := len(w.Manifest().Nodes); got != steps+1 {
+			t.Fatalf("expected step %d to add exactly one node, manifest has %d nodes", steps, got)
+		}
+	}
+
+	if steps != len(g) {
+		t.Errorf("expected %d steps, got: %d", len(g), steps)
+	}
+	got := w.Manifest()
+	verifyManifest(t, got)
+	if !got.Equal(expect) {
+		t.Error("expected walker manifest to equal NewManifest output")
+	}
+	for i := range expect.Nodes {
+		if expect.Nodes[i] != got.Nodes[i] {
+			t.Fatalf("node order mismatch at %d", i)
+		}
+	}
+
+	if done, err := w.Step(context.Background()); !done || err != nil {
+		t.Errorf("expected finished walker to stay done, got: %t, %v", done, err)
+	}
+}